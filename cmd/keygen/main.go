@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"go.uber.org/zap"
+
+	"github.com/Jourloy/go-metrics-collector/internal/encrypt"
+)
+
+var (
+	Bits    = flag.Int(`bits`, 4096, `Size of RSA key`)
+	Private = flag.String(`private`, `private.pem`, `Path of private key for server`)
+	Public  = flag.String(`public`, `public.pem`, `Path of public key for agent`)
+)
+
+func init() {
+	zap.ReplaceGlobals(zap.Must(zap.NewDevelopment()))
+}
+
+func main() {
+	flag.Parse()
+
+	privatePEM, publicPEM, err := encrypt.GenerateKeys(*Bits)
+	if err != nil {
+		zap.L().Fatal(`Cannot generate keys`, zap.Error(err))
+	}
+
+	if err := os.WriteFile(*Private, privatePEM, 0600); err != nil {
+		zap.L().Fatal(`Cannot write private key`, zap.Error(err))
+	}
+
+	if err := os.WriteFile(*Public, publicPEM, 0644); err != nil {
+		zap.L().Fatal(`Cannot write public key`, zap.Error(err))
+	}
+
+	zap.L().Info(`Keys generated`, zap.String(`private`, *Private), zap.String(`public`, *Public))
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	_ "net/http/pprof"
+	"os"
 
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
 
 	"github.com/Jourloy/go-metrics-collector/internal/server"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository"
 )
 
 var buildVersion string = `N/A`
@@ -23,6 +25,14 @@ func main() {
 	}
 	zap.L().Info(`Application initialized`)
 
+	// `server migrate [flags] up|down|status [flags]` runs migrations of Postgres without server
+	if len(os.Args) > 1 && os.Args[1] == `migrate` {
+		if err := repository.Migrate(os.Args[2:], os.Stdout); err != nil {
+			zap.L().Fatal(`Migration failed`, zap.Error(err))
+		}
+		return
+	}
+
 	zap.L().Info(`Information about app`, zap.String(`buildVersion`, buildVersion), zap.String(`buildDate`, buildDate), zap.String(`buildCommit`, buildCommit))
 
 	server.Start()
@@ -8,27 +8,27 @@ package collector
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
 	"os"
-	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/Jourloy/go-metrics-collector/internal/agent/outbox"
 	"github.com/Jourloy/go-metrics-collector/internal/agent/rpc"
+	"github.com/Jourloy/go-metrics-collector/internal/encrypt"
 	"github.com/Jourloy/go-metrics-collector/internal/proto"
+	"github.com/Jourloy/go-metrics-collector/internal/sign"
 	"github.com/avast/retry-go"
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/mem"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 var (
@@ -37,28 +37,71 @@ var (
 	PollInterval   = flag.Int("p", 2, "Poll Interval")
 	Key            = flag.String(`k`, ``, `Key for hash`)
 	RateLimit      = flag.Int(`i`, 0, `Rate limit. 0 - no limit`)
+	BatchSize      = flag.Int(`b`, 100, `Max count of metrics in one request. 0 - no limit`)
+	Transport      = flag.String(`transport`, `http`, `Transport for reports: http or grpc`)
+	GRPCAddress    = flag.String(`g`, `localhost:3200`, `Host of the gRPC server`)
+	CryptoKey      = flag.String(`crypto-key`, ``, `Path to public key of the server for encryption`)
+	OutboxDir      = flag.String(`outbox`, ``, `Directory for reports which cannot be sent. Empty - don't save`)
+	OutboxMaxBytes = flag.Int64(`outbox-size`, 64<<20, `Max size of outbox in bytes`)
+	OutboxMaxAge   = flag.Duration(`outbox-age`, 24*time.Hour, `Max age of report in outbox`)
+	Collectors     = flag.String(`collectors`, `memory,cpu`, `Comma separated collectors of host metrics: memory, cpu, swap, disk, diskio, net, load, fd, uptime`)
+	SourceTimeout  = flag.Duration(`source-timeout`, 10*time.Second, `Max duration of one poll of source`)
+	StatsdAddress  = flag.String(`statsd`, ``, `Address of StatsD listener: :8125, udp://:8125 or unixgram:///path. Empty - disabled`)
+	HostLabel      = flag.Bool(`host-label`, true, `Add host label with hostname to every metric`)
+	Labels         = flag.String(`labels`, ``, `Comma separated labels added to every metric, e.g. env=prod,dc=eu`)
 )
 
+// SourceConfigs are configs of sources from `agent.config.json`.
+var SourceConfigs []SourceConfig
+
 type Collector struct {
-	done chan struct{}
-	pr   proto.MetricServiceClient
+	done      chan struct{}
+	pr        *rpc.Client
+	publicKey *rsa.PublicKey
+	outbox    *outbox.Outbox
+	dropped   int64 // Count of dropped reports which is already added to OutboxDropped
+	sources   []sourceRunner
+	labels    map[string]string // Labels added to every metric
+	sending   sync.Mutex
 	sync.Mutex
 	gauge   map[string]float64
 	counter map[string]int64
+	series  map[string]series // Names and labels of metrics with labels by metricKey
+}
+
+// series is a name and labels of metric.
+type series struct {
+	id     string
+	labels map[string]string
 }
 
 type Metric struct {
-	ID    string   `json:"id"`              // Name of metric
-	MType string   `json:"type"`            // Gauge or Counter
-	Delta *int64   `json:"delta,omitempty"` // Value if metric is a counter
-	Value *float64 `json:"value,omitempty"` // Value if metric is a gauge
+	ID     string            `json:"id"`               // Name of metric
+	MType  string            `json:"type"`             // Gauge or Counter
+	Delta  *int64            `json:"delta,omitempty"`  // Value if metric is a counter
+	Value  *float64          `json:"value,omitempty"`  // Value if metric is a gauge
+	Labels map[string]string `json:"labels,omitempty"` // Dimensions of metric, e.g. host or cpu
+
+	key string // metricKey of counter in the Collector, empty for reports from outbox
 }
 
 type AgentConfig struct {
-	Address        string `json:"address"`
-	ReportInterval string `json:"report_interval"`
-	PollInterval   string `json:"poll_interval"`
-	CryptoKey      string `json:"crypto_key"`
+	Address        string            `json:"address"`
+	ReportInterval string            `json:"report_interval"`
+	PollInterval   string            `json:"poll_interval"`
+	CryptoKey      string            `json:"crypto_key"`
+	BatchSize      *int              `json:"batch_size"`
+	Transport      string            `json:"transport"`
+	GRPCAddress    string            `json:"grpc_address"`
+	OutboxDir      string            `json:"outbox_dir"`
+	OutboxMaxBytes *int64            `json:"outbox_max_bytes"`
+	OutboxMaxAge   string            `json:"outbox_max_age"`
+	Collectors     []string          `json:"collectors"`
+	SourceTimeout  string            `json:"source_timeout"`
+	StatsdAddress  string            `json:"statsd_address"`
+	HostLabel      *bool             `json:"host_label"`
+	Labels         map[string]string `json:"labels"`
+	Sources        []SourceConfig    `json:"sources"`
 }
 
 // envParse initializes the ServerAddress, PollInterval, and ReportInterval
@@ -86,10 +129,68 @@ func envParse() {
 
 	if rateENV, exist := os.LookupEnv(`RATE_LIMIT`); exist {
 		if i, err := strconv.Atoi(rateENV); err == nil {
-			ReportInterval = &i
+			RateLimit = &i
+		}
+	}
+
+	if batchENV, exist := os.LookupEnv(`BATCH_SIZE`); exist {
+		if i, err := strconv.Atoi(batchENV); err == nil {
+			BatchSize = &i
 		}
 	}
 
+	if transportENV, exist := os.LookupEnv(`TRANSPORT`); exist {
+		Transport = &transportENV
+	}
+
+	if grpcENV, exist := os.LookupEnv(`GRPC_ADDRESS`); exist {
+		GRPCAddress = &grpcENV
+	}
+
+	if keyENV, exist := os.LookupEnv(`CRYPTO_KEY`); exist {
+		CryptoKey = &keyENV
+	}
+
+	if outboxENV, exist := os.LookupEnv(`OUTBOX_DIR`); exist {
+		OutboxDir = &outboxENV
+	}
+
+	if sizeENV, exist := os.LookupEnv(`OUTBOX_MAX_BYTES`); exist {
+		if i, err := strconv.ParseInt(sizeENV, 10, 64); err == nil {
+			OutboxMaxBytes = &i
+		}
+	}
+
+	if ageENV, exist := os.LookupEnv(`OUTBOX_MAX_AGE`); exist {
+		if d, err := time.ParseDuration(ageENV); err == nil {
+			OutboxMaxAge = &d
+		}
+	}
+
+	if collectorsENV, exist := os.LookupEnv(`COLLECTORS`); exist {
+		Collectors = &collectorsENV
+	}
+
+	if timeoutENV, exist := os.LookupEnv(`SOURCE_TIMEOUT`); exist {
+		if d, err := time.ParseDuration(timeoutENV); err == nil {
+			SourceTimeout = &d
+		}
+	}
+
+	if statsdENV, exist := os.LookupEnv(`STATSD_ADDRESS`); exist {
+		StatsdAddress = &statsdENV
+	}
+
+	if hostENV, exist := os.LookupEnv(`HOST_LABEL`); exist {
+		if b, err := strconv.ParseBool(hostENV); err == nil {
+			HostLabel = &b
+		}
+	}
+
+	if labelsENV, exist := os.LookupEnv(`LABELS`); exist {
+		Labels = &labelsENV
+	}
+
 	if file, err := os.Open(`./agent.config.json`); err == nil {
 		defer file.Close()
 
@@ -106,6 +207,62 @@ func envParse() {
 		if i, err := strconv.Atoi(config.ReportInterval); err == nil {
 			ReportInterval = &i
 		}
+
+		if config.BatchSize != nil {
+			BatchSize = config.BatchSize
+		}
+
+		if config.Transport != `` {
+			Transport = &config.Transport
+		}
+
+		if config.GRPCAddress != `` {
+			GRPCAddress = &config.GRPCAddress
+		}
+
+		if config.CryptoKey != `` {
+			CryptoKey = &config.CryptoKey
+		}
+
+		if config.OutboxDir != `` {
+			OutboxDir = &config.OutboxDir
+		}
+
+		if config.OutboxMaxBytes != nil {
+			OutboxMaxBytes = config.OutboxMaxBytes
+		}
+
+		if d, err := time.ParseDuration(config.OutboxMaxAge); err == nil {
+			OutboxMaxAge = &d
+		}
+
+		if config.Collectors != nil {
+			collectors := strings.Join(config.Collectors, `,`)
+			Collectors = &collectors
+		}
+
+		if d, err := time.ParseDuration(config.SourceTimeout); err == nil {
+			SourceTimeout = &d
+		}
+
+		if config.StatsdAddress != `` {
+			StatsdAddress = &config.StatsdAddress
+		}
+
+		if config.HostLabel != nil {
+			HostLabel = config.HostLabel
+		}
+
+		if len(config.Labels) > 0 {
+			pairs := make([]string, 0, len(config.Labels))
+			for k, v := range config.Labels {
+				pairs = append(pairs, k+`=`+v)
+			}
+			labels := strings.Join(pairs, `,`)
+			Labels = &labels
+		}
+
+		SourceConfigs = config.Sources
 	}
 
 	zap.L().Debug(`Collector initialized`)
@@ -119,34 +276,106 @@ func CreateCollector() *Collector {
 	// Parse environment variables
 	envParse()
 
-	pr := rpc.Connect()
-
-	return &Collector{
+	c := &Collector{
 		gauge:   make(map[string]float64),
 		counter: make(map[string]int64),
+		series:  make(map[string]series),
 		done:    make(chan struct{}),
-		pr:      pr,
 	}
+
+	labels, err := parseLabels(*Labels)
+	if err != nil {
+		zap.L().Fatal(`Cannot parse labels`, zap.Error(err))
+	}
+	if *HostLabel {
+		if _, ok := labels[`host`]; !ok {
+			hostname, err := os.Hostname()
+			if err != nil {
+				zap.L().Fatal(`Cannot get hostname`, zap.Error(err))
+			}
+			labels[`host`] = hostname
+		}
+	}
+	c.labels = labels
+
+	// Load public key for encryption
+	if *CryptoKey != `` {
+		key, err := encrypt.LoadPublicKey(*CryptoKey)
+		if err != nil {
+			zap.L().Fatal(`Cannot load public key`, zap.Error(err))
+		}
+		c.publicKey = key
+	}
+
+	// Create sources, runtime metrics are always collected
+	names := []string{`runtime`}
+	for _, name := range strings.Split(*Collectors, `,`) {
+		if name = strings.TrimSpace(name); name != `` {
+			names = append(names, name)
+		}
+	}
+
+	configs := SourceConfigs
+	if *StatsdAddress != `` {
+		options, _ := json.Marshal(statsdOptions{Address: *StatsdAddress})
+		configs = append(configs[:len(configs):len(configs)], SourceConfig{Name: `statsd`, Options: options})
+	}
+
+	sources, err := buildSources(names, configs, time.Duration(*PollInterval)*time.Second, *SourceTimeout)
+	if err != nil {
+		zap.L().Fatal(`Cannot create sources`, zap.Error(err))
+	}
+	c.sources = sources
+
+	// Open outbox for reports which cannot be sent
+	if *OutboxDir != `` {
+		o, err := outbox.Open(outbox.Options{
+			Dir:      *OutboxDir,
+			MaxBytes: *OutboxMaxBytes,
+			MaxAge:   *OutboxMaxAge,
+		})
+		if err != nil {
+			zap.L().Fatal(`Cannot open outbox`, zap.Error(err))
+		}
+		c.outbox = o
+	}
+
+	switch *Transport {
+	case `grpc`:
+		pr, err := rpc.Connect(*GRPCAddress,
+			grpc.WithChainUnaryInterceptor(rpc.UnaryLoggerInterceptor(), rpc.UnaryHashInterceptor(*Key)),
+			grpc.WithChainStreamInterceptor(rpc.StreamLoggerInterceptor(), rpc.StreamHashInterceptor(*Key)),
+		)
+		if err != nil {
+			zap.L().Fatal(`Cannot create gRPC client`, zap.Error(err))
+		}
+		c.pr = pr
+	case `http`:
+	default:
+		zap.L().Fatal(`Unknown transport`, zap.String(`transport`, *Transport))
+	}
+
+	return c
 }
 
-// StartTickers starts the tickers for collecting and sending metrics in the Collector struct.
+// StartTickers starts polling of sources and the ticker for sending metrics in the Collector struct.
+//
+// Each source is polled in its own goroutine with its own interval.
 func (c *Collector) StartTickers() {
-	// Start tickers
-	collectTicker := time.NewTicker(time.Duration(*PollInterval) * time.Second)
-	defer collectTicker.Stop()
+	for _, r := range c.sources {
+		go c.runSource(r)
+	}
 
+	// Start ticker
 	sendTicker := time.NewTicker(time.Duration(*ReportInterval) * time.Second)
 	defer sendTicker.Stop()
 
-	zap.L().Info(`Collector's tickers started`)
+	zap.L().Info(`Collector's tickers started`, zap.Int(`sources`, len(c.sources)))
 
 	for {
 		select {
 		case <-c.done:
 			return
-		case <-collectTicker.C:
-			c.collectMetric()
-			c.collectPsutilMetric()
 		case <-sendTicker.C:
 			go c.sendMetrics()
 		}
@@ -157,163 +386,361 @@ func (c *Collector) StartTickers() {
 func (c *Collector) CloseChannel() {
 	zap.L().Info(`Collector's tickers stopped`)
 	close(c.done)
+
+	if c.pr != nil {
+		c.pr.Close()
+	}
+
+	// Stop listeners of sources
+	for _, r := range c.sources {
+		if closer, ok := r.source.(io.Closer); ok {
+			closer.Close()
+		}
+	}
 }
 
-// collectMetric collects various metrics and stores them in the gauge and counter maps.
+// sendMetrics takes snapshot of collected metrics, splits it into batches and
+// sends them to the server.
 //
-// For mentor: This is already gorutine, looks like worker, so I don't change code below
-func (c *Collector) collectMetric() {
-	var memStats runtime.MemStats
-	runtime.ReadMemStats(&memStats)
-
-	c.gauge[`Alloc`] = float64(memStats.Alloc)
-	c.gauge[`BuckHashSys`] = float64(memStats.BuckHashSys)
-	c.gauge[`Frees`] = float64(memStats.Frees)
-	c.gauge[`GCCPUFraction`] = float64(memStats.GCCPUFraction)
-	c.gauge[`GCSys`] = float64(memStats.GCSys)
-	c.gauge[`HeapAlloc`] = float64(memStats.HeapAlloc)
-	c.gauge[`HeapIdle`] = float64(memStats.HeapIdle)
-	c.gauge[`HeapInuse`] = float64(memStats.HeapInuse)
-	c.gauge[`HeapReleased`] = float64(memStats.HeapReleased)
-	c.gauge[`HeapObjects`] = float64(memStats.HeapObjects)
-	c.gauge[`HeapSys`] = float64(memStats.HeapSys)
-	c.gauge[`LastGC`] = float64(memStats.LastGC)
-	c.gauge[`Lookups`] = float64(memStats.Lookups)
-	c.gauge[`MCacheInuse`] = float64(memStats.MCacheInuse)
-	c.gauge[`MCacheSys`] = float64(memStats.MCacheSys)
-	c.gauge[`MSpanInuse`] = float64(memStats.MSpanInuse)
-	c.gauge[`MSpanSys`] = float64(memStats.MSpanSys)
-	c.gauge[`Mallocs`] = float64(memStats.Mallocs)
-	c.gauge[`NextGC`] = float64(memStats.NextGC)
-	c.gauge[`NumForcedGC`] = float64(memStats.NumForcedGC)
-	c.gauge[`NumGC`] = float64(memStats.NumGC)
-	c.gauge[`OtherSys`] = float64(memStats.OtherSys)
-	c.gauge[`PauseTotalNs`] = float64(memStats.PauseTotalNs)
-	c.gauge[`StackInuse`] = float64(memStats.StackInuse)
-	c.gauge[`StackSys`] = float64(memStats.StackSys)
-	c.gauge[`Sys`] = float64(memStats.Sys)
-	c.gauge[`TotalAlloc`] = float64(memStats.TotalAlloc)
-	c.gauge[`RandomValue`] = rand.Float64()
-
-	c.counter[`PollCount`]++
-
-	zap.L().Debug(`Metrics collected`)
+// Count of metrics in one batch is limited by BatchSize and count of parallel
+// requests is limited by RateLimit. If outbox is enabled, reports left from
+// previous failures are sent first, and batches which cannot be sent are saved
+// into outbox.
+func (c *Collector) sendMetrics() {
+	// Reports are sent one after another, so outbox keeps their order
+	c.sending.Lock()
+	defer c.sending.Unlock()
+
+	batches := splitBatches(c.snapshot(), *BatchSize)
+	if len(batches) == 0 {
+		return
+	}
+
+	// Send saved reports. If server is still unavailable, save current
+	// batches after them without sending.
+	if c.outbox != nil {
+		defer c.updateOutboxMetrics()
+
+		if err := c.outbox.Replay(c.sendSaved); err != nil {
+			zap.L().Warn(`Cannot send reports from outbox`, zap.Error(err))
+			for _, batch := range batches {
+				c.saveBatch(batch)
+			}
+			return
+		}
+	}
+
+	rate := len(batches)
+	if *RateLimit > 0 && *RateLimit < rate {
+		rate = *RateLimit
+	}
+
+	// Create a channel to send batches
+	jobs := make(chan []Metric)
+
+	var wg sync.WaitGroup
+
+	// Launch workers
+	for i := 0; i < rate; i++ {
+		zap.L().Debug(`Metric worker launched`, zap.Int(`id`, i))
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			c.sendMetricWorker(id, jobs)
+		}(i)
+	}
+
+	for _, batch := range batches {
+		jobs <- batch
+	}
+
+	// Wait for all batches to be sent
+	close(jobs)
+	wg.Wait()
 }
 
-func (c *Collector) collectPsutilMetric() {
-	v, err := mem.VirtualMemory()
-	if err != nil {
-		zap.L().Error(`Cannot get virtual memory`, zap.Error(err))
+// sendSaved sends report from outbox.
+//
+// Parameters:
+//   - data: the report saved by saveBatch.
+//
+// Returns:
+//   - error: an error if report was not sent.
+func (c *Collector) sendSaved(data []byte) error {
+	var batch []Metric
+	if err := json.Unmarshal(data, &batch); err != nil {
+		// Broken report will never be sent, so skip it
+		zap.L().Error(`Cannot decode report from outbox`, zap.Error(err))
+		return nil
+	}
+
+	return c.sendBatch(batch)
+}
+
+// saveBatch saves batch into outbox. If outbox is disabled, counters of batch
+// are sent with the next report and gauges are replaced by new values.
+//
+// Parameters:
+//   - batch: the metrics which cannot be sent.
+func (c *Collector) saveBatch(batch []Metric) {
+	if c.outbox == nil {
 		return
 	}
 
-	cp, err := cpu.Times(true)
+	b, err := json.Marshal(batch)
 	if err != nil {
-		zap.L().Error(`Cannot get cpu info`, zap.Error(err))
+		zap.L().Error(`Cannot encode report`, zap.Error(err))
 		return
 	}
 
-	c.gauge[`TotalMemory`] = float64(v.Total)
-	c.gauge[`FreeMemory`] = float64(v.Free)
-
-	for i := 0; i < len(cp); i++ {
-		c.gauge[`CPUutilization`+strconv.Itoa(i)] = float64(cp[i].System)
+	if err := c.outbox.Push(b); err != nil {
+		zap.L().Error(`Cannot save report into outbox`, zap.Error(err))
+		return
 	}
+
+	c.sent(batch)
+}
+
+// updateOutboxMetrics sets self-metrics of outbox for the next report.
+//
+// OutboxDropped is a counter, so only reports dropped since the previous
+// call are added to it.
+func (c *Collector) updateOutboxMetrics() {
+	c.Lock()
+	defer c.Unlock()
+
+	dropped := c.outbox.Dropped()
+
+	c.gauge[`OutboxDepth`] = float64(c.outbox.Len())
+	c.counter[`OutboxDropped`] += dropped - c.dropped
+	c.dropped = dropped
 }
 
-type Statuses struct {
-	Success  int
-	Internal int
-	Fail     int
+// sent subtracts deltas of sent counters, so the next report contains only
+// increase since this one. Deltas of batch which is neither sent nor saved
+// into outbox are kept and sent with the next report.
+//
+// Parameters:
+//   - batch: the metrics which were delivered to the server or saved into outbox.
+func (c *Collector) sent(batch []Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, m := range batch {
+		if m.key != `` && m.Delta != nil {
+			c.counter[m.key] -= *m.Delta
+		}
+	}
 }
 
-func (c *Collector) sendMetrics() {
+// snapshot copies collected metrics into a slice.
+//
+// Labels of the Collector are added to every metric, labels of metric win.
+// Counters keep their deltas until the batch is sent, see sent.
+//
+// Returns:
+//   - []Metric: gauge and counter metrics.
+func (c *Collector) snapshot() []Metric {
 	c.Lock()
 	defer c.Unlock()
 
-	// Create a channel to send metrics
-	metric := make(chan Metric)
+	metrics := make([]Metric, 0, len(c.gauge)+len(c.counter))
+
+	for key, value := range c.gauge {
+		v := value
+		id, labels := c.seriesOf(key)
+		metrics = append(metrics, Metric{
+			ID:     id,
+			MType:  `gauge`,
+			Value:  &v,
+			Labels: labels,
+		})
+	}
 
-	jobs := len(c.gauge) + len(c.counter)
-	rate := jobs
+	for key, delta := range c.counter {
+		d := delta
+		id, labels := c.seriesOf(key)
+		metrics = append(metrics, Metric{
+			ID:     id,
+			MType:  `counter`,
+			Delta:  &d,
+			Labels: labels,
+			key:    key,
+		})
+	}
 
-	if *RateLimit > 0 {
-		rate = *RateLimit
+	return metrics
+}
+
+// seriesOf returns name and labels of metric by its key.
+//
+// Parameters:
+//   - key: the metricKey of metric.
+//
+// Returns:
+//   - string: the name of metric.
+//   - map[string]string: the labels of metric with labels of the Collector, nil if empty.
+func (c *Collector) seriesOf(key string) (string, map[string]string) {
+	s, ok := c.series[key]
+	if !ok {
+		s = series{id: key}
 	}
 
-	// Launch workers
-	for i := 0; i < rate; i++ {
-		zap.L().Debug(`Metric worker launched`, zap.Int(`id`, i))
-		go c.sendMetricWorker(i, metric)
+	if len(c.labels) == 0 {
+		return s.id, s.labels
 	}
 
-	// Add gauge metrics
-	for i, v := range c.gauge {
-		metric <- Metric{
-			ID:    i,
-			MType: `gauge`,
-			Value: &v,
-		}
+	labels := make(map[string]string, len(c.labels)+len(s.labels))
+	for k, v := range c.labels {
+		labels[k] = v
+	}
+	for k, v := range s.labels {
+		labels[k] = v
 	}
 
-	// Add counter metrics
-	for i, v := range c.counter {
-		metric <- Metric{
-			ID:    i,
-			MType: `counter`,
-			Delta: &v,
+	return s.id, labels
+}
+
+// parseLabels parses comma separated labels, e.g. `env=prod,dc=eu`.
+//
+// Parameters:
+//   - s: the labels.
+//
+// Returns:
+//   - map[string]string: the labels, empty if s is empty.
+//   - error: error if label is not `name=value`.
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	for _, pair := range strings.Split(s, `,`) {
+		if pair = strings.TrimSpace(pair); pair == `` {
+			continue
+		}
+
+		k, v, ok := strings.Cut(pair, `=`)
+		k = strings.TrimSpace(k)
+		if !ok || k == `` {
+			return nil, fmt.Errorf(`expected "name=value", got %q`, pair)
 		}
+		labels[k] = strings.TrimSpace(v)
+	}
+
+	return labels, nil
+}
+
+// splitBatches splits metrics into batches with no more than size metrics in each.
+//
+// Parameters:
+//   - metrics: metrics to split.
+//   - size: max count of metrics in one batch. If size <= 0, only one batch is returned.
+//
+// Returns:
+//   - [][]Metric: batches of metrics.
+func splitBatches(metrics []Metric, size int) [][]Metric {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	if size <= 0 {
+		size = len(metrics)
+	}
+
+	batches := make([][]Metric, 0, (len(metrics)+size-1)/size)
+	for start := 0; start < len(metrics); start += size {
+		end := min(start+size, len(metrics))
+		batches = append(batches, metrics[start:end])
 	}
 
-	// Wait for all metrics to be sent
-	close(metric)
+	return batches
 }
 
-// sendMetricWorker is a function that processes metrics from a channel and sends them to a remote server.
+// sendMetricWorker is a function that processes batches from a channel and sends them to a remote server.
 //
 // Parameters:
 //   - id: an integer representing the worker's ID.
-//   - metric: a channel that receives Metric objects.
-func (c *Collector) sendMetricWorker(id int, metric <-chan Metric) {
-	for m := range metric {
-		var code = 0
+//   - batches: a channel that receives batches of metrics.
+func (c *Collector) sendMetricWorker(id int, batches <-chan []Metric) {
+	for batch := range batches {
 		if err := c.retryIfError(
 			func() error {
-				c, err := c.sendPOST(m, nil)
-				code = c
-				return err
+				return c.sendBatch(batch)
 			},
 		); err != nil {
 			zap.L().Error(err.Error())
+			c.saveBatch(batch)
+		} else {
+			c.sent(batch)
 		}
 
-		zap.L().Debug(`Metric worker finished`, zap.Int(`id`, id), zap.Int(`code`, code), zap.String(`id`, m.ID))
+		zap.L().Debug(`Metric worker finished`, zap.Int(`id`, id), zap.Int(`metrics`, len(batch)))
+	}
+}
+
+// sendBatch sends batch of metrics to the server with selected transport.
+//
+// Parameters:
+//   - batch: the metrics to be sent.
+//
+// Returns:
+//   - error: an error if batch was not sent.
+func (c *Collector) sendBatch(batch []Metric) error {
+	if c.pr != nil {
+		return c.sendRPC(batch)
+	}
+
+	code, err := c.sendPOST(batch)
+	if err != nil {
+		return err
 	}
 
-	// GRPC
+	zap.L().Debug(`Batch sent`, zap.Int(`code`, code))
 
-	/* for m := range metric {
-		if m.MType == `gauge` {
-			c.pr.UpdateGauge(context.Background(), &proto.UpdateGaugeRequest{
-				Value: *m.Value,
-				Name: m.ID,
-			})
-		}
+	return nil
+}
 
-		if m.MType == `counter` {
-			c.pr.UpdateCounter(context.Background(), &proto.UpdateCounterRequest{
-				Value: *m.Delta,
-				Name: m.ID,
-			})
+// sendRPC sends batch of metrics into the gRPC stream. Batch is sent when
+// server acknowledges it, ack is waited until the next report.
+//
+// Parameters:
+//   - batch: the metrics to be sent.
+//
+// Returns:
+//   - error: an error if batch was not sent.
+func (c *Collector) sendRPC(batch []Metric) error {
+	metrics := make([]*proto.Metric, 0, len(batch))
+
+	for _, m := range batch {
+		switch m.MType {
+		case `gauge`:
+			metrics = append(metrics, &proto.Metric{Id: m.ID, Type: proto.MetricType_GAUGE, Value: *m.Value, Labels: m.Labels})
+		case `counter`:
+			metrics = append(metrics, &proto.Metric{Id: m.ID, Type: proto.MetricType_COUNTER, Delta: *m.Delta, Labels: m.Labels})
 		}
-	} */
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*ReportInterval)*time.Second)
+	defer cancel()
+
+	return c.pr.StreamMetrics(ctx, metrics)
+}
+
+// batchError is a metric which was rejected by the server in batch request.
+type batchError struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
 }
 
-// sendPOST sends a POST request to the server with the given metric.
+// sendPOST sends a POST request to the server with the given batch of metrics.
 //
 // Parameters:
-// - metric: the metric to be sent
-func (c *Collector) sendPOST(metrics Metric, statuses *Statuses) (int, error) {
+//   - metrics: the metrics to be sent
+//
+// Returns:
+//   - int: status code of the response.
+//   - error: an error if request failed or batch was not accepted, e.g. server
+//     is unavailable or rejected signature, so batch should be sent again.
+func (c *Collector) sendPOST(metrics []Metric) (int, error) {
 	b, err := json.Marshal(metrics)
 	if err != nil {
 		return 0, err
@@ -326,8 +753,18 @@ func (c *Collector) sendPOST(metrics Metric, statuses *Statuses) (int, error) {
 	w.Write(b)
 	w.Close()
 
+	body := gz.Bytes()
+
+	// Encrypt the compressed body
+	if c.publicKey != nil {
+		body, err = encrypt.Encrypt(c.publicKey, body)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// Create the request
-	req, err := http.NewRequest(http.MethodPost, `http://`+*ServerAddress+`/update/`, &gz)
+	req, err := http.NewRequest(http.MethodPost, `http://`+*ServerAddress+`/updates/`, bytes.NewReader(body))
 	if err != nil {
 		return 0, err
 	}
@@ -336,10 +773,13 @@ func (c *Collector) sendPOST(metrics Metric, statuses *Statuses) (int, error) {
 	req.Header.Set(`Content-Encoding`, `gzip`)
 	req.Header.Set(`Accept-Encoding`, `gzip`)
 	req.Header.Set(`Content-Type`, `application/json`)
+	if c.publicKey != nil {
+		req.Header.Set(encrypt.HeaderEncryption, encrypt.Algorithm)
+	}
 
 	// Add hash header
 	if *Key != `` {
-		c.addHashHeader(req, gz.Bytes())
+		c.addHashHeader(req, b)
 	}
 
 	// Send the request
@@ -349,36 +789,69 @@ func (c *Collector) sendPOST(metrics Metric, statuses *Statuses) (int, error) {
 	}
 	defer res.Body.Close()
 
+	// Log metrics rejected by the server. Batch is not applied in that case,
+	// so there is no reason to retry it.
+	if res.StatusCode == http.StatusBadRequest && c.logBatchErrors(res) {
+		return res.StatusCode, nil
+	}
+
+	// Other errors, e.g. rejected signature or unavailable storage, are not
+	// caused by metrics, batch should be sent again
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return res.StatusCode, fmt.Errorf(`server responded with %d`, res.StatusCode)
+	}
+
 	return res.StatusCode, nil
 }
 
-// addHashHeader adds a hash header to the given http.Request and sets the value of the 'HashSHA256' header field.
+// logBatchErrors logs metrics rejected by the server.
 //
 // Parameters:
-// - req: a pointer to an http.Request object to which the hash header will be added.
-// - body: a byte slice representing the body of the request.
-func (c *Collector) addHashHeader(req *http.Request, body []byte) {
-	key := sha256.Sum256([]byte(*Key))
+//   - res: the response of batch request.
+//
+// Returns:
+//   - bool: true if response has errors of metrics.
+func (c *Collector) logBatchErrors(res *http.Response) bool {
+	var body io.Reader = res.Body
+	if res.Header.Get(`Content-Encoding`) == `gzip` {
+		r, err := gzip.NewReader(res.Body)
+		if err != nil {
+			zap.L().Error(`Cannot read response`, zap.Error(err))
+			return false
+		}
+		defer r.Close()
+		body = r
+	}
 
-	// Create cipher block
-	aesblock, err := aes.NewCipher(key[:])
-	if err != nil {
-		zap.L().Error(`Cannot create AES block`, zap.Error(err))
-		return
+	var rejected struct {
+		Errors []batchError `json:"errors"`
+	}
+	if err := json.NewDecoder(body).Decode(&rejected); err != nil || len(rejected.Errors) == 0 {
+		zap.L().Error(`Batch rejected by the server`, zap.Error(err))
+		return false
 	}
 
-	// Create GCM
-	aesgcm, err := cipher.NewGCM(aesblock)
-	if err != nil {
-		zap.L().Error(`Cannot create AES GCM`, zap.Error(err))
-		return
+	for _, e := range rejected.Errors {
+		zap.L().Error(`Metric rejected by the server`, zap.Int(`index`, e.Index), zap.String(`id`, e.ID), zap.String(`error`, e.Error))
 	}
 
-	nonce := key[len(key)-aesgcm.NonceSize():]
+	return true
+}
+
+// addHashHeader signs the request with HMAC-SHA256 of timestamp, nonce and body.
+//
+// Server checks signature after decompression, so the uncompressed body is signed.
+//
+// Parameters:
+//   - req: a pointer to an http.Request object to which the headers will be added.
+//   - body: a byte slice representing the uncompressed body of the request.
+func (c *Collector) addHashHeader(req *http.Request, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := sign.NewNonce()
 
-	// Encode body
-	h := aesgcm.Seal(nil, nonce, body, nil)
-	req.Header.Set(`HashSHA256`, hex.EncodeToString(h[:]))
+	req.Header.Set(sign.HeaderTimestamp, ts)
+	req.Header.Set(sign.HeaderNonce, nonce)
+	req.Header.Set(sign.HeaderHash, sign.SumRequest(*Key, ts, nonce, body))
 }
 
 // retryIfError retries the given function if it returns an error.
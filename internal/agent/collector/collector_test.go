@@ -0,0 +1,117 @@
+package collector
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Jourloy/go-metrics-collector/internal/agent/outbox"
+)
+
+func TestOutboxReports(t *testing.T) {
+	var mu sync.Mutex
+	total := make(map[string]int64)
+
+	// Server sums deltas of all received counters
+	var unavailable atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+
+		var metrics []Metric
+		require.NoError(t, json.NewDecoder(gz).Decode(&metrics))
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, m := range metrics {
+			if m.Delta != nil {
+				total[m.ID] += *m.Delta
+			}
+		}
+	}))
+	defer srv.Close()
+
+	address := *ServerAddress
+	*ServerAddress = strings.TrimPrefix(srv.URL, `http://`)
+	defer func() { *ServerAddress = address }()
+
+	o, err := outbox.Open(outbox.Options{Dir: t.TempDir(), MaxBytes: 1000})
+	require.NoError(t, err)
+
+	c := newTestCollector()
+	c.outbox = o
+
+	// Report left from previous failure, it is dropped when the next report is saved
+	old := `[{"id":"Old","type":"counter","delta":1}]`
+	require.NoError(t, o.Push([]byte(old+strings.Repeat(` `, 980-len(old)))))
+
+	delta := int64(5)
+	c.merge([]Metric{{ID: `Requests`, MType: `counter`, Delta: &delta}})
+
+	// Server is unavailable, so report is saved with its deltas
+	unavailable.Store(true)
+	c.sendMetrics()
+	assert.Equal(t, 1, o.Len())
+	assert.Equal(t, int64(1), o.Dropped())
+	assert.Equal(t, int64(0), c.counter[`Requests`])
+	assert.Equal(t, int64(1), c.counter[`OutboxDropped`])
+
+	// Saved report and increase since it are sent once
+	unavailable.Store(false)
+	delta = 2
+	c.merge([]Metric{{ID: `Requests`, MType: `counter`, Delta: &delta}})
+	c.sendMetrics()
+	c.sendMetrics()
+
+	assert.Equal(t, 0, o.Len())
+	assert.Equal(t, map[string]int64{`Requests`: 7, `OutboxDropped`: 1}, total)
+}
+
+func TestRejectedReports(t *testing.T) {
+	// Server rejects signature first, then rejects metrics of batch
+	var rejectMetrics atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rejectMetrics.Load() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":[{"index":0,"id":"Requests","error":"counter value not found"}]}`))
+			return
+		}
+		http.Error(w, `bad request`, http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	address := *ServerAddress
+	*ServerAddress = strings.TrimPrefix(srv.URL, `http://`)
+	defer func() { *ServerAddress = address }()
+
+	o, err := outbox.Open(outbox.Options{Dir: t.TempDir(), MaxBytes: 1 << 20})
+	require.NoError(t, err)
+
+	c := newTestCollector()
+	c.outbox = o
+
+	delta := int64(5)
+	c.merge([]Metric{{ID: `Requests`, MType: `counter`, Delta: &delta}})
+
+	// Request is rejected, so report is saved to be sent again
+	c.sendMetrics()
+	assert.Equal(t, 1, o.Len())
+
+	// Batch with rejected metrics is not sent again
+	rejectMetrics.Store(true)
+	c.sendMetrics()
+	assert.Equal(t, 0, o.Len())
+}
@@ -0,0 +1,105 @@
+package collector
+
+import (
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+// cpuUsage is a utilization of CPU between two polls in percents.
+type cpuUsage struct {
+	Busy   float64
+	User   float64
+	System float64
+	Iowait float64
+	Idle   float64
+	Steal  float64
+}
+
+// cpuTotal returns total time of CPU.
+//
+// Guest time is already included in user time, so it is not counted.
+func cpuTotal(t cpu.TimesStat) float64 {
+	return t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+}
+
+// cpuPercent calculates utilization of CPU between two polls.
+//
+// Parameters:
+//   - prev: the times of previous poll.
+//   - cur: the times of current poll.
+//
+// Returns:
+//   - cpuUsage: the utilization in percents.
+//   - bool: false if there is no time between polls or counters were reset.
+func cpuPercent(prev, cur cpu.TimesStat) (cpuUsage, bool) {
+	total := cpuTotal(cur) - cpuTotal(prev)
+	if total <= 0 {
+		return cpuUsage{}, false
+	}
+
+	percent := func(p, c float64) float64 {
+		d := c - p
+		if d < 0 {
+			d = 0
+		}
+		return min(d/total*100, 100)
+	}
+
+	idle := percent(prev.Idle, cur.Idle)
+	iowait := percent(prev.Iowait, cur.Iowait)
+
+	return cpuUsage{
+		Busy:   max(100-idle-iowait, 0),
+		User:   percent(prev.User+prev.Nice, cur.User+cur.Nice),
+		System: percent(prev.System+prev.Irq+prev.Softirq, cur.System+cur.Irq+cur.Softirq),
+		Iowait: iowait,
+		Idle:   idle,
+		Steal:  percent(prev.Steal, cur.Steal),
+	}, true
+}
+
+// cpuGauges calculates utilization of CPU for each core and all cores.
+//
+// Times of the first poll are only remembered, so metrics are reported from the second poll.
+//
+// Parameters:
+//   - prev: the times of previous poll by name of core, updated with current times.
+//   - cores: the times of each core.
+//   - all: the times of all cores.
+//
+// Returns:
+//   - []Metric: the gauges, e.g. `CPUutilization` with `cpu` label for each core
+//     and without it for all cores.
+func cpuGauges(prev map[string]cpu.TimesStat, cores []cpu.TimesStat, all cpu.TimesStat) []Metric {
+	metrics := make([]Metric, 0, (len(cores)+1)*6)
+
+	add := func(key string, labels map[string]string, t cpu.TimesStat) {
+		p, ok := prev[key]
+		prev[key] = t
+		if !ok {
+			return
+		}
+
+		u, ok := cpuPercent(p, t)
+		if !ok {
+			return
+		}
+
+		metrics = append(metrics,
+			gaugeMetric(`CPUutilization`, u.Busy, labels),
+			gaugeMetric(`CPUuser`, u.User, labels),
+			gaugeMetric(`CPUsystem`, u.System, labels),
+			gaugeMetric(`CPUiowait`, u.Iowait, labels),
+			gaugeMetric(`CPUidle`, u.Idle, labels),
+			gaugeMetric(`CPUsteal`, u.Steal, labels),
+		)
+	}
+
+	for _, t := range cores {
+		add(t.CPU, map[string]string{`cpu`: strings.TrimPrefix(t.CPU, `cpu`)}, t)
+	}
+	add(`cpu-total`, nil, all)
+
+	return metrics
+}
@@ -0,0 +1,106 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCPUPercent(t *testing.T) {
+	tests := []struct {
+		name string
+		prev cpu.TimesStat
+		cur  cpu.TimesStat
+		want cpuUsage
+		ok   bool
+	}{
+		{
+			name: `idle`,
+			prev: cpu.TimesStat{User: 10, System: 10, Idle: 80},
+			cur:  cpu.TimesStat{User: 10, System: 10, Idle: 180},
+			want: cpuUsage{Idle: 100},
+			ok:   true,
+		},
+		{
+			name: `mixed`,
+			prev: cpu.TimesStat{User: 100, System: 50, Idle: 1000, Iowait: 10, Steal: 5},
+			cur:  cpu.TimesStat{User: 150, System: 70, Idle: 1020, Iowait: 15, Steal: 10},
+			want: cpuUsage{Busy: 75, User: 50, System: 20, Iowait: 5, Idle: 20, Steal: 5},
+			ok:   true,
+		},
+		{
+			name: `nice, irq and softirq`,
+			prev: cpu.TimesStat{},
+			cur:  cpu.TimesStat{User: 10, Nice: 10, System: 10, Irq: 5, Softirq: 5, Idle: 60},
+			want: cpuUsage{Busy: 40, User: 20, System: 20, Idle: 60},
+			ok:   true,
+		},
+		{
+			name: `no time between polls`,
+			prev: cpu.TimesStat{User: 10, Idle: 10},
+			cur:  cpu.TimesStat{User: 10, Idle: 10},
+			ok:   false,
+		},
+		{
+			name: `counters reset`,
+			prev: cpu.TimesStat{User: 100, Idle: 100},
+			cur:  cpu.TimesStat{User: 1, Idle: 1},
+			ok:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cpuPercent(tt.prev, tt.cur)
+			assert.Equal(t, tt.ok, ok)
+			assert.InDelta(t, tt.want.Busy, got.Busy, 1e-9)
+			assert.InDelta(t, tt.want.User, got.User, 1e-9)
+			assert.InDelta(t, tt.want.System, got.System, 1e-9)
+			assert.InDelta(t, tt.want.Iowait, got.Iowait, 1e-9)
+			assert.InDelta(t, tt.want.Idle, got.Idle, 1e-9)
+			assert.InDelta(t, tt.want.Steal, got.Steal, 1e-9)
+		})
+	}
+}
+
+func TestCPUGauges(t *testing.T) {
+	prev := make(map[string]cpu.TimesStat)
+
+	// First poll is only remembered
+	gauge := metricValues(cpuGauges(prev,
+		[]cpu.TimesStat{
+			{CPU: `cpu0`, User: 10, Idle: 90},
+			{CPU: `cpu1`, User: 50, Idle: 50},
+		},
+		cpu.TimesStat{CPU: `cpu-total`, User: 60, Idle: 140},
+	))
+	assert.Empty(t, gauge)
+
+	gauge = metricValues(cpuGauges(prev,
+		[]cpu.TimesStat{
+			{CPU: `cpu0`, User: 20, Idle: 180},
+			{CPU: `cpu1`, User: 150, Idle: 50},
+		},
+		cpu.TimesStat{CPU: `cpu-total`, User: 170, Idle: 230},
+	))
+	assert.InDelta(t, 10, gauge[`CPUutilization{cpu="0"}`], 1e-9)
+	assert.InDelta(t, 90, gauge[`CPUidle{cpu="0"}`], 1e-9)
+	assert.InDelta(t, 100, gauge[`CPUutilization{cpu="1"}`], 1e-9)
+	assert.InDelta(t, 100, gauge[`CPUuser{cpu="1"}`], 1e-9)
+	assert.InDelta(t, 55, gauge[`CPUutilization`], 1e-9)
+	assert.InDelta(t, 45, gauge[`CPUidle`], 1e-9)
+	assert.Len(t, gauge, 18)
+
+	// Utilization goes down when core is idle again
+	gauge = metricValues(cpuGauges(prev,
+		[]cpu.TimesStat{
+			{CPU: `cpu0`, User: 20, Idle: 280},
+			{CPU: `cpu1`, User: 150, Idle: 150},
+		},
+		cpu.TimesStat{CPU: `cpu-total`, User: 170, Idle: 430},
+	))
+	assert.InDelta(t, 0, gauge[`CPUutilization{cpu="0"}`], 1e-9)
+	assert.InDelta(t, 0, gauge[`CPUutilization{cpu="1"}`], 1e-9)
+	assert.InDelta(t, 0, gauge[`CPUutilization`], 1e-9)
+}
@@ -0,0 +1,224 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMaxOutput is a default max size of command output in bytes.
+const defaultMaxOutput = 64 << 10
+
+// execWaitDelay is a time to wait for output after command is killed by timeout.
+const execWaitDelay = time.Second
+
+var (
+	errNoCommand      = errors.New(`command is empty`)
+	errOutputTooLarge = errors.New(`output of command is too large`)
+)
+
+func init() {
+	Register(`exec`, newExecSource)
+}
+
+// execOptions are options of exec source in `agent.config.json`.
+type execOptions struct {
+	Command   []string `json:"command"`    // Path to command and its arguments
+	MaxOutput int      `json:"max_output"` // Max size of output in bytes
+}
+
+// execSource runs external command and parses metrics from its output.
+//
+// Command is killed when timeout of the source is reached.
+type execSource struct {
+	sourceBase
+	command   []string
+	maxOutput int
+}
+
+// newExecSource creates a source which runs external command.
+func newExecSource(opt SourceOptions) (Source, error) {
+	var o execOptions
+	if len(opt.Options) > 0 {
+		if err := json.Unmarshal(opt.Options, &o); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(o.Command) == 0 || o.Command[0] == `` {
+		return nil, errNoCommand
+	}
+
+	if o.MaxOutput <= 0 {
+		o.MaxOutput = defaultMaxOutput
+	}
+
+	return &execSource{
+		sourceBase: newSourceBase(opt),
+		command:    o.Command,
+		maxOutput:  o.MaxOutput,
+	}, nil
+}
+
+// Collect runs command and parses its output.
+func (s *execSource) Collect(ctx context.Context) ([]Metric, error) {
+	// Command is killed when output exceeds limit
+	cmdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stdout := &limitedBuffer{limit: s.maxOutput, cancel: cancel}
+
+	cmd := exec.CommandContext(cmdCtx, s.command[0], s.command[1:]...)
+	cmd.Stdout = stdout
+	cmd.WaitDelay = execWaitDelay
+
+	err := cmd.Run()
+	switch {
+	case stdout.exceeded:
+		return nil, errOutputTooLarge
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case err != nil:
+		return nil, err
+	}
+
+	return parseExecOutput(stdout.buf.Bytes())
+}
+
+// limitedBuffer is a buffer which discards data and calls cancel when size of data exceeds limit.
+//
+// Buffer is not embedded, so io.Copy cannot bypass Write with ReadFrom.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	exceeded bool
+	cancel   context.CancelFunc
+}
+
+// Write writes data into buffer if limit is not exceeded.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.exceeded || b.buf.Len()+len(p) > b.limit {
+		if !b.exceeded {
+			b.exceeded = true
+			b.cancel()
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// parseExecOutput parses metrics from output of command.
+//
+// Output is either JSON array of metrics in format of the server API or lines
+// in format `name type value`, e.g. `QueueLength gauge 12`. Empty lines and
+// lines started with `#` are skipped.
+//
+// Parameters:
+//   - b: the output of command.
+//
+// Returns:
+//   - []Metric: the metrics.
+//   - error: error if any metric is invalid.
+func parseExecOutput(b []byte) ([]Metric, error) {
+	b = bytes.TrimSpace(b)
+
+	if bytes.HasPrefix(b, []byte(`[`)) {
+		var metrics []Metric
+		if err := json.Unmarshal(b, &metrics); err != nil {
+			return nil, err
+		}
+
+		for i, m := range metrics {
+			if err := checkExecMetric(m); err != nil {
+				return nil, fmt.Errorf(`metric %d: %w`, i, err)
+			}
+		}
+
+		return metrics, nil
+	}
+
+	var metrics []Metric
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+
+		m, err := parseExecLine(line)
+		if err != nil {
+			return nil, fmt.Errorf(`line %d: %w`, n, err)
+		}
+		metrics = append(metrics, m)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+// parseExecLine parses metric from line in format `name type value`.
+//
+// Parameters:
+//   - line: the line.
+//
+// Returns:
+//   - Metric: the metric.
+//   - error: error if line is invalid.
+func parseExecLine(line string) (Metric, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return Metric{}, fmt.Errorf(`expected "name type value", got %q`, line)
+	}
+
+	m := Metric{ID: fields[0], MType: fields[1]}
+
+	switch m.MType {
+	case `gauge`:
+		v, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return Metric{}, err
+		}
+		m.Value = &v
+	case `counter`:
+		d, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return Metric{}, err
+		}
+		m.Delta = &d
+	}
+
+	return m, checkExecMetric(m)
+}
+
+// checkExecMetric checks that metric has name, known type and value of its type.
+func checkExecMetric(m Metric) error {
+	if m.ID == `` {
+		return errors.New(`name is empty`)
+	}
+
+	switch m.MType {
+	case `gauge`:
+		if m.Value == nil {
+			return errors.New(`value of gauge is empty`)
+		}
+	case `counter`:
+		if m.Delta == nil {
+			return errors.New(`delta of counter is empty`)
+		}
+	default:
+		return fmt.Errorf(`unknown type %q`, m.MType)
+	}
+
+	return nil
+}
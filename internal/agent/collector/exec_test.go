@@ -0,0 +1,125 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExecOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name:   `lines`,
+			output: "# comment\nQueueLength gauge 12.5\n\nLicenses counter 3\n",
+			want:   map[string]float64{`QueueLength`: 12.5, `Licenses`: 3},
+		},
+		{
+			name:   `json`,
+			output: `[{"id":"QueueLength","type":"gauge","value":1},{"id":"Licenses","type":"counter","delta":2}]`,
+			want:   map[string]float64{`QueueLength`: 1, `Licenses`: 2},
+		},
+		{
+			name:   `empty`,
+			output: "\n",
+			want:   map[string]float64{},
+		},
+		{name: `missing field`, output: `QueueLength gauge`, wantErr: true},
+		{name: `unknown type`, output: `QueueLength histogram 1`, wantErr: true},
+		{name: `float counter`, output: `Licenses counter 1.5`, wantErr: true},
+		{name: `invalid value`, output: `QueueLength gauge none`, wantErr: true},
+		{name: `invalid json`, output: `[{"id":`, wantErr: true},
+		{name: `json without value`, output: `[{"id":"QueueLength","type":"gauge"}]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, err := parseExecOutput([]byte(tt.output))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			got := make(map[string]float64, len(metrics))
+			for _, m := range metrics {
+				if m.Value != nil {
+					got[m.ID] = *m.Value
+				} else {
+					got[m.ID] = float64(*m.Delta)
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExecSource(t *testing.T) {
+	if _, err := exec.LookPath(`sh`); err != nil {
+		t.Skip(`sh not found`)
+	}
+
+	newSource := func(script string, maxOutput int) Source {
+		options, _ := json.Marshal(execOptions{Command: []string{`sh`, `-c`, script}, MaxOutput: maxOutput})
+		s, err := NewSource(`exec`, SourceOptions{Name: `script`, PollInterval: time.Second, Options: options})
+		require.NoError(t, err)
+		return s
+	}
+
+	metrics, err := newSource(`echo "QueueLength gauge 7"`, 0).Collect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 7.0, *metrics[0].Value)
+
+	_, err = newSource(`echo "QueueLength gauge 7"; exit 1`, 0).Collect(context.Background())
+	assert.Error(t, err)
+
+	_, err = newSource(`yes "QueueLength gauge 7"`, 1024).Collect(context.Background())
+	assert.ErrorIs(t, err, errOutputTooLarge)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = newSource(`exec sleep 10`, 0).Collect(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = NewSource(`exec`, SourceOptions{Name: `empty`})
+	assert.ErrorIs(t, err, errNoCommand)
+}
+
+func TestExecReports(t *testing.T) {
+	if _, err := exec.LookPath(`sh`); err != nil {
+		t.Skip(`sh not found`)
+	}
+
+	lastReport := startReportServer(t)
+
+	// Command reports increase of counter since previous run
+	options, _ := json.Marshal(execOptions{Command: []string{`sh`, `-c`, `echo "ProcessedJobs counter 3"`}})
+	s, err := NewSource(`exec`, SourceOptions{Name: `script`, PollInterval: time.Second, Options: options})
+	require.NoError(t, err)
+	r := sourceRunner{source: s, timeout: time.Second}
+
+	c := newTestCollector()
+
+	c.pollSource(r)
+	c.sendMetrics()
+	assert.Equal(t, map[string]int64{`ProcessedJobs`: 3}, lastReport())
+
+	// Only increase of the second poll is sent
+	c.pollSource(r)
+	c.sendMetrics()
+	assert.Equal(t, map[string]int64{`ProcessedJobs`: 3}, lastReport())
+
+	// Nothing is collected, so delta is 0
+	c.sendMetrics()
+	assert.Equal(t, map[string]int64{`ProcessedJobs`: 0}, lastReport())
+}
@@ -0,0 +1,299 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"go.uber.org/zap"
+)
+
+// psutilCollector collects group of host metrics.
+type psutilCollector func(ctx context.Context) ([]Metric, error)
+
+// psutilCollectors are collectors of host metrics registered as sources.
+//
+// Function creates a new collector for each source, so collectors may keep state between polls.
+var psutilCollectors = map[string]func() psutilCollector{
+	`memory`: func() psutilCollector { return collectMemory },
+	`cpu`:    newCPUCollector,
+	`swap`:   func() psutilCollector { return collectSwap },
+	`disk`:   func() psutilCollector { return collectDisk },
+	`diskio`: newDiskIOCollector,
+	`net`:    newNetCollector,
+	`load`:   func() psutilCollector { return collectLoad },
+	`fd`:     func() psutilCollector { return collectFD },
+	`uptime`: func() psutilCollector { return collectUptime },
+}
+
+var errFD = errors.New(`file descriptors are supported only on Linux`)
+var errCPU = errors.New(`times of CPU not found`)
+
+func init() {
+	for name, f := range psutilCollectors {
+		f := f
+		Register(name, func(opt SourceOptions) (Source, error) {
+			return &psutilSource{sourceBase: newSourceBase(opt), collect: f()}, nil
+		})
+	}
+}
+
+// psutilSource is a source of host metrics.
+type psutilSource struct {
+	sourceBase
+	collect psutilCollector
+}
+
+// Collect collects host metrics.
+func (s *psutilSource) Collect(ctx context.Context) ([]Metric, error) {
+	return s.collect(ctx)
+}
+
+// collectMemory collects total and free virtual memory.
+func collectMemory(ctx context.Context) ([]Metric, error) {
+	v, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return gaugeMetrics(map[string]float64{
+		`TotalMemory`: float64(v.Total),
+		`FreeMemory`:  float64(v.Free),
+	}), nil
+}
+
+// newCPUCollector creates a collector of CPU utilization.
+//
+// Collector keeps times of previous poll, so each source has its own collector.
+func newCPUCollector() psutilCollector {
+	prev := make(map[string]cpu.TimesStat)
+
+	return func(ctx context.Context) ([]Metric, error) {
+		cores, err := cpu.TimesWithContext(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+
+		all, err := cpu.TimesWithContext(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(all) == 0 {
+			return nil, errCPU
+		}
+
+		return cpuGauges(prev, cores, all[0]), nil
+	}
+}
+
+// collectSwap collects usage of swap.
+func collectSwap(ctx context.Context) ([]Metric, error) {
+	s, err := mem.SwapMemoryWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return gaugeMetrics(map[string]float64{
+		`SwapTotal`: float64(s.Total),
+		`SwapUsed`:  float64(s.Used),
+		`SwapFree`:  float64(s.Free),
+	}), nil
+}
+
+// collectDisk collects usage of each mounted partition with `mount` label.
+func collectDisk(ctx context.Context) ([]Metric, error) {
+	partitions, err := disk.PartitionsWithContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make([]Metric, 0, len(partitions)*4)
+	for _, p := range partitions {
+		u, err := disk.UsageWithContext(ctx, p.Mountpoint)
+		if err != nil {
+			zap.L().Debug(`Cannot get disk usage`, zap.String(`mount`, p.Mountpoint), zap.Error(err))
+			continue
+		}
+
+		labels := map[string]string{`mount`: p.Mountpoint}
+		metrics = append(metrics,
+			gaugeMetric(`DiskTotal`, float64(u.Total), labels),
+			gaugeMetric(`DiskUsed`, float64(u.Used), labels),
+			gaugeMetric(`DiskFree`, float64(u.Free), labels),
+			gaugeMetric(`DiskUsedPercent`, u.UsedPercent, labels),
+		)
+	}
+
+	return metrics, nil
+}
+
+// newDiskIOCollector creates a collector of I/O counters of each block device
+// with `device` label.
+//
+// Collector keeps counters of previous poll, so each source has its own collector.
+func newDiskIOCollector() psutilCollector {
+	deltas := newCounterDeltas()
+
+	return func(ctx context.Context) ([]Metric, error) {
+		counters, err := disk.IOCountersWithContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, io := range counters {
+			labels := map[string]string{`device`: name}
+			deltas.add(`DiskReadBytes`, labels, io.ReadBytes)
+			deltas.add(`DiskWriteBytes`, labels, io.WriteBytes)
+			deltas.add(`DiskReadCount`, labels, io.ReadCount)
+			deltas.add(`DiskWriteCount`, labels, io.WriteCount)
+		}
+
+		return deltas.next(), nil
+	}
+}
+
+// newNetCollector creates a collector of bytes, packets and errors of each
+// network interface with `interface` label.
+//
+// Collector keeps counters of previous poll, so each source has its own collector.
+func newNetCollector() psutilCollector {
+	deltas := newCounterDeltas()
+
+	return func(ctx context.Context) ([]Metric, error) {
+		counters, err := net.IOCountersWithContext(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, io := range counters {
+			labels := map[string]string{`interface`: io.Name}
+			deltas.add(`NetBytesSent`, labels, io.BytesSent)
+			deltas.add(`NetBytesRecv`, labels, io.BytesRecv)
+			deltas.add(`NetPacketsSent`, labels, io.PacketsSent)
+			deltas.add(`NetPacketsRecv`, labels, io.PacketsRecv)
+			deltas.add(`NetErrIn`, labels, io.Errin)
+			deltas.add(`NetErrOut`, labels, io.Errout)
+		}
+
+		return deltas.next(), nil
+	}
+}
+
+// counterDeltas converts cumulative counters of system into counters with
+// increase since the previous poll.
+//
+// Counters of the first poll are only remembered, so metrics are reported
+// from the second poll. If counter decreased, e.g. device was re-created, the
+// whole value is the increase. Counters which are not polled anymore are
+// forgotten.
+type counterDeltas struct {
+	prev    map[string]uint64 // Values of previous poll by key of metric
+	cur     map[string]uint64 // Values of current poll by key of metric
+	metrics []Metric
+}
+
+// newCounterDeltas creates a counterDeltas.
+func newCounterDeltas() *counterDeltas {
+	return &counterDeltas{
+		prev: make(map[string]uint64),
+		cur:  make(map[string]uint64),
+	}
+}
+
+// add adds cumulative value of counter of the current poll.
+//
+// Parameters:
+//   - id: the name of metric.
+//   - labels: the labels of metric.
+//   - value: the cumulative value.
+func (d *counterDeltas) add(id string, labels map[string]string, value uint64) {
+	key := metricKey(id, labels)
+	d.cur[key] = value
+
+	prev, ok := d.prev[key]
+	if !ok {
+		return
+	}
+
+	delta := int64(value - prev)
+	if value < prev {
+		delta = int64(value)
+	}
+	d.metrics = append(d.metrics, Metric{ID: id, MType: `counter`, Delta: &delta, Labels: labels})
+}
+
+// next finishes the current poll.
+//
+// Returns:
+//   - []Metric: the counters with increase since the previous poll.
+func (d *counterDeltas) next() []Metric {
+	metrics := d.metrics
+
+	d.prev, d.cur = d.cur, make(map[string]uint64, len(d.cur))
+	d.metrics = nil
+
+	return metrics
+}
+
+// collectLoad collects load average.
+func collectLoad(ctx context.Context) ([]Metric, error) {
+	l, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return gaugeMetrics(map[string]float64{
+		`Load1`:  l.Load1,
+		`Load5`:  l.Load5,
+		`Load15`: l.Load15,
+	}), nil
+}
+
+// collectFD collects count of allocated file descriptors and their limit.
+func collectFD(ctx context.Context) ([]Metric, error) {
+	b, err := os.ReadFile(`/proc/sys/fs/file-nr`)
+	if err != nil {
+		return nil, errFD
+	}
+
+	// File contains allocated, unused and max count of descriptors
+	fields := bytes.Fields(b)
+	if len(fields) != 3 {
+		return nil, errFD
+	}
+
+	allocated, err := strconv.ParseFloat(string(fields[0]), 64)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := strconv.ParseFloat(string(fields[2]), 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return gaugeMetrics(map[string]float64{
+		`FileDescriptors`:    allocated,
+		`FileDescriptorsMax`: limit,
+	}), nil
+}
+
+// collectUptime collects uptime of the host in seconds.
+func collectUptime(ctx context.Context) ([]Metric, error) {
+	u, err := host.UptimeWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return gaugeMetrics(map[string]float64{
+		`Uptime`: float64(u),
+	}), nil
+}
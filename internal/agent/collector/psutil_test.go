@@ -0,0 +1,39 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterDeltas(t *testing.T) {
+	d := newCounterDeltas()
+	sda := map[string]string{`device`: `sda`}
+	sdb := map[string]string{`device`: `sdb`}
+
+	// The first poll is only remembered
+	d.add(`DiskReadBytes`, sda, 100)
+	assert.Empty(t, d.next())
+
+	d.add(`DiskReadBytes`, sda, 150)
+	d.add(`DiskReadBytes`, sdb, 10)
+	metrics := d.next()
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, `DiskReadBytes`, metrics[0].ID)
+	assert.Equal(t, `counter`, metrics[0].MType)
+	assert.Equal(t, sda, metrics[0].Labels)
+	assert.Equal(t, int64(50), *metrics[0].Delta)
+
+	// Counter was reset
+	d.add(`DiskReadBytes`, sda, 20)
+	d.add(`DiskReadBytes`, sdb, 10)
+	metrics = d.next()
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, int64(20), *metrics[0].Delta)
+	assert.Equal(t, int64(0), *metrics[1].Delta)
+
+	// Device which was not polled is forgotten
+	d.next()
+	d.add(`DiskReadBytes`, sda, 30)
+	assert.Empty(t, d.next())
+}
@@ -0,0 +1,63 @@
+package collector
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+)
+
+func init() {
+	Register(`runtime`, newRuntimeSource)
+}
+
+// runtimeSource collects memory statistics of the Go runtime and PollCount.
+type runtimeSource struct {
+	sourceBase
+}
+
+// newRuntimeSource creates a source of runtime metrics.
+func newRuntimeSource(opt SourceOptions) (Source, error) {
+	return &runtimeSource{sourceBase: newSourceBase(opt)}, nil
+}
+
+// Collect collects memory statistics, RandomValue and increments PollCount.
+func (s *runtimeSource) Collect(_ context.Context) ([]Metric, error) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	metrics := gaugeMetrics(map[string]float64{
+		`Alloc`:         float64(memStats.Alloc),
+		`BuckHashSys`:   float64(memStats.BuckHashSys),
+		`Frees`:         float64(memStats.Frees),
+		`GCCPUFraction`: float64(memStats.GCCPUFraction),
+		`GCSys`:         float64(memStats.GCSys),
+		`HeapAlloc`:     float64(memStats.HeapAlloc),
+		`HeapIdle`:      float64(memStats.HeapIdle),
+		`HeapInuse`:     float64(memStats.HeapInuse),
+		`HeapReleased`:  float64(memStats.HeapReleased),
+		`HeapObjects`:   float64(memStats.HeapObjects),
+		`HeapSys`:       float64(memStats.HeapSys),
+		`LastGC`:        float64(memStats.LastGC),
+		`Lookups`:       float64(memStats.Lookups),
+		`MCacheInuse`:   float64(memStats.MCacheInuse),
+		`MCacheSys`:     float64(memStats.MCacheSys),
+		`MSpanInuse`:    float64(memStats.MSpanInuse),
+		`MSpanSys`:      float64(memStats.MSpanSys),
+		`Mallocs`:       float64(memStats.Mallocs),
+		`NextGC`:        float64(memStats.NextGC),
+		`NumForcedGC`:   float64(memStats.NumForcedGC),
+		`NumGC`:         float64(memStats.NumGC),
+		`OtherSys`:      float64(memStats.OtherSys),
+		`PauseTotalNs`:  float64(memStats.PauseTotalNs),
+		`StackInuse`:    float64(memStats.StackInuse),
+		`StackSys`:      float64(memStats.StackSys),
+		`Sys`:           float64(memStats.Sys),
+		`TotalAlloc`:    float64(memStats.TotalAlloc),
+		`RandomValue`:   rand.Float64(),
+	})
+
+	pollCount := int64(1)
+	metrics = append(metrics, Metric{ID: `PollCount`, MType: `counter`, Delta: &pollCount})
+
+	return metrics, nil
+}
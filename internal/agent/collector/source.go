@@ -0,0 +1,319 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Source is a plug-in which collects metrics.
+//
+// Each source is polled in its own goroutine, so slow or failing source
+// doesn't block others.
+type Source interface {
+	// Name returns unique name of the source.
+	Name() string
+	// PollInterval returns interval between polls of the source.
+	PollInterval() time.Duration
+	// Collect collects metrics. Gauges replace previous values, counters are
+	// added to previous values. Collect must return when ctx is done.
+	Collect(ctx context.Context) ([]Metric, error)
+}
+
+// SourceOptions are options for creating a source.
+type SourceOptions struct {
+	Name         string          // Unique name of the source
+	PollInterval time.Duration   // Interval between polls
+	Options      json.RawMessage // Options of the source from config, may be empty
+}
+
+// SourceFactory creates a source.
+type SourceFactory func(opt SourceOptions) (Source, error)
+
+// SourceConfig is a config of the source in `agent.config.json`.
+type SourceConfig struct {
+	Name         string          `json:"name"`          // Unique name of the source
+	Type         string          `json:"type"`          // Registered type of the source, name is used if empty
+	PollInterval string          `json:"poll_interval"` // Duration, PollInterval of agent is used if empty
+	Timeout      string          `json:"timeout"`       // Duration, SourceTimeout of agent is used if empty
+	Options      json.RawMessage `json:"options"`       // Options of the source
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]SourceFactory)
+)
+
+var errUnknownSource = errors.New(`unknown source`)
+
+// Register makes source type available by name.
+//
+// It panics if type is already registered, so it should be called from init.
+//
+// Parameters:
+//   - name: the type of the source.
+//   - f: the factory of the source.
+func Register(name string, f SourceFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(`source ` + name + ` is already registered`)
+	}
+	registry[name] = f
+}
+
+// NewSource creates a source of registered type.
+//
+// Parameters:
+//   - typ: the type of the source.
+//   - opt: the options of the source.
+//
+// Returns:
+//   - Source: the source.
+//   - error: error if type is unknown or options are invalid.
+func NewSource(typ string, opt SourceOptions) (Source, error) {
+	registryMu.RLock()
+	f, ok := registry[typ]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf(`%w: %s`, errUnknownSource, typ)
+	}
+
+	return f(opt)
+}
+
+// sourceBase implements Name and PollInterval of Source.
+type sourceBase struct {
+	name     string
+	interval time.Duration
+}
+
+// newSourceBase creates sourceBase from options.
+func newSourceBase(opt SourceOptions) sourceBase {
+	return sourceBase{name: opt.Name, interval: opt.PollInterval}
+}
+
+// Name returns name of the source.
+func (s sourceBase) Name() string {
+	return s.name
+}
+
+// PollInterval returns interval between polls of the source.
+func (s sourceBase) PollInterval() time.Duration {
+	return s.interval
+}
+
+// sourceRunner is an enabled source with its timeout.
+type sourceRunner struct {
+	source  Source
+	timeout time.Duration
+}
+
+// buildSources creates enabled sources.
+//
+// Sources from names are created with default options. Sources from configs
+// are created with their options and replace sources with the same name.
+//
+// Parameters:
+//   - names: the names of enabled sources.
+//   - configs: the configs of sources.
+//   - interval: the default interval between polls.
+//   - timeout: the default timeout of poll.
+//
+// Returns:
+//   - []sourceRunner: the sources in order of names and configs.
+//   - error: error if source cannot be created.
+func buildSources(names []string, configs []SourceConfig, interval, timeout time.Duration) ([]sourceRunner, error) {
+	configs = append(configs[:0:0], configs...)
+	for _, name := range names {
+		configs = append(configs, SourceConfig{Name: name})
+	}
+
+	runners := make([]sourceRunner, 0, len(configs))
+	index := make(map[string]int, len(configs))
+
+	for _, cfg := range configs {
+		if cfg.Name == `` {
+			return nil, errors.New(`name of source is empty`)
+		}
+
+		// Config has priority over names, they are added after configs
+		if _, ok := index[cfg.Name]; ok {
+			continue
+		}
+
+		typ := cfg.Type
+		if typ == `` {
+			typ = cfg.Name
+		}
+
+		r := sourceRunner{timeout: timeout}
+		opt := SourceOptions{Name: cfg.Name, PollInterval: interval, Options: cfg.Options}
+
+		if cfg.PollInterval != `` {
+			d, err := time.ParseDuration(cfg.PollInterval)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf(`invalid poll interval of source %s: %q`, cfg.Name, cfg.PollInterval)
+			}
+			opt.PollInterval = d
+		}
+
+		if cfg.Timeout != `` {
+			d, err := time.ParseDuration(cfg.Timeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf(`invalid timeout of source %s: %q`, cfg.Name, cfg.Timeout)
+			}
+			r.timeout = d
+		}
+
+		s, err := NewSource(typ, opt)
+		if err != nil {
+			return nil, fmt.Errorf(`cannot create source %s: %w`, cfg.Name, err)
+		}
+		r.source = s
+
+		index[cfg.Name] = len(runners)
+		runners = append(runners, r)
+	}
+
+	return runners, nil
+}
+
+// runSource polls the source until the Collector is stopped.
+//
+// Parameters:
+//   - r: the source with its timeout.
+func (c *Collector) runSource(r sourceRunner) {
+	ticker := time.NewTicker(r.source.PollInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.pollSource(r)
+		}
+	}
+}
+
+// pollSource collects metrics from the source and merges them into the Collector.
+//
+// Parameters:
+//   - r: the source with its timeout.
+func (c *Collector) pollSource(r sourceRunner) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	metrics, err := r.source.Collect(ctx)
+	if err != nil {
+		zap.L().Error(`Cannot collect metrics`, zap.String(`source`, r.source.Name()), zap.Error(err))
+		return
+	}
+
+	c.merge(metrics)
+
+	zap.L().Debug(`Metrics collected`, zap.String(`source`, r.source.Name()), zap.Int(`count`, len(metrics)))
+}
+
+// merge stores metrics in the gauge and counter maps.
+//
+// Metrics with labels are stored by metricKey, their names and labels are
+// remembered for snapshot.
+//
+// Parameters:
+//   - metrics: the metrics to store.
+func (c *Collector) merge(metrics []Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, m := range metrics {
+		key := metricKey(m.ID, m.Labels)
+		if len(m.Labels) > 0 {
+			if _, ok := c.series[key]; !ok {
+				c.series[key] = series{id: m.ID, labels: m.Labels}
+			}
+		}
+
+		switch {
+		case m.MType == `gauge` && m.Value != nil:
+			c.gauge[key] = *m.Value
+		case m.MType == `counter` && m.Delta != nil:
+			c.counter[key] += *m.Delta
+		}
+	}
+}
+
+// gaugeMetric creates gauge metric.
+//
+// Parameters:
+//   - id: the name of metric.
+//   - value: the value of metric.
+//   - labels: the labels of metric, may be nil.
+//
+// Returns:
+//   - Metric: the gauge metric.
+func gaugeMetric(id string, value float64, labels map[string]string) Metric {
+	return Metric{ID: id, MType: `gauge`, Value: &value, Labels: labels}
+}
+
+// metricKey returns unique key of metric with labels, e.g. `CPUutilization{cpu="0"}`.
+//
+// Parameters:
+//   - id: the name of metric.
+//   - labels: the labels of metric.
+//
+// Returns:
+//   - string: the name if there are no labels, otherwise name with sorted labels.
+func metricKey(id string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return id
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(id)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// gaugeMetrics converts map of gauges into metrics.
+//
+// Parameters:
+//   - gauge: the values by names.
+//
+// Returns:
+//   - []Metric: the gauge metrics.
+func gaugeMetrics(gauge map[string]float64) []Metric {
+	metrics := make([]Metric, 0, len(gauge))
+	for id, value := range gauge {
+		v := value
+		metrics = append(metrics, Metric{ID: id, MType: `gauge`, Value: &v})
+	}
+	return metrics
+}
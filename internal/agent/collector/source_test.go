@@ -0,0 +1,216 @@
+package collector
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSource returns metrics or error from the function.
+type testSource struct {
+	sourceBase
+	collect func(ctx context.Context) ([]Metric, error)
+}
+
+func (s *testSource) Collect(ctx context.Context) ([]Metric, error) {
+	return s.collect(ctx)
+}
+
+func newTestCollector() *Collector {
+	return &Collector{
+		gauge:   make(map[string]float64),
+		counter: make(map[string]int64),
+		series:  make(map[string]series),
+		done:    make(chan struct{}),
+	}
+}
+
+// metricValues returns values of gauges by metricKey.
+func metricValues(metrics []Metric) map[string]float64 {
+	values := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		if m.Value != nil {
+			values[metricKey(m.ID, m.Labels)] = *m.Value
+		}
+	}
+	return values
+}
+
+func TestBuildSources(t *testing.T) {
+	configs := []SourceConfig{
+		{Name: `cpu`, PollInterval: `5s`, Timeout: `1s`},
+		{Name: `root`, Type: `disk`},
+	}
+
+	runners, err := buildSources([]string{`runtime`, `cpu`}, configs, 2*time.Second, 10*time.Second)
+	require.NoError(t, err)
+	require.Len(t, runners, 3)
+
+	assert.Equal(t, `cpu`, runners[0].source.Name())
+	assert.Equal(t, 5*time.Second, runners[0].source.PollInterval())
+	assert.Equal(t, time.Second, runners[0].timeout)
+
+	assert.Equal(t, `root`, runners[1].source.Name())
+	assert.IsType(t, &psutilSource{}, runners[1].source)
+	assert.Equal(t, 2*time.Second, runners[1].source.PollInterval())
+
+	assert.Equal(t, `runtime`, runners[2].source.Name())
+	assert.Equal(t, 10*time.Second, runners[2].timeout)
+
+	_, err = buildSources([]string{`unknown`}, nil, time.Second, time.Second)
+	assert.ErrorIs(t, err, errUnknownSource)
+
+	_, err = buildSources(nil, []SourceConfig{{Name: `cpu`, PollInterval: `never`}}, time.Second, time.Second)
+	assert.Error(t, err)
+
+	_, err = buildSources(nil, []SourceConfig{{Type: `cpu`}}, time.Second, time.Second)
+	assert.Error(t, err)
+}
+
+// startReportServer starts server which receives reports of the agent.
+//
+// Returns function which returns deltas of counters of the last report by ID.
+func startReportServer(t *testing.T) func() map[string]int64 {
+	var mu sync.Mutex
+	var last map[string]int64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+
+		var metrics []Metric
+		require.NoError(t, json.NewDecoder(gz).Decode(&metrics))
+
+		mu.Lock()
+		defer mu.Unlock()
+		last = make(map[string]int64)
+		for _, m := range metrics {
+			if m.Delta != nil {
+				last[m.ID] = *m.Delta
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	address := *ServerAddress
+	*ServerAddress = strings.TrimPrefix(srv.URL, `http://`)
+	t.Cleanup(func() { *ServerAddress = address })
+
+	return func() map[string]int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+}
+
+func TestPollSource(t *testing.T) {
+	c := newTestCollector()
+
+	value := 1.5
+	delta := int64(2)
+	ok := sourceRunner{
+		source: &testSource{
+			sourceBase: sourceBase{name: `ok`, interval: time.Second},
+			collect: func(_ context.Context) ([]Metric, error) {
+				return []Metric{
+					{ID: `Gauge`, MType: `gauge`, Value: &value},
+					{ID: `Counter`, MType: `counter`, Delta: &delta},
+				}, nil
+			},
+		},
+		timeout: time.Second,
+	}
+
+	// Source which doesn't return until timeout
+	slow := sourceRunner{
+		source: &testSource{
+			sourceBase: sourceBase{name: `slow`, interval: time.Second},
+			collect: func(ctx context.Context) ([]Metric, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		},
+		timeout: 10 * time.Millisecond,
+	}
+
+	failed := sourceRunner{
+		source: &testSource{
+			sourceBase: sourceBase{name: `failed`, interval: time.Second},
+			collect: func(_ context.Context) ([]Metric, error) {
+				return nil, errors.New(`failed`)
+			},
+		},
+		timeout: time.Second,
+	}
+
+	c.pollSource(ok)
+	c.pollSource(slow)
+	c.pollSource(failed)
+	c.pollSource(ok)
+
+	assert.Equal(t, map[string]float64{`Gauge`: 1.5}, c.gauge)
+	assert.Equal(t, map[string]int64{`Counter`: 4}, c.counter)
+}
+
+func TestRuntimeSource(t *testing.T) {
+	s, err := NewSource(`runtime`, SourceOptions{Name: `runtime`, PollInterval: time.Second, Options: json.RawMessage(`{}`)})
+	require.NoError(t, err)
+
+	c := newTestCollector()
+	c.pollSource(sourceRunner{source: s, timeout: time.Second})
+	c.pollSource(sourceRunner{source: s, timeout: time.Second})
+
+	assert.Contains(t, c.gauge, `Alloc`)
+	assert.Contains(t, c.gauge, `RandomValue`)
+	assert.Equal(t, int64(2), c.counter[`PollCount`])
+}
+
+func TestSnapshotLabels(t *testing.T) {
+	c := newTestCollector()
+	c.labels = map[string]string{`host`: `a`, `cpu`: `all`}
+
+	delta := int64(2)
+	c.merge([]Metric{
+		gaugeMetric(`CPUutilization`, 10, map[string]string{`cpu`: `0`}),
+		gaugeMetric(`CPUutilization`, 20, map[string]string{`cpu`: `1`}),
+		{ID: `PollCount`, MType: `counter`, Delta: &delta},
+	})
+	c.merge([]Metric{
+		gaugeMetric(`CPUutilization`, 15, map[string]string{`cpu`: `0`}),
+		{ID: `PollCount`, MType: `counter`, Delta: &delta},
+	})
+
+	metrics := c.snapshot()
+	require.Len(t, metrics, 3)
+
+	byKey := make(map[string]Metric, len(metrics))
+	for _, m := range metrics {
+		byKey[metricKey(m.ID, m.Labels)] = m
+	}
+
+	// Labels of metric win over labels of the Collector
+	m := byKey[`CPUutilization{cpu="0",host="a"}`]
+	require.NotNil(t, m.Value)
+	assert.Equal(t, 15.0, *m.Value)
+
+	m = byKey[`PollCount{cpu="all",host="a"}`]
+	require.NotNil(t, m.Delta)
+	assert.Equal(t, int64(4), *m.Delta)
+
+	labels, err := parseLabels(` env=prod, dc=eu ,`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{`env`: `prod`, `dc`: `eu`}, labels)
+
+	_, err = parseLabels(`env`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,370 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// statsdMaxPacket is a max size of StatsD packet.
+const statsdMaxPacket = 64 << 10
+
+// statsdMaxTimerValues is a max count of values of one timer kept for percentile between polls.
+const statsdMaxTimerValues = 10_000
+
+var (
+	errStatsdLine  = errors.New(`invalid statsd line`)
+	errStatsdType  = errors.New(`unknown statsd type`)
+	errStatsdValue = errors.New(`invalid statsd value`)
+	errStatsdRate  = errors.New(`invalid statsd sample rate`)
+	errNoAddress   = errors.New(`address is empty`)
+)
+
+func init() {
+	Register(`statsd`, newStatsdSource)
+}
+
+// statsdOptions are options of StatsD source in `agent.config.json`.
+type statsdOptions struct {
+	Address string `json:"address"` // `:8125`, `udp://:8125` or `unixgram:///path/to/socket`
+}
+
+// statsdSample is a parsed StatsD line.
+type statsdSample struct {
+	name     string
+	typ      string  // `c`, `g`, `ms`, `h` or `s`
+	value    float64 // Value of counter, gauge or timer
+	set      string  // Value of set
+	rate     float64 // Sample rate, 1 if not set
+	relative bool    // Gauge value is a change of the current value
+}
+
+// statsdTimer is aggregated values of timer between polls.
+type statsdTimer struct {
+	samples int
+	count   float64
+	sum     float64
+	min     float64
+	max     float64
+	values  []float64
+}
+
+// statsdSource listens StatsD packets and aggregates them between polls.
+//
+// Counters are reported as counters, gauges as gauges. Timers are reported as
+// gauges `<name>.count`, `.sum`, `.min`, `.max`, `.mean` and `.p90`, sets as
+// gauge with count of unique values. Timers and sets are reset after each poll.
+type statsdSource struct {
+	sourceBase
+	conn    net.PacketConn
+	network string
+	address string
+
+	mu       sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	changed  map[string]struct{}
+	timers   map[string]*statsdTimer
+	sets     map[string]map[string]struct{}
+}
+
+// newStatsdSource creates a source and starts listening StatsD packets.
+func newStatsdSource(opt SourceOptions) (Source, error) {
+	var o statsdOptions
+	if len(opt.Options) > 0 {
+		if err := json.Unmarshal(opt.Options, &o); err != nil {
+			return nil, err
+		}
+	}
+
+	s := newStatsdAggregator(opt)
+
+	network, address, err := parseStatsdAddress(o.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Socket file is left after previous run
+	if network == `unixgram` {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	s.network = network
+	s.address = address
+
+	go s.listen()
+
+	zap.L().Info(`StatsD listener started`, zap.String(`network`, network), zap.String(`address`, conn.LocalAddr().String()))
+
+	return s, nil
+}
+
+// newStatsdAggregator creates a source without listener.
+func newStatsdAggregator(opt SourceOptions) *statsdSource {
+	return &statsdSource{
+		sourceBase: newSourceBase(opt),
+		counters:   make(map[string]float64),
+		gauges:     make(map[string]float64),
+		changed:    make(map[string]struct{}),
+		timers:     make(map[string]*statsdTimer),
+		sets:       make(map[string]map[string]struct{}),
+	}
+}
+
+// parseStatsdAddress parses address of listener.
+//
+// Parameters:
+//   - address: the address, `:8125`, `udp://:8125` or `unixgram:///path/to/socket`.
+//
+// Returns:
+//   - string: the network.
+//   - string: the address in the network.
+//   - error: error if address is invalid.
+func parseStatsdAddress(address string) (string, string, error) {
+	network := `udp`
+	if i := strings.Index(address, `://`); i >= 0 {
+		network, address = address[:i], address[i+3:]
+	}
+
+	if address == `` {
+		return ``, ``, errNoAddress
+	}
+
+	switch network {
+	case `udp`, `udp4`, `udp6`, `unixgram`:
+		return network, address, nil
+	default:
+		return ``, ``, fmt.Errorf(`unknown network %q`, network)
+	}
+}
+
+// listen reads packets until connection is closed.
+func (s *statsdSource) listen() {
+	buf := make([]byte, statsdMaxPacket)
+
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			zap.L().Warn(`Cannot read StatsD packet`, zap.Error(err))
+			continue
+		}
+
+		s.handlePacket(buf[:n])
+	}
+}
+
+// handlePacket parses lines of the packet and aggregates them.
+//
+// Invalid lines are skipped.
+//
+// Parameters:
+//   - packet: the packet.
+func (s *statsdSource) handlePacket(packet []byte) {
+	for _, line := range bytes.Split(packet, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		sample, err := parseStatsdLine(string(line))
+		if err != nil {
+			zap.L().Debug(`Invalid StatsD line`, zap.ByteString(`line`, line), zap.Error(err))
+			continue
+		}
+
+		s.add(sample)
+	}
+}
+
+// add aggregates the sample.
+//
+// Parameters:
+//   - sample: the sample.
+func (s *statsdSource) add(sample statsdSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch sample.typ {
+	case `c`:
+		s.counters[sample.name] += sample.value / sample.rate
+	case `g`:
+		if sample.relative {
+			s.gauges[sample.name] += sample.value
+		} else {
+			s.gauges[sample.name] = sample.value
+		}
+		s.changed[sample.name] = struct{}{}
+	case `ms`, `h`:
+		t, ok := s.timers[sample.name]
+		if !ok {
+			t = &statsdTimer{min: sample.value, max: sample.value}
+			s.timers[sample.name] = t
+		}
+		t.samples++
+		t.count += 1 / sample.rate
+		t.sum += sample.value
+		t.min = math.Min(t.min, sample.value)
+		t.max = math.Max(t.max, sample.value)
+		if len(t.values) < statsdMaxTimerValues {
+			t.values = append(t.values, sample.value)
+		}
+	case `s`:
+		set, ok := s.sets[sample.name]
+		if !ok {
+			set = make(map[string]struct{})
+			s.sets[sample.name] = set
+		}
+		set[sample.set] = struct{}{}
+	}
+}
+
+// Collect returns metrics aggregated since previous poll.
+func (s *statsdSource) Collect(_ context.Context) ([]Metric, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	gauge := make(map[string]float64, len(s.changed)+len(s.timers)*6+len(s.sets))
+	metrics := make([]Metric, 0, len(s.counters))
+
+	for name, value := range s.counters {
+		// Fractional part is kept until next poll
+		delta := math.Trunc(value)
+		if delta == 0 {
+			continue
+		}
+		s.counters[name] = value - delta
+
+		d := int64(delta)
+		metrics = append(metrics, Metric{ID: name, MType: `counter`, Delta: &d})
+	}
+
+	for name := range s.changed {
+		gauge[name] = s.gauges[name]
+	}
+	s.changed = make(map[string]struct{})
+
+	for name, t := range s.timers {
+		sort.Float64s(t.values)
+
+		gauge[name+`.count`] = t.count
+		gauge[name+`.sum`] = t.sum
+		gauge[name+`.min`] = t.min
+		gauge[name+`.max`] = t.max
+		gauge[name+`.mean`] = t.sum / float64(t.samples)
+		gauge[name+`.p90`] = percentile(t.values, 90)
+	}
+	s.timers = make(map[string]*statsdTimer)
+
+	for name, set := range s.sets {
+		gauge[name] = float64(len(set))
+	}
+	s.sets = make(map[string]map[string]struct{})
+
+	return append(metrics, gaugeMetrics(gauge)...), nil
+}
+
+// Close stops listening.
+func (s *statsdSource) Close() error {
+	err := s.conn.Close()
+	if s.network == `unixgram` {
+		os.Remove(s.address)
+	}
+	return err
+}
+
+// percentile returns percentile of sorted values with nearest-rank method.
+//
+// Parameters:
+//   - values: the sorted values.
+//   - p: the percentile from 0 to 100.
+//
+// Returns:
+//   - float64: the value, 0 if values are empty.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(len(values))))
+	rank = min(max(rank, 1), len(values))
+
+	return values[rank-1]
+}
+
+// parseStatsdLine parses line in format `name:value|type[|@rate][|#tags]`.
+//
+// Tags are ignored.
+//
+// Parameters:
+//   - line: the line.
+//
+// Returns:
+//   - statsdSample: the sample.
+//   - error: error if line is invalid.
+func parseStatsdLine(line string) (statsdSample, error) {
+	name, rest, ok := strings.Cut(line, `:`)
+	if !ok || name == `` {
+		return statsdSample{}, errStatsdLine
+	}
+
+	parts := strings.Split(rest, `|`)
+	if len(parts) < 2 || parts[0] == `` {
+		return statsdSample{}, errStatsdLine
+	}
+
+	sample := statsdSample{name: name, typ: parts[1], rate: 1}
+
+	for _, p := range parts[2:] {
+		if !strings.HasPrefix(p, `@`) {
+			continue
+		}
+
+		rate, err := strconv.ParseFloat(p[1:], 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return statsdSample{}, errStatsdRate
+		}
+		sample.rate = rate
+	}
+
+	if sample.typ == `s` {
+		sample.set = parts[0]
+		return sample, nil
+	}
+
+	switch sample.typ {
+	case `c`, `ms`, `h`:
+	case `g`:
+		sample.relative = parts[0][0] == '+' || parts[0][0] == '-'
+	default:
+		return statsdSample{}, errStatsdType
+	}
+
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return statsdSample{}, errStatsdValue
+	}
+	sample.value = value
+
+	return sample, nil
+}
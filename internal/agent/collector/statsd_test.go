@@ -0,0 +1,164 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    statsdSample
+		wantErr error
+	}{
+		{line: `requests:1|c`, want: statsdSample{name: `requests`, typ: `c`, value: 1, rate: 1}},
+		{line: `requests:2|c|@0.5`, want: statsdSample{name: `requests`, typ: `c`, value: 2, rate: 0.5}},
+		{line: `requests:2|c|#env:prod|@0.1`, want: statsdSample{name: `requests`, typ: `c`, value: 2, rate: 0.1}},
+		{line: `queue:12.5|g`, want: statsdSample{name: `queue`, typ: `g`, value: 12.5, rate: 1}},
+		{line: `queue:-3|g`, want: statsdSample{name: `queue`, typ: `g`, value: -3, rate: 1, relative: true}},
+		{line: `latency:320|ms`, want: statsdSample{name: `latency`, typ: `ms`, value: 320, rate: 1}},
+		{line: `latency:320|h`, want: statsdSample{name: `latency`, typ: `h`, value: 320, rate: 1}},
+		{line: `users:alice|s`, want: statsdSample{name: `users`, typ: `s`, set: `alice`, rate: 1}},
+		{line: `requests`, wantErr: errStatsdLine},
+		{line: `:1|c`, wantErr: errStatsdLine},
+		{line: `requests:1`, wantErr: errStatsdLine},
+		{line: `requests:|c`, wantErr: errStatsdLine},
+		{line: `requests:1|x`, wantErr: errStatsdType},
+		{line: `requests:one|c`, wantErr: errStatsdValue},
+		{line: `requests:NaN|g`, wantErr: errStatsdValue},
+		{line: `requests:1|c|@0`, wantErr: errStatsdRate},
+		{line: `requests:1|c|@2`, wantErr: errStatsdRate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := parseStatsdLine(tt.line)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestStatsdAggregation(t *testing.T) {
+	s := newStatsdAggregator(SourceOptions{Name: `statsd`, PollInterval: time.Second})
+
+	s.handlePacket([]byte("requests:1|c\nrequests:1|c|@0.5\n\ninvalid\nqueue:10|g\nqueue:+5|g\n" +
+		"latency:10|ms\nlatency:30|ms\nlatency:20|ms\nusers:alice|s\nusers:bob|s\nusers:alice|s"))
+
+	got := collectStatsd(t, s)
+	assert.Equal(t, map[string]float64{
+		`requests`:      3,
+		`queue`:         15,
+		`latency.count`: 3,
+		`latency.sum`:   60,
+		`latency.min`:   10,
+		`latency.max`:   30,
+		`latency.mean`:  20,
+		`latency.p90`:   30,
+		`users`:         2,
+	}, got)
+
+	// Timers and sets are reset, gauge is reported only when changed, fractional part of counter is kept
+	s.handlePacket([]byte("requests:1|c|@0.4\nqueue:-1|g"))
+	assert.Equal(t, map[string]float64{`requests`: 2, `queue`: 14}, collectStatsd(t, s))
+
+	s.handlePacket([]byte("requests:1|c|@0.4"))
+	assert.Equal(t, map[string]float64{`requests`: 3}, collectStatsd(t, s))
+
+	assert.Empty(t, collectStatsd(t, s))
+}
+
+func TestStatsdReports(t *testing.T) {
+	lastReport := startReportServer(t)
+
+	c := newTestCollector()
+	s := newStatsdAggregator(SourceOptions{Name: `statsd`, PollInterval: time.Second})
+	r := sourceRunner{source: s, timeout: time.Second}
+
+	s.handlePacket([]byte("requests:3|c"))
+	c.pollSource(r)
+	c.sendMetrics()
+	assert.Equal(t, map[string]int64{`requests`: 3}, lastReport())
+
+	// Sent delta is not sent again
+	c.pollSource(r)
+	c.sendMetrics()
+	assert.Equal(t, map[string]int64{`requests`: 0}, lastReport())
+
+	// Increase which was collected while report was sent is kept
+	s.handlePacket([]byte("requests:2|c"))
+	c.pollSource(r)
+	c.sent(c.snapshot())
+	s.handlePacket([]byte("requests:1|c"))
+	c.pollSource(r)
+	c.sendMetrics()
+	assert.Equal(t, map[string]int64{`requests`: 1}, lastReport())
+}
+
+func TestStatsdListener(t *testing.T) {
+	options, _ := json.Marshal(statsdOptions{Address: `udp://127.0.0.1:0`})
+	source, err := NewSource(`statsd`, SourceOptions{Name: `statsd`, PollInterval: time.Second, Options: options})
+	require.NoError(t, err)
+	defer source.(io.Closer).Close()
+
+	conn, err := net.Dial(`udp`, source.(*statsdSource).conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("requests:5|c\nqueue:7|g"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		s := source.(*statsdSource)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.counters[`requests`] == 5 && s.gauges[`queue`] == 7
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, map[string]float64{`requests`: 5, `queue`: 7}, collectStatsd(t, source))
+}
+
+func TestParseStatsdAddress(t *testing.T) {
+	network, address, err := parseStatsdAddress(`:8125`)
+	require.NoError(t, err)
+	assert.Equal(t, `udp`, network)
+	assert.Equal(t, `:8125`, address)
+
+	network, address, err = parseStatsdAddress(`unixgram:///run/statsd.sock`)
+	require.NoError(t, err)
+	assert.Equal(t, `unixgram`, network)
+	assert.Equal(t, `/run/statsd.sock`, address)
+
+	_, _, err = parseStatsdAddress(`tcp://:8125`)
+	assert.Error(t, err)
+
+	_, _, err = parseStatsdAddress(`udp://`)
+	assert.ErrorIs(t, err, errNoAddress)
+}
+
+// collectStatsd collects metrics and returns values by names.
+func collectStatsd(t *testing.T, s Source) map[string]float64 {
+	metrics, err := s.Collect(context.Background())
+	require.NoError(t, err)
+
+	got := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		if m.Value != nil {
+			got[m.ID] = *m.Value
+		} else {
+			got[m.ID] = float64(*m.Delta)
+		}
+	}
+	return got
+}
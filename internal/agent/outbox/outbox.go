@@ -0,0 +1,208 @@
+// Package outbox provide bounded on-disk queue for reports which cannot be sent
+//
+// Each report is stored in its own file, named by sequence number, so the queue
+// survives restart of the agent and is replayed in the same order.
+package outbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const fileExt = `.json`
+
+type Options struct {
+	Dir      string        // Directory for reports
+	MaxBytes int64         // Max total size of reports. 0 - no limit
+	MaxAge   time.Duration // Max age of report. 0 - no limit
+}
+
+type entry struct {
+	seq     uint64
+	size    int64
+	created time.Time
+}
+
+type Outbox struct {
+	sync.Mutex
+	opt     Options
+	seq     uint64
+	size    int64
+	entries []entry
+	dropped int64
+}
+
+// Open opens the queue in the directory and loads reports left by previous run.
+//
+// Parameters:
+//   - opt: options of the queue.
+//
+// Returns:
+//   - *Outbox: the queue.
+//   - error: an error if the directory cannot be created or read.
+func Open(opt Options) (*Outbox, error) {
+	if err := os.MkdirAll(opt.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(opt.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{opt: opt}
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, fileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+
+		o.entries = append(o.entries, entry{seq: seq, size: info.Size(), created: info.ModTime()})
+		o.size += info.Size()
+		o.seq = max(o.seq, seq)
+	}
+
+	sort.Slice(o.entries, func(i, j int) bool {
+		return o.entries[i].seq < o.entries[j].seq
+	})
+
+	if len(o.entries) > 0 {
+		zap.L().Info(`Outbox restored`, zap.Int(`reports`, len(o.entries)), zap.Int64(`bytes`, o.size))
+	}
+
+	return o, nil
+}
+
+// Push adds report to the end of the queue.
+//
+// If the queue exceeds MaxBytes, the oldest reports are dropped.
+//
+// Parameters:
+//   - data: the report.
+//
+// Returns:
+//   - error: an error if the report cannot be written.
+func (o *Outbox) Push(data []byte) error {
+	o.Lock()
+	defer o.Unlock()
+
+	o.seq++
+	e := entry{seq: o.seq, size: int64(len(data)), created: time.Now()}
+
+	// Write into temporary file first, so queue never contains partial report
+	tmp := filepath.Join(o.opt.Dir, fmt.Sprintf(`%020d.tmp`, e.seq))
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.path(e.seq)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	o.entries = append(o.entries, e)
+	o.size += e.size
+
+	// Drop the oldest reports
+	for o.opt.MaxBytes > 0 && o.size > o.opt.MaxBytes && len(o.entries) > 0 {
+		o.drop()
+	}
+
+	return nil
+}
+
+// Replay sends reports from the oldest one and removes sent reports.
+//
+// Replay stops on the first failure, so order of reports is kept. Reports
+// older than MaxAge are dropped without sending.
+//
+// Parameters:
+//   - send: the function which sends one report.
+//
+// Returns:
+//   - error: the error of send, if any.
+func (o *Outbox) Replay(send func(data []byte) error) error {
+	o.Lock()
+	defer o.Unlock()
+
+	for len(o.entries) > 0 {
+		e := o.entries[0]
+
+		if o.opt.MaxAge > 0 && time.Since(e.created) > o.opt.MaxAge {
+			o.drop()
+			continue
+		}
+
+		data, err := os.ReadFile(o.path(e.seq))
+		if err != nil {
+			zap.L().Error(`Cannot read report from outbox`, zap.Error(err))
+			o.drop()
+			continue
+		}
+
+		if err := send(data); err != nil {
+			return err
+		}
+
+		o.remove()
+	}
+
+	return nil
+}
+
+// Len returns count of reports in the queue.
+func (o *Outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+
+	return len(o.entries)
+}
+
+// Dropped returns count of reports dropped because of limits since start.
+func (o *Outbox) Dropped() int64 {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.dropped
+}
+
+// drop removes the oldest report and counts it as dropped.
+func (o *Outbox) drop() {
+	zap.L().Warn(`Report dropped from outbox`, zap.Uint64(`seq`, o.entries[0].seq))
+	o.dropped++
+	o.remove()
+}
+
+// remove removes the oldest report.
+func (o *Outbox) remove() {
+	e := o.entries[0]
+	if err := os.Remove(o.path(e.seq)); err != nil && !os.IsNotExist(err) {
+		zap.L().Error(`Cannot remove report from outbox`, zap.Error(err))
+	}
+
+	o.entries = o.entries[1:]
+	o.size -= e.size
+}
+
+// path returns path of report file.
+func (o *Outbox) path(seq uint64) string {
+	return filepath.Join(o.opt.Dir, fmt.Sprintf(`%020d%s`, seq, fileExt))
+}
@@ -0,0 +1,56 @@
+package outbox
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	dir := t.TempDir()
+
+	o, err := Open(Options{Dir: dir, MaxBytes: 10})
+	require.NoError(t, err)
+
+	require.NoError(t, o.Push([]byte(`aaaa`)))
+	require.NoError(t, o.Push([]byte(`bbbb`)))
+	require.NoError(t, o.Push([]byte(`cccc`))) // `aaaa` is dropped by size limit
+	assert.Equal(t, 2, o.Len())
+	assert.Equal(t, int64(1), o.Dropped())
+
+	// Failed send keeps reports
+	errSend := errors.New(`server is unavailable`)
+	assert.ErrorIs(t, o.Replay(func([]byte) error { return errSend }), errSend)
+	assert.Equal(t, 2, o.Len())
+
+	// Reports survive restart and are replayed in order
+	o, err = Open(Options{Dir: dir, MaxBytes: 10})
+	require.NoError(t, err)
+	require.NoError(t, o.Push([]byte(`dd`)))
+
+	var sent []string
+	require.NoError(t, o.Replay(func(data []byte) error {
+		sent = append(sent, string(data))
+		return nil
+	}))
+	assert.Equal(t, []string{`bbbb`, `cccc`, `dd`}, sent)
+	assert.Equal(t, 0, o.Len())
+}
+
+func TestOutboxMaxAge(t *testing.T) {
+	o, err := Open(Options{Dir: t.TempDir(), MaxAge: time.Millisecond})
+	require.NoError(t, err)
+
+	require.NoError(t, o.Push([]byte(`old`)))
+	time.Sleep(5 * time.Millisecond)
+
+	require.NoError(t, o.Replay(func([]byte) error {
+		t.Fatal(`expired report was sent`)
+		return nil
+	}))
+	assert.Equal(t, 0, o.Len())
+	assert.Equal(t, int64(1), o.Dropped())
+}
@@ -0,0 +1,180 @@
+package rpc
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/Jourloy/go-metrics-collector/internal/sign"
+)
+
+const (
+	// HashKey is a metadata key with signature of request or response.
+	HashKey = `hashsha256`
+	// TimestampKey is a metadata key with unix time of request or stream opening.
+	TimestampKey = `x-timestamp`
+	// NonceKey is a metadata key with unique string of request or stream.
+	NonceKey = `x-nonce`
+)
+
+// signatureField is a field of stream messages with their signature.
+const signatureField = `signature`
+
+// UnaryHashInterceptor signs each request and verifies signature of response.
+//
+// Signature is HMAC-SHA256 of timestamp, nonce and deterministic protobuf
+// encoding of the message, see sign.SumRequest.
+//
+// Parameters:
+//   - key: the secret key. If empty, requests are not signed.
+func UnaryHashInterceptor(key string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if key == `` {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		b, err := marshal(req)
+		if err != nil {
+			return err
+		}
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce := sign.NewNonce()
+		ctx = metadata.AppendToOutgoingContext(ctx,
+			TimestampKey, ts,
+			NonceKey, nonce,
+			HashKey, sign.SumRequest(key, ts, nonce, b),
+		)
+
+		var header metadata.MD
+		if err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&header))...); err != nil {
+			return err
+		}
+
+		// Check signature of response if server sent it
+		if values := header.Get(HashKey); len(values) > 0 {
+			b, err := marshal(reply)
+			if err != nil {
+				return err
+			}
+			if !sign.Verify(key, values[0], b) {
+				return status.Error(codes.DataLoss, `response signature mismatch`)
+			}
+		}
+
+		return nil
+	}
+}
+
+// StreamHashInterceptor signs method with timestamp and nonce of stream
+// opening, and each sent message of stream into its `signature` field.
+//
+// Parameters:
+//   - key: the secret key. If empty, streams are not signed.
+func StreamHashInterceptor(key string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if key == `` {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce := sign.NewNonce()
+		ctx = metadata.AppendToOutgoingContext(ctx,
+			TimestampKey, ts,
+			NonceKey, nonce,
+			HashKey, sign.SumRequest(key, ts, nonce, []byte(method)),
+		)
+
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		return &signedClientStream{ClientStream: stream, key: key, ts: ts, nonce: nonce}, nil
+	}
+}
+
+// signedClientStream signs each sent message.
+type signedClientStream struct {
+	grpc.ClientStream
+	key   string
+	ts    string
+	nonce string
+	seq   int64 // Number of the next message
+}
+
+// SendMsg signs copy of message and sends it.
+func (s *signedClientStream) SendMsg(m any) error {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return status.Error(codes.Internal, `message is not protobuf`)
+	}
+
+	field := msg.ProtoReflect().Descriptor().Fields().ByName(signatureField)
+	if field == nil {
+		return status.Error(codes.Internal, `message of stream cannot be signed`)
+	}
+
+	signed := proto.Clone(msg)
+	signed.ProtoReflect().Clear(field)
+
+	b, err := marshal(signed)
+	if err != nil {
+		return err
+	}
+
+	signed.ProtoReflect().Set(field, protoreflect.ValueOfString(sign.SumMessage(s.key, s.ts, s.nonce, s.seq, b)))
+	s.seq++
+
+	return s.ClientStream.SendMsg(signed)
+}
+
+// UnaryLoggerInterceptor logs method, status and latency of each unary call.
+func UnaryLoggerInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		t := time.Now()
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+
+		logCall(method, err, time.Since(t))
+		return err
+	}
+}
+
+// StreamLoggerInterceptor logs method, status and latency of stream opening.
+func StreamLoggerInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		t := time.Now()
+
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+
+		logCall(method, err, time.Since(t))
+		return stream, err
+	}
+}
+
+// logCall logs details of finished call.
+func logCall(method string, err error, latency time.Duration) {
+	zap.L().Debug(
+		`gRPC`,
+		zap.String(`status`, status.Code(err).String()),
+		zap.String(`method`, method),
+		zap.Duration(`latency`, latency),
+	)
+}
+
+// marshal encodes message deterministically, so signatures are stable.
+func marshal(m any) ([]byte, error) {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return nil, status.Error(codes.Internal, `message is not protobuf`)
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+}
@@ -1,22 +1,158 @@
+// Package rpc provide gRPC client for send metrics to the server
 package rpc
 
 import (
-	"log"
+	"context"
+	"errors"
+	"io"
+	"sync"
 
-	"github.com/Jourloy/go-metrics-collector/internal/proto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/Jourloy/go-metrics-collector/internal/proto"
 )
 
-func Connect() proto.MetricServiceClient {
-	// устанавливаем соединение с сервером
-	conn, err := grpc.Dial(":3200", grpc.WithTransportCredentials(insecure.NewCredentials()))
+var errStreamClosed = errors.New(`stream is closed by the server`)
+
+// Client is a connection to the gRPC metric service.
+//
+// Client keeps one long-lived stream for StreamMetrics and reopens it
+// after failure.
+type Client struct {
+	conn   *grpc.ClientConn
+	client proto.MetricServiceClient
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu           sync.Mutex
+	stream       proto.MetricService_StreamMetricsClient
+	cancelStream context.CancelFunc
+}
+
+// Connect creates a client for the gRPC server on the given address.
+//
+// Connection is established lazily, so the server may be unavailable at
+// the moment of call.
+//
+// Parameters:
+//   - address: host and port of the gRPC server.
+//   - opts: additional dial options.
+//
+// Returns:
+//   - *Client: the client, which should be closed after use.
+//   - error: an error if the client cannot be created.
+func Connect(address string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+
+	conn, err := grpc.Dial(address, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Client{
+		conn:   conn,
+		client: proto.NewMetricServiceClient(conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// UpdateMetrics sends batch of metrics in one request.
+//
+// Parameters:
+//   - ctx: the context of request.
+//   - metrics: the batch of metrics.
+//
+// Returns:
+//   - []*proto.Metric: metrics with values updated by the server.
+//   - error: gRPC status error if the batch was rejected.
+func (c *Client) UpdateMetrics(ctx context.Context, metrics []*proto.Metric) ([]*proto.Metric, error) {
+	res, err := c.client.UpdateMetrics(ctx, &proto.UpdateMetricsRequest{
+		Metrics: metrics,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Metrics, nil
+}
+
+// StreamMetrics sends batch of metrics into the long-lived stream and waits
+// for acknowledgement of the server.
+//
+// The stream is opened on first call. Batches are sent one by one, so the
+// next batch is sent only after the previous one is acknowledged. After
+// failure the stream is closed and next call opens a new one.
+//
+// Parameters:
+//   - ctx: the context which limits waiting for acknowledgement.
+//   - metrics: the batch of metrics.
+//
+// Returns:
+//   - error: gRPC status error if the batch was rejected, or ctx error if
+//     acknowledgement was not received in time. Batch is delivered only if
+//     error is nil.
+func (c *Client) StreamMetrics(ctx context.Context, metrics []*proto.Metric) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stream == nil {
+		streamCtx, cancel := context.WithCancel(c.ctx)
+		stream, err := c.client.StreamMetrics(streamCtx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		c.stream = stream
+		c.cancelStream = cancel
+	}
+
+	// Recv can't be interrupted by ctx, so it waits in goroutine
+	ack := make(chan error, 1)
+	go func(stream proto.MetricService_StreamMetricsClient) {
+		// If Send fails, the real reason of failure is returned by Recv
+		stream.Send(&proto.UpdateMetricsRequest{Metrics: metrics})
+		_, err := stream.Recv()
+		if err == io.EOF {
+			err = errStreamClosed
+		}
+		ack <- err
+	}(c.stream)
+
+	var err error
+	select {
+	case err = <-ack:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Goroutine may still wait for the server, so stream is cancelled
 	if err != nil {
-		log.Fatal(err)
+		c.cancelStream()
+		c.stream = nil
+	}
+
+	return err
+}
+
+// Close closes the stream and the connection to the server.
+//
+// Returns:
+//   - error: an error of closing the connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stream != nil {
+		c.stream.CloseSend()
+		c.cancelStream()
+		c.stream = nil
 	}
-	defer conn.Close()
-	// получаем переменную интерфейсного типа UsersClient,
-	// через которую будем отправлять сообщения
-	c := proto.NewMetricServiceClient(conn)
-	return c
+	c.cancel()
+
+	return c.conn.Close()
 }
@@ -0,0 +1,145 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Jourloy/go-metrics-collector/internal/proto"
+	"github.com/Jourloy/go-metrics-collector/internal/server/rpc"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository/memory"
+)
+
+// startServer starts server with the given key over in-process listener and
+// returns client with the given key.
+func startServer(t *testing.T, serverKey string, clientKey string) (*memory.MemStorage, *Client) {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+	s := memory.CreateRepository(memory.Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+	})
+
+	listener := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(rpc.UnaryHashInterceptor(serverKey)),
+		grpc.StreamInterceptor(rpc.StreamHashInterceptor(serverKey)),
+	)
+	proto.RegisterMetricServiceServer(srv, rpc.CreateMetricServer(s))
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	client, err := Connect(`bufnet`,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithChainUnaryInterceptor(UnaryLoggerInterceptor(), UnaryHashInterceptor(clientKey)),
+		grpc.WithChainStreamInterceptor(StreamLoggerInterceptor(), StreamHashInterceptor(clientKey)),
+	)
+	require.NoError(t, err)
+
+	return s, client
+}
+
+func TestClient(t *testing.T) {
+	s, client := startServer(t, `secret`, `secret`)
+
+	ctx := context.Background()
+
+	// Send batch in one request
+	updated, err := client.UpdateMetrics(ctx, []*proto.Metric{
+		{Id: `Alloc`, Type: proto.MetricType_GAUGE, Value: 2.5},
+		{Id: `PollCount`, Type: proto.MetricType_COUNTER, Delta: 1},
+	})
+	require.NoError(t, err)
+	assert.Len(t, updated, 2)
+
+	// Send batches into one stream, each batch is saved when ack is received
+	for i := 0; i < 3; i++ {
+		require.NoError(t, client.StreamMetrics(ctx, []*proto.Metric{
+			{Id: `PollCount`, Type: proto.MetricType_COUNTER, Delta: 1},
+		}))
+
+		counter, err := s.GetCounterValue(ctx, `PollCount`)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i+2), counter)
+	}
+
+	// Rejected batch closes the stream, the next batch opens a new one
+	err = client.StreamMetrics(ctx, []*proto.Metric{{Id: `PollCount`}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.NoError(t, client.StreamMetrics(ctx, []*proto.Metric{
+		{Id: `PollCount`, Type: proto.MetricType_COUNTER, Delta: 1},
+	}))
+	require.NoError(t, client.Close())
+
+	gauge, err := s.GetGaugeValue(context.Background(), `Alloc`)
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, gauge)
+
+	counter, err := s.GetCounterValue(context.Background(), `PollCount`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), counter)
+}
+
+func TestClientWithWrongKey(t *testing.T) {
+	_, client := startServer(t, `secret`, `wrong`)
+
+	_, err := client.UpdateMetrics(context.Background(), []*proto.Metric{
+		{Id: `Alloc`, Type: proto.MetricType_GAUGE, Value: 1},
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	err = client.StreamMetrics(context.Background(), []*proto.Metric{
+		{Id: `Alloc`, Type: proto.MetricType_GAUGE, Value: 1},
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientWithoutAck(t *testing.T) {
+	// Server accepts stream, but never acknowledges batches
+	listener := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer()
+	proto.RegisterMetricServiceServer(srv, silentServer{})
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	client, err := Connect(`bufnet`,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = client.StreamMetrics(ctx, []*proto.Metric{
+		{Id: `PollCount`, Type: proto.MetricType_COUNTER, Delta: 1},
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// silentServer receives batches without acknowledgement.
+type silentServer struct {
+	proto.UnimplementedMetricServiceServer
+}
+
+func (silentServer) StreamMetrics(stream proto.MetricService_StreamMetricsServer) error {
+	for {
+		if _, err := stream.Recv(); err != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Package encrypt provide asymmetric encryption of request bodies
+//
+// Small payloads are encrypted with RSA-OAEP directly. Payloads which do not fit
+// into one RSA block are encrypted with random AES-GCM key, and the key is
+// encrypted with RSA-OAEP.
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+)
+
+// HeaderEncryption is a header which marks encrypted request body.
+const HeaderEncryption = `X-Encryption`
+
+// Algorithm is a value of HeaderEncryption.
+const Algorithm = `rsa-oaep`
+
+// Modes of encrypted message. Mode is the first byte of the message.
+const (
+	modeRSA    byte = 1 // RSA-OAEP of data
+	modeHybrid byte = 2 // RSA-OAEP of AES key, nonce and AES-GCM of data
+)
+
+const aesKeySize = 32
+
+var errMessage = errors.New(`encrypted message is invalid`)
+var errPEM = errors.New(`PEM block not found`)
+var errKeyType = errors.New(`key is not RSA key`)
+
+// Encrypt encrypts data with the public key.
+//
+// Parameters:
+//   - key: the public key of the server.
+//   - data: the data to encrypt.
+//
+// Returns:
+//   - []byte: the encrypted message.
+//   - error: an error if encryption failed.
+func Encrypt(key *rsa.PublicKey, data []byte) ([]byte, error) {
+	// Max size of data for RSA-OAEP with SHA-256
+	limit := key.Size() - 2*sha256.Size - 2
+
+	if len(data) <= limit {
+		c, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, data, nil)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{modeRSA}, c...), nil
+	}
+
+	// Encrypt data with random AES key
+	aesKey := make([]byte, aesKeySize)
+	if _, err := rand.Read(aesKey); err != nil {
+		return nil, err
+	}
+
+	aesgcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, aesKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, 0, 1+len(encryptedKey)+len(nonce)+len(data)+aesgcm.Overhead())
+	message = append(message, modeHybrid)
+	message = append(message, encryptedKey...)
+	message = append(message, nonce...)
+
+	return aesgcm.Seal(message, nonce, data, nil), nil
+}
+
+// Decrypt decrypts message encrypted by Encrypt.
+//
+// Parameters:
+//   - key: the private key of the server.
+//   - message: the encrypted message.
+//
+// Returns:
+//   - []byte: the decrypted data.
+//   - error: an error if message is invalid.
+func Decrypt(key *rsa.PrivateKey, message []byte) ([]byte, error) {
+	if len(message) < 1+key.Size() {
+		return nil, errMessage
+	}
+
+	switch message[0] {
+	case modeRSA:
+		return rsa.DecryptOAEP(sha256.New(), nil, key, message[1:], nil)
+	case modeHybrid:
+		encryptedKey := message[1 : 1+key.Size()]
+		aesKey, err := rsa.DecryptOAEP(sha256.New(), nil, key, encryptedKey, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		aesgcm, err := newGCM(aesKey)
+		if err != nil {
+			return nil, err
+		}
+
+		rest := message[1+key.Size():]
+		if len(rest) < aesgcm.NonceSize() {
+			return nil, errMessage
+		}
+
+		return aesgcm.Open(nil, rest[:aesgcm.NonceSize()], rest[aesgcm.NonceSize():], nil)
+	default:
+		return nil, errMessage
+	}
+}
+
+// newGCM creates AES-GCM cipher with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateKeys generates RSA key pair in PEM format.
+//
+// Parameters:
+//   - bits: the size of key.
+//
+// Returns:
+//   - []byte: the private key in PKCS #1 format.
+//   - []byte: the public key in PKIX format.
+//   - error: an error if generation failed.
+func GenerateKeys(bits int) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privatePEM := pem.EncodeToMemory(&pem.Block{
+		Type:  `RSA PRIVATE KEY`,
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	publicPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  `PUBLIC KEY`,
+		Bytes: public,
+	})
+
+	return privatePEM, publicPEM, nil
+}
+
+// LoadPublicKey reads PEM encoded RSA public key from file.
+//
+// Parameters:
+//   - path: the path to the file with PKIX or PKCS #1 key.
+//
+// Returns:
+//   - *rsa.PublicKey: the key.
+//   - error: an error if file cannot be read or parsed.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errKeyType
+	}
+
+	return rsaKey, nil
+}
+
+// LoadPrivateKey reads PEM encoded RSA private key from file.
+//
+// Parameters:
+//   - path: the path to the file with PKCS #1 or PKCS #8 key.
+//
+// Returns:
+//   - *rsa.PrivateKey: the key.
+//   - error: an error if file cannot be read or parsed.
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errKeyType
+	}
+
+	return rsaKey, nil
+}
+
+// readPEM reads the first PEM block from file.
+func readPEM(path string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errPEM
+	}
+
+	return block, nil
+}
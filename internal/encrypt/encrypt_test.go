@@ -0,0 +1,50 @@
+package encrypt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncrypt(t *testing.T) {
+	privatePEM, publicPEM, err := GenerateKeys(2048)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	privatePath := filepath.Join(dir, `private.pem`)
+	publicPath := filepath.Join(dir, `public.pem`)
+	require.NoError(t, os.WriteFile(privatePath, privatePEM, 0600))
+	require.NoError(t, os.WriteFile(publicPath, publicPEM, 0644))
+
+	private, err := LoadPrivateKey(privatePath)
+	require.NoError(t, err)
+	public, err := LoadPublicKey(publicPath)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: `Small (RSA)`, data: []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)},
+		{name: `Large (hybrid)`, data: bytes.Repeat([]byte(`metric`), 10_000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := Encrypt(public, tt.data)
+			require.NoError(t, err)
+
+			data, err := Decrypt(private, message)
+			require.NoError(t, err)
+			assert.Equal(t, tt.data, data)
+
+			// Corrupted message
+			message[len(message)-1] ^= 0xff
+			_, err = Decrypt(private, message)
+			assert.Error(t, err)
+		})
+	}
+}
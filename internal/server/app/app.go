@@ -2,12 +2,20 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strconv"
 
+	"github.com/Jourloy/go-metrics-collector/internal/proto/prompb"
+	"github.com/Jourloy/go-metrics-collector/internal/server/influx"
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+	"github.com/Jourloy/go-metrics-collector/internal/server/otlp"
 	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
@@ -20,29 +28,92 @@ var errCounter error = errors.New(`counter value not found`)
 var errGauge error = errors.New(`gauge value not found`)
 var errNotFound error = errors.New(`404 page not found`)
 var errBody error = errors.New(`body not found`)
+var errStorage error = errors.New(`storage is unavailable`)
+var errTooLarge error = errors.New(`body is too large`)
+
+// MaxBodySize is a max size of body of request, compressed and decompressed.
+var MaxBodySize = flag.Int64(`max-body`, 32<<20, `Max size of body of request in bytes`)
+
+// ParseEnv overrides flags by MAX_BODY_SIZE environment variable.
+func ParseEnv() {
+	if env, exist := os.LookupEnv(`MAX_BODY_SIZE`); exist {
+		if n, err := strconv.ParseInt(env, 10, 64); err == nil {
+			MaxBodySize = &n
+		}
+	}
+}
 
 type AppSevice struct {
-	storage storage.Storage
+	storage     storage.Storage
+	ingest      *ingest.Writer
+	remoteTypes remoteWriteTypes
+	influxRules influx.Rules
+	otlp        *otlp.Server
+	maxBody     int64
 }
 
 type Metric struct {
-	ID    string   `json:"id"`              // Name of metric
-	MType string   `json:"type"`            // Gauge or Counter
-	Delta *int64   `json:"delta,omitempty"` // Value if metric is a counter
-	Value *float64 `json:"value,omitempty"` // Value if metric is a gauge
+	ID     string         `json:"id"`               // Name of metric
+	MType  string         `json:"type"`             // Gauge or Counter
+	Delta  *int64         `json:"delta,omitempty"`  // Value if metric is a counter
+	Value  *float64       `json:"value,omitempty"`  // Value if metric is a gauge
+	Labels storage.Labels `json:"labels,omitempty"` // Dimensions of metric, e.g. host
 }
 
 // GetAppSevice returns an instance of AppService initialized with the given storage.
 //
 // Parameters:
 //   - s: the storage instance to be used by the AppService.
+//   - w: the writer of samples of external protocols, shared with other
+//     receivers, so each counter has one baseline.
 //
 // Return:
 //   - *AppService: a pointer to the initialized AppService instance.
-func GetAppSevice(s storage.Storage) *AppSevice {
+func GetAppSevice(s storage.Storage, w *ingest.Writer) *AppSevice {
+	ParseEnv()
+	influx.ParseEnv()
+	rules, err := influx.ParseRules(*influx.Counters)
+	if err != nil {
+		zap.L().Fatal(`Cannot parse rules of InfluxDB counters`, zap.Error(err))
+	}
+
 	return &AppSevice{
-		storage: s,
+		storage:     s,
+		ingest:      w,
+		otlp:        otlp.NewServer(w),
+		remoteTypes: remoteWriteTypes{types: make(map[string]prompb.MetricMetadata_MetricType)},
+		influxRules: rules,
+		maxBody:     *MaxBodySize,
+	}
+}
+
+// readBody reads body of request which is not larger than MaxBodySize.
+//
+// Responds with 413 if body is too large and 400 if it cannot be read.
+//
+// Parameters:
+//   - ctx: the gin context.
+//
+// Returns:
+//   - []byte: the body.
+//   - bool: false if body is not read and response is written.
+func (a *AppSevice) readBody(ctx *gin.Context) ([]byte, bool) {
+	b, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, a.maxBody))
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		zap.L().Error(errTooLarge.Error(), zap.Int64(`limit`, maxErr.Limit))
+		ctx.String(http.StatusRequestEntityTooLarge, errTooLarge.Error())
+		return nil, false
+	}
+
+	if err != nil {
+		zap.L().Error(errBody.Error(), zap.Error(err))
+		ctx.String(http.StatusBadRequest, errBody.Error())
+		return nil, false
 	}
+
+	return b, true
 }
 
 // Pong returns the response "Live" with a status code of 200 OK.
@@ -95,11 +166,11 @@ func (a *AppSevice) UpdateMetricByParams(ctx *gin.Context) {
 		return
 	}
 
-	// Update metric
-	metric, err := a.updateMetric(name, mType, nil, nil, &value)
+	// Update metric, labels are passed as query parameters
+	metric, err := a.updateMetric(ctx.Request.Context(), name, queryLabels(ctx), mType, nil, nil, &value)
 	if err != nil {
 		zap.L().Error(err.Error())
-		ctx.String(http.StatusBadRequest, err.Error())
+		ctx.String(errorStatus(err), err.Error())
 		return
 	}
 
@@ -130,10 +201,10 @@ func (a *AppSevice) UpdateMetricByBody(ctx *gin.Context) {
 	}
 
 	// Update metric
-	updated, err := a.updateMetric(metric.ID, metric.MType, metric.Value, metric.Delta, nil)
+	updated, err := a.updateMetric(ctx.Request.Context(), metric.ID, metric.Labels, metric.MType, metric.Value, metric.Delta, nil)
 	if err != nil {
 		zap.L().Error(err.Error())
-		ctx.String(http.StatusBadRequest, err.Error())
+		ctx.String(errorStatus(err), err.Error())
 		return
 	}
 
@@ -142,7 +213,22 @@ func (a *AppSevice) UpdateMetricByBody(ctx *gin.Context) {
 
 type Metrics []Metric
 
-// UpdateManyMetrics updates multiple metrics from butch request.
+// BatchError describes a metric from batch request which cannot be applied.
+type BatchError struct {
+	Index int    `json:"index"` // Position of metric in the batch
+	ID    string `json:"id"`    // Name of metric
+	Error string `json:"error"` // Reason of failure
+}
+
+// UpdateManyMetrics updates multiple metrics from batch request.
+//
+// The batch is validated before any metric is written and is saved by
+// storage.UpdateBatch, so it applies either fully or not at all. If some
+// metrics are invalid, the handler returns 400 with list of BatchError in
+// `errors` field.
+//
+// Parameters:
+//   - ctx: the gin context.
 func (a *AppSevice) UpdateManyMetrics(ctx *gin.Context) {
 	// Check storage
 	if !a.checkStorage(ctx) {
@@ -172,26 +258,96 @@ func (a *AppSevice) UpdateManyMetrics(ctx *gin.Context) {
 		return
 	}
 
-	for _, metric := range body {
-		// Check metric type
-		if !a.checkMetricType(metric.MType, ctx) {
-			continue
+	// Validate whole batch before update
+	batchErrors := []BatchError{}
+	for i, metric := range body {
+		if err := a.validateMetric(metric); err != nil {
+			batchErrors = append(batchErrors, BatchError{
+				Index: i,
+				ID:    metric.ID,
+				Error: err.Error(),
+			})
 		}
+	}
 
-		_, err := a.updateMetric(metric.ID, metric.MType, metric.Value, metric.Delta, nil)
-		if err != nil {
-			zap.L().Error(`Failed to update metric`, zap.Error(err))
-			continue
+	if len(batchErrors) > 0 {
+		zap.L().Error(`Batch rejected`, zap.Int(`invalid`, len(batchErrors)), zap.Int(`total`, len(body)))
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			`errors`: batchErrors,
+		})
+		return
+	}
+
+	// Values are checked by validateMetric
+	batch := make([]storage.Metric, len(body))
+	for i, metric := range body {
+		batch[i] = storage.Metric{Name: storage.SeriesKey(metric.ID, metric.Labels), MType: metric.MType}
+		if metric.MType == `counter` {
+			batch[i].Delta = *metric.Delta
+		} else {
+			batch[i].Value = *metric.Value
+		}
+	}
+
+	result, err := a.storage.UpdateBatch(ctx.Request.Context(), batch)
+	if err != nil {
+		err = fmt.Errorf(`%w: %w`, errStorage, err)
+		zap.L().Error(`Failed to update batch`, zap.Error(err))
+		ctx.String(errorStatus(err), err.Error())
+		return
+	}
+
+	updated := make(Metrics, len(body))
+	for i, metric := range body {
+		updated[i] = Metric{ID: metric.ID, MType: metric.MType, Labels: metric.Labels}
+		if metric.MType == `counter` {
+			updated[i].Delta = &result[i].Delta
+		} else {
+			updated[i].Value = &result[i].Value
 		}
 	}
 
-	ctx.JSON(http.StatusOK, body)
+	ctx.JSON(http.StatusOK, updated)
+}
+
+// validateMetric checks that metric has name, known type and value for its type.
+//
+// Parameters:
+//   - metric: the metric to check.
+//
+// Returns:
+//   - error: nil if metric is valid.
+func (a *AppSevice) validateMetric(metric Metric) error {
+	if metric.ID == `` {
+		return errName
+	}
+
+	if err := storage.CheckSeries(metric.ID, metric.Labels); err != nil {
+		return err
+	}
+
+	switch metric.MType {
+	case `counter`:
+		if metric.Delta == nil {
+			return errCounter
+		}
+	case `gauge`:
+		if metric.Value == nil {
+			return errGauge
+		}
+	default:
+		return errType
+	}
+
+	return nil
 }
 
 // updateMetric updates a metric based on the provided parameters.
 //
 // Parameters:
+// - ctx: the context of request.
 // - name: the name of the metric.
+// - labels: the labels of the metric (optional).
 // - mType: the type of the metric. Only `counter` and `gauge` are supported.
 // - value: the value of the metric (optional).
 // - delta: the delta value of the metric (optional).
@@ -199,8 +355,13 @@ func (a *AppSevice) UpdateManyMetrics(ctx *gin.Context) {
 //
 // Returns:
 // - Metric: the updated metric.
-// - error: an error if the metric update fails.
-func (a *AppSevice) updateMetric(name string, mType string, value *float64, delta *int64, strValue *string) (Metric, error) {
+// - error: an error if the metric is invalid or errStorage if the update fails.
+func (a *AppSevice) updateMetric(ctx context.Context, name string, labels storage.Labels, mType string, value *float64, delta *int64, strValue *string) (Metric, error) {
+	if err := storage.CheckSeries(name, labels); err != nil {
+		return Metric{}, err
+	}
+	key := storage.SeriesKey(name, labels)
+
 	// Update counter metric
 	if mType == `counter` {
 		var v int64
@@ -219,11 +380,15 @@ func (a *AppSevice) updateMetric(name string, mType string, value *float64, delt
 		}
 
 		// Update metric
-		u := a.storage.UpdateCounterMetric(name, v)
+		u, err := a.storage.UpdateCounterMetric(ctx, key, v)
+		if err != nil {
+			return Metric{}, fmt.Errorf(`%w: %w`, errStorage, err)
+		}
 		updated := Metric{
-			ID:    name,
-			MType: mType,
-			Delta: &u,
+			ID:     name,
+			MType:  mType,
+			Delta:  &u,
+			Labels: labels,
 		}
 
 		return updated, nil
@@ -246,11 +411,15 @@ func (a *AppSevice) updateMetric(name string, mType string, value *float64, delt
 	}
 
 	// Update metric
-	u := a.storage.UpdateGaugeMetric(name, v)
+	u, err := a.storage.UpdateGaugeMetric(ctx, key, v)
+	if err != nil {
+		return Metric{}, fmt.Errorf(`%w: %w`, errStorage, err)
+	}
 	updated := Metric{
-		ID:    name,
-		MType: mType,
-		Value: &u,
+		ID:     name,
+		MType:  mType,
+		Value:  &u,
+		Labels: labels,
 	}
 
 	return updated, nil
@@ -280,31 +449,20 @@ func (a *AppSevice) GetMetricByParams(ctx *gin.Context) {
 		return
 	}
 
-	// Get counter metric
-	if mType == `counter` {
-		u, err := a.storage.GetCounterValue(name)
-		if !err {
-			zap.L().Error(errNotFound.Error())
-			ctx.String(http.StatusNotFound, errNotFound.Error())
-			return
-		}
-
-		ctx.String(http.StatusOK, `%d`, u)
+	// Labels are passed as query parameters
+	metric, err := a.findMetric(ctx.Request.Context(), name, queryLabels(ctx), mType)
+	if err != nil {
+		zap.L().Error(err.Error())
+		ctx.String(errorStatus(err), err.Error())
 		return
 	}
 
-	// Get gauge metric
-	if mType == `gauge` {
-		u, err := a.storage.GetGaugeValue(name)
-		if !err {
-			zap.L().Error(errNotFound.Error())
-			ctx.String(http.StatusNotFound, errNotFound.Error())
-			return
-		}
-
-		ctx.String(http.StatusOK, `%g`, u)
+	if metric.Delta != nil {
+		ctx.String(http.StatusOK, `%d`, *metric.Delta)
 		return
 	}
+
+	ctx.String(http.StatusOK, `%g`, *metric.Value)
 }
 
 // GetMetricByBody retrieves a metric based on the request body.
@@ -330,36 +488,11 @@ func (a *AppSevice) GetMetricByBody(ctx *gin.Context) {
 		return
 	}
 
-	var metric Metric
-
-	// Get counter metric
-	if template.MType == `counter` {
-		u, ok := a.storage.GetCounterValue(template.ID)
-		if !ok {
-			zap.L().Error(errNotFound.Error())
-			ctx.String(http.StatusNotFound, errNotFound.Error())
-			return
-		}
-		metric = Metric{
-			ID:    template.ID,
-			MType: template.MType,
-			Delta: &u,
-		}
-	}
-
-	// Get gauge metric
-	if template.MType == `gauge` {
-		u, ok := a.storage.GetGaugeValue(template.ID)
-		if !ok {
-			zap.L().Error(errNotFound.Error())
-			ctx.String(http.StatusNotFound, errNotFound.Error())
-			return
-		}
-		metric = Metric{
-			ID:    template.ID,
-			MType: template.MType,
-			Value: &u,
-		}
+	metric, err := a.findMetric(ctx.Request.Context(), template.ID, template.Labels, template.MType)
+	if err != nil {
+		zap.L().Error(err.Error())
+		ctx.String(errorStatus(err), err.Error())
+		return
 	}
 
 	ctx.Header(`Content-Type`, `application/json`)
@@ -371,7 +504,16 @@ func (a *AppSevice) GetMetricByBody(ctx *gin.Context) {
 // Parameters:
 //   - ctx: the gin context.
 func (a *AppSevice) GetAllMetrics(ctx *gin.Context) {
-	gauge, counter := a.storage.GetValues()
+	if !a.checkStorage(ctx) {
+		return
+	}
+
+	gauge, counter, err := a.storage.GetValues(ctx.Request.Context())
+	if err != nil {
+		zap.L().Error(err.Error())
+		ctx.String(http.StatusServiceUnavailable, errStorage.Error())
+		return
+	}
 
 	merged := make(map[string]any, len(gauge)+len(counter))
 
@@ -387,6 +529,86 @@ func (a *AppSevice) GetAllMetrics(ctx *gin.Context) {
 	})
 }
 
+// findMetric finds metric by name and labels.
+//
+// Labels are a filter, see storage.FindCounter.
+//
+// Parameters:
+//   - ctx: the context of request.
+//   - name: the name of the metric.
+//   - labels: the labels of the metric.
+//   - mType: the type of the metric, `counter` or `gauge`.
+//
+// Returns:
+//   - Metric: the metric with its value and all labels.
+//   - error: errNotFound, storage.ErrAmbiguous or errStorage.
+func (a *AppSevice) findMetric(ctx context.Context, name string, labels storage.Labels, mType string) (Metric, error) {
+	metric := Metric{ID: name, MType: mType}
+
+	var key string
+	var err error
+	if mType == `counter` {
+		var u int64
+		key, u, err = storage.FindCounter(ctx, a.storage, name, labels)
+		metric.Delta = &u
+	} else {
+		var u float64
+		key, u, err = storage.FindGauge(ctx, a.storage, name, labels)
+		metric.Value = &u
+	}
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return Metric{}, errNotFound
+	case errors.Is(err, storage.ErrAmbiguous):
+		return Metric{}, err
+	case err != nil:
+		return Metric{}, fmt.Errorf(`%w: %w`, errStorage, err)
+	}
+
+	_, metric.Labels, err = storage.ParseSeriesKey(key)
+	if err != nil {
+		return Metric{}, fmt.Errorf(`%w: %w`, errStorage, err)
+	}
+
+	return metric, nil
+}
+
+// errorStatus returns status code for error of findMetric and updateMetric.
+//
+// Errors of storage are 503, so clients retry the request later. Other
+// errors are caused by the request.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errStorage):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// queryLabels returns query parameters of the request as labels.
+//
+// Parameters:
+//   - ctx: the gin context.
+//
+// Returns:
+//   - storage.Labels: the labels, nil if query is empty.
+func queryLabels(ctx *gin.Context) storage.Labels {
+	query := ctx.Request.URL.Query()
+	if len(query) == 0 {
+		return nil
+	}
+
+	labels := make(storage.Labels, len(query))
+	for k, v := range query {
+		labels[k] = v[0]
+	}
+
+	return labels
+}
+
 func (a *AppSevice) checkMetricType(mType string, ctx *gin.Context) bool {
 	if mType != `counter` && mType != `gauge` {
 		zap.L().Error(errType.Error())
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/influx"
+)
+
+// InfluxWrite receives lines of InfluxDB line protocol.
+//
+// Name of metric is `<measurement>_<field>`, tags are added to the name as
+// labels. Integer fields which match `-influx-counters` globs are saved as
+// counters, other fields as gauges. Valid lines are written even if other
+// lines are invalid.
+//
+// Returns 204 on success, 400 with errors of invalid lines, e.g.
+// `{"errors":[{"line":2,"error":"fields not found"}]}`, and 413 if body is
+// larger than MaxBodySize.
+//
+// Parameters:
+//   - ctx: the gin context.
+func (a *AppSevice) InfluxWrite(ctx *gin.Context) {
+	if !a.checkStorage(ctx) {
+		return
+	}
+
+	b, ok := a.readBody(ctx)
+	if !ok {
+		return
+	}
+
+	points, errs := influx.ParseLines(b)
+
+	written, _, err := a.ingest.Write(ctx.Request.Context(), influx.Samples(points, a.influxRules))
+	if err != nil {
+		zap.L().Error(`InfluxDB write failed`, zap.Int(`written`, written), zap.Error(err))
+		ctx.String(http.StatusServiceUnavailable, errStorage.Error())
+		return
+	}
+	zap.L().Debug(`InfluxDB lines received`, zap.Int(`points`, len(points)), zap.Int(`written`, written))
+
+	if len(errs) > 0 {
+		zap.L().Error(`Invalid InfluxDB lines`, zap.Int(`count`, len(errs)))
+		ctx.JSON(http.StatusBadRequest, gin.H{`errors`: errs})
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
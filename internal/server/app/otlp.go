@@ -0,0 +1,72 @@
+package app
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// OTLPMetrics receives metrics by OTLP/HTTP.
+//
+// Body is `ExportMetricsServiceRequest` in protobuf (`application/x-protobuf`)
+// or JSON (`application/json`) format. Response has the same format as request.
+//
+// Returns 200 on success or partial success, 400 if body cannot be decoded, 413
+// if body is larger than MaxBodySize and 415 if content type is not supported.
+//
+// Parameters:
+//   - ctx: the gin context.
+func (a *AppSevice) OTLPMetrics(ctx *gin.Context) {
+	if !a.checkStorage(ctx) {
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(ctx.GetHeader(`Content-Type`))
+	if contentType != `application/x-protobuf` && contentType != `application/json` {
+		zap.L().Error(`Unsupported content type of OTLP request`, zap.String(`type`, contentType))
+		ctx.String(http.StatusUnsupportedMediaType, `unsupported content type`)
+		return
+	}
+
+	b, ok := a.readBody(ctx)
+	if !ok {
+		return
+	}
+
+	var req collectorpb.ExportMetricsServiceRequest
+	var err error
+	if contentType == `application/json` {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(b, &req)
+	} else {
+		err = proto.Unmarshal(b, &req)
+	}
+	if err != nil {
+		zap.L().Error(`Cannot decode OTLP request`, zap.Error(err))
+		ctx.String(http.StatusBadRequest, errBody.Error())
+		return
+	}
+
+	resp, err := a.otlp.Export(ctx.Request.Context(), &req)
+	if err != nil {
+		ctx.String(http.StatusServiceUnavailable, errStorage.Error())
+		return
+	}
+
+	if contentType == `application/json` {
+		b, err = protojson.Marshal(resp)
+	} else {
+		b, err = proto.Marshal(resp)
+	}
+	if err != nil {
+		zap.L().Error(`Cannot encode OTLP response`, zap.Error(err))
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.Data(http.StatusOK, contentType, b)
+}
@@ -0,0 +1,283 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+)
+
+// Content types of Prometheus text format and OpenMetrics text format.
+const (
+	prometheusContentType  = `text/plain; version=0.0.4; charset=utf-8`
+	openMetricsContentType = `application/openmetrics-text; version=1.0.0; charset=utf-8`
+)
+
+// GetPrometheusMetrics returns all metrics in Prometheus text format, or in
+// OpenMetrics text format if client prefers it in Accept header.
+//
+// Names are sanitized, e.g. `CPUutilization.0` becomes `CPUutilization_0`.
+// If gauge and counter have the same name after sanitization, only the gauge is returned.
+//
+// Parameters:
+//   - ctx: the gin context.
+func (a *AppSevice) GetPrometheusMetrics(ctx *gin.Context) {
+	if !a.checkStorage(ctx) {
+		return
+	}
+
+	gauge, counter, err := a.storage.GetValues(ctx.Request.Context())
+	if err != nil {
+		zap.L().Error(err.Error())
+		ctx.String(http.StatusServiceUnavailable, errStorage.Error())
+		return
+	}
+
+	openMetrics := acceptsOpenMetrics(ctx.GetHeader(`Accept`))
+
+	var b bytes.Buffer
+	writePrometheus(&b, gauge, counter, openMetrics)
+
+	if openMetrics {
+		ctx.Data(http.StatusOK, openMetricsContentType, b.Bytes())
+		return
+	}
+	ctx.Data(http.StatusOK, prometheusContentType, b.Bytes())
+}
+
+// acceptsOpenMetrics checks that OpenMetrics 1.0.0 is accepted with quality
+// not lower than Prometheus text format, e.g. Prometheus sends
+// `application/openmetrics-text;version=1.0.0;q=0.5,text/plain;version=0.0.4;q=0.3`.
+//
+// Parameters:
+//   - accept: the Accept header.
+//
+// Returns:
+//   - bool: true if OpenMetrics should be returned.
+func acceptsOpenMetrics(accept string) bool {
+	openMetrics, text := 0.0, 0.0
+
+	for _, part := range strings.Split(accept, `,`) {
+		params := strings.Split(part, `;`)
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q, version := 1.0, ``
+		for _, param := range params[1:] {
+			k, v, _ := strings.Cut(param, `=`)
+			switch strings.ToLower(strings.TrimSpace(k)) {
+			case `q`:
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			case `version`:
+				version = strings.TrimSpace(v)
+			}
+		}
+
+		switch mediaType {
+		case `application/openmetrics-text`:
+			if version == `` || version == `1.0.0` {
+				openMetrics = max(openMetrics, q)
+			}
+		case `text/plain`, `text/*`, `*/*`:
+			text = max(text, q)
+		}
+	}
+
+	return openMetrics > 0 && openMetrics >= text
+}
+
+// labelValueReplacer escapes value of label in Prometheus text format.
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheus writes metrics in Prometheus text format sorted by names.
+//
+// Metrics with the same name and different labels are written as one family.
+// In OpenMetrics format samples of counters have `_total` suffix, family name
+// is without it, and output ends with `# EOF`.
+//
+// Parameters:
+//   - b: the buffer for output.
+//   - gauge: the gauge metrics.
+//   - counter: the counter metrics.
+//   - openMetrics: write in OpenMetrics text format.
+func writePrometheus(b *bytes.Buffer, gauge map[string]float64, counter map[string]int64, openMetrics bool) {
+	type family struct {
+		mType  string
+		id     string            // Name of the first metric, for logging of duplicates
+		series map[string]string // Values by labels in Prometheus format
+	}
+
+	families := make(map[string]*family)
+
+	add := func(key, mType, value string) {
+		id, labels, err := storage.ParseSeriesKey(key)
+		if err != nil {
+			id, labels = key, nil
+		}
+
+		// Different labels may have the same name in Prometheus format, e.g. `a.b` and `a_b`
+		promLabels, ok := prometheusLabels(labels)
+		if !ok {
+			zap.L().Warn(`Duplicate name of label in Prometheus format`, zap.String(`id`, key))
+			return
+		}
+
+		name := prometheusName(id)
+		f, ok := families[name]
+		if !ok {
+			f = &family{mType: mType, id: id, series: make(map[string]string)}
+			families[name] = f
+		}
+		if f.mType != mType || f.id != id {
+			zap.L().Warn(`Duplicate name of metric in Prometheus format`, zap.String(`id`, key), zap.String(`other`, f.id))
+			return
+		}
+		if _, ok := f.series[promLabels]; ok {
+			zap.L().Warn(`Duplicate labels of metric in Prometheus format`, zap.String(`id`, key))
+			return
+		}
+
+		f.series[promLabels] = value
+	}
+
+	// Keys are sorted before adding, so result doesn't depend on map order.
+	// Gauges are added first, so they win over counters with the same name.
+	gaugeKeys := make([]string, 0, len(gauge))
+	for key := range gauge {
+		gaugeKeys = append(gaugeKeys, key)
+	}
+	sort.Strings(gaugeKeys)
+
+	counterKeys := make([]string, 0, len(counter))
+	for key := range counter {
+		counterKeys = append(counterKeys, key)
+	}
+	sort.Strings(counterKeys)
+
+	for _, key := range gaugeKeys {
+		add(key, `gauge`, strconv.FormatFloat(gauge[key], 'g', -1, 64))
+	}
+	for _, key := range counterKeys {
+		add(key, `counter`, strconv.FormatInt(counter[key], 10))
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := families[name]
+
+		family, sample := name, name
+		if openMetrics && f.mType == `counter` {
+			family = strings.TrimSuffix(name, `_total`)
+			sample = family + `_total`
+		}
+
+		b.WriteString(`# TYPE `)
+		b.WriteString(family)
+		b.WriteByte(' ')
+		b.WriteString(f.mType)
+		b.WriteByte('\n')
+
+		series := make([]string, 0, len(f.series))
+		for labels := range f.series {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+
+		for _, labels := range series {
+			b.WriteString(sample)
+			b.WriteString(labels)
+			b.WriteByte(' ')
+			b.WriteString(f.series[labels])
+			b.WriteByte('\n')
+		}
+	}
+
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+}
+
+// prometheusLabels formats labels in Prometheus text format sorted by names, e.g. `{cpu="0",host="a"}`.
+//
+// Parameters:
+//   - labels: the labels.
+//
+// Returns:
+//   - string: the labels in braces, empty if there are no labels.
+//   - bool: false if several labels have the same name in Prometheus format.
+func prometheusLabels(labels storage.Labels) (string, bool) {
+	if len(labels) == 0 {
+		return ``, true
+	}
+
+	names := make([]string, 0, len(labels))
+	values := make(map[string]string, len(labels))
+	for k, v := range labels {
+		name := strings.ReplaceAll(prometheusName(k), `:`, `_`)
+		if _, ok := values[name]; ok {
+			return ``, false
+		}
+		names = append(names, name)
+		values[name] = v
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueReplacer.Replace(values[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String(), true
+}
+
+// prometheusName converts name of metric into valid name of Prometheus metric.
+//
+// Invalid characters are replaced with `_`, and `_` is added before first digit.
+//
+// Parameters:
+//   - id: the name of metric.
+//
+// Returns:
+//   - string: the valid name.
+func prometheusName(id string) string {
+	if id == `` {
+		return `_`
+	}
+
+	b := make([]byte, 0, len(id)+1)
+	if id[0] >= '0' && id[0] <= '9' {
+		b = append(b, '_')
+	}
+
+	for i := 0; i < len(id); i++ {
+		ch := id[i]
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9', ch == '_', ch == ':':
+			b = append(b, ch)
+		default:
+			b = append(b, '_')
+		}
+	}
+
+	return string(b)
+}
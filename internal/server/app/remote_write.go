@@ -0,0 +1,158 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Jourloy/go-metrics-collector/internal/proto/prompb"
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+)
+
+// remoteWriteTypes remembers types of metrics from metadata, Prometheus sends it in separate requests.
+type remoteWriteTypes struct {
+	sync.RWMutex
+	types map[string]prompb.MetricMetadata_MetricType
+}
+
+// counterSuffixes are suffixes of cumulative series when metadata is unknown.
+var counterSuffixes = []string{`_total`, `_count`, `_sum`, `_bucket`}
+
+// RemoteWrite receives samples from Prometheus remote write.
+//
+// Body is a snappy compressed protobuf `WriteRequest`. Labels are added to
+// names of metrics, e.g. `up{instance="localhost:9090",job="prometheus"}`.
+// Counters, histograms and summaries are saved as counters, other metrics as
+// gauges. If metadata is not sent, series with `_total`, `_count`, `_sum` and
+// `_bucket` suffixes are counters.
+//
+// Returns 204 on success, 400 if request cannot be decoded and 413 if
+// compressed or decompressed body is larger than MaxBodySize.
+//
+// Parameters:
+//   - ctx: the gin context.
+func (a *AppSevice) RemoteWrite(ctx *gin.Context) {
+	if !a.checkStorage(ctx) {
+		return
+	}
+
+	compressed, ok := a.readBody(ctx)
+	if !ok {
+		return
+	}
+
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		zap.L().Error(`Invalid remote write body`, zap.Error(err))
+		ctx.String(http.StatusBadRequest, errBody.Error())
+		return
+	}
+
+	if int64(n) > a.maxBody {
+		zap.L().Error(errTooLarge.Error(), zap.Int(`size`, n), zap.Int64(`limit`, a.maxBody))
+		ctx.String(http.StatusRequestEntityTooLarge, errTooLarge.Error())
+		return
+	}
+
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		zap.L().Error(`Cannot decompress remote write body`, zap.Error(err))
+		ctx.String(http.StatusBadRequest, errBody.Error())
+		return
+	}
+
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		zap.L().Error(`Cannot decode remote write body`, zap.Error(err))
+		ctx.String(http.StatusBadRequest, errBody.Error())
+		return
+	}
+
+	a.remoteTypes.Lock()
+	for _, m := range req.Metadata {
+		a.remoteTypes.types[m.MetricFamilyName] = m.Type
+	}
+	a.remoteTypes.Unlock()
+
+	samples := make([]ingest.Sample, 0, len(req.Timeseries))
+
+	a.remoteTypes.RLock()
+	for _, ts := range req.Timeseries {
+		name := ``
+		labels := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			if l.Name == `__name__` {
+				name = l.Value
+				continue
+			}
+			labels[l.Name] = l.Value
+		}
+
+		counter := a.isRemoteCounter(name)
+		for _, s := range ts.Samples {
+			samples = append(samples, ingest.Sample{
+				Name:    name,
+				Labels:  labels,
+				Value:   s.Value,
+				Counter: counter,
+			})
+		}
+	}
+	a.remoteTypes.RUnlock()
+
+	written, errs, err := a.ingest.Write(ctx.Request.Context(), samples)
+	if err != nil {
+		// Prometheus retries requests with 5xx status
+		zap.L().Error(`Remote write failed`, zap.Int(`written`, written), zap.Error(err))
+		ctx.String(http.StatusServiceUnavailable, errStorage.Error())
+		return
+	}
+	if len(errs) > 0 {
+		// Prometheus sends NaN as stale marker, so skipped samples are not an error
+		zap.L().Debug(`Remote write samples skipped`, zap.Int(`count`, len(errs)), zap.Error(errs[0]))
+	}
+	zap.L().Debug(`Remote write received`, zap.Int(`written`, written))
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// isRemoteCounter checks if series of remote write is cumulative.
+//
+// Read lock of remoteTypes must be held.
+//
+// Parameters:
+//   - name: the name of series.
+//
+// Returns:
+//   - bool: true if series is a counter.
+func (a *AppSevice) isRemoteCounter(name string) bool {
+	family := name
+	for _, suffix := range counterSuffixes {
+		if f, ok := strings.CutSuffix(name, suffix); ok {
+			family = f
+			break
+		}
+	}
+
+	// Metadata contains name of family, counters may be named with or without suffix
+	for _, n := range []string{name, family} {
+		switch a.remoteTypes.types[n] {
+		case prompb.MetricMetadata_COUNTER:
+			return true
+		case prompb.MetricMetadata_HISTOGRAM, prompb.MetricMetadata_SUMMARY:
+			// Quantiles of summary are gauges
+			return family != name
+		case prompb.MetricMetadata_UNKNOWN:
+			continue
+		default:
+			return false
+		}
+	}
+
+	return family != name
+}
@@ -0,0 +1,213 @@
+package app
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+)
+
+const (
+	seriesRange     = time.Hour // Range of series if `from` is not set
+	seriesMaxPoints = 11000     // Max count of steps in one request
+)
+
+var errRange = errors.New(`from must be before to`)
+var errStep = errors.New(`step is too small for range`)
+
+// seriesParams are reserved query parameters of series request, other parameters are labels.
+var seriesParams = map[string]bool{`name`: true, `type`: true, `from`: true, `to`: true, `step`: true, `agg`: true}
+
+// Series is a response of series request.
+type Series struct {
+	ID     string          `json:"id"`               // Name of metric
+	MType  string          `json:"type"`             // Gauge or Counter
+	Labels storage.Labels  `json:"labels,omitempty"` // Labels of found metric
+	Step   string          `json:"step,omitempty"`   // Duration of step, empty for raw values
+	Agg    string          `json:"agg"`              // Aggregation of values in step
+	Points []storage.Point `json:"points"`           // Values sorted by time
+}
+
+// GetSeries returns history of metric.
+//
+// Query parameters:
+//   - name: the name of metric, required.
+//   - type: `gauge` (default) or `counter`, counters are cumulative values.
+//   - from, to: RFC 3339 time or Unix seconds, default is the last hour.
+//     From is rounded down to step.
+//   - step: duration (`30s`) or seconds, one value of each step is returned.
+//     Raw values are returned if step is not set.
+//   - agg: aggregation of values in step, `last` (default), `min`, `max`,
+//     `avg` or `sum` (counters only, the sum of increments).
+//
+// Values are read from the coarsest rollup of history which satisfies step,
+// e.g. hourly rollups for `2h` step and minute rollups for `5m` step.
+//
+// Other parameters are labels, metric is found the same way as by `/value`.
+//
+// Parameters:
+//   - ctx: the gin context.
+func (a *AppSevice) GetSeries(ctx *gin.Context) {
+	if !a.checkStorage(ctx) {
+		return
+	}
+
+	name := ctx.Query(`name`)
+	if name == `` {
+		zap.L().Error(errName.Error())
+		ctx.String(http.StatusBadRequest, errName.Error())
+		return
+	}
+
+	mType := ctx.DefaultQuery(`type`, `gauge`)
+	if !a.checkMetricType(mType, ctx) {
+		return
+	}
+
+	from, to, step, err := parseSeriesRange(ctx, time.Now())
+	if err != nil {
+		zap.L().Error(err.Error())
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	agg := ctx.DefaultQuery(`agg`, storage.AggLast)
+	if err := storage.CheckAggregation(agg, mType == `counter`); err != nil {
+		zap.L().Error(err.Error())
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	labels := make(storage.Labels)
+	for k, v := range ctx.Request.URL.Query() {
+		if !seriesParams[k] {
+			labels[k] = v[0]
+		}
+	}
+
+	metric, err := a.findMetric(ctx.Request.Context(), name, labels, mType)
+	if err != nil {
+		zap.L().Error(err.Error())
+		ctx.String(errorStatus(err), err.Error())
+		return
+	}
+
+	key := storage.SeriesKey(metric.ID, metric.Labels)
+
+	var buckets []storage.Bucket
+	if mType == `counter` {
+		buckets, err = a.storage.GetCounterHistory(ctx.Request.Context(), key, from, to, step)
+	} else {
+		buckets, err = a.storage.GetGaugeHistory(ctx.Request.Context(), key, from, to, step)
+	}
+	if err != nil {
+		zap.L().Error(err.Error())
+		ctx.String(http.StatusServiceUnavailable, errStorage.Error())
+		return
+	}
+
+	series := Series{
+		ID:     metric.ID,
+		MType:  mType,
+		Labels: metric.Labels,
+		Agg:    agg,
+		Points: make([]storage.Point, 0, len(buckets)),
+	}
+	for _, b := range storage.Rollup(buckets, step) {
+		series.Points = append(series.Points, storage.Point{Time: b.Time, Value: b.Value(agg)})
+	}
+	if step > 0 {
+		series.Step = step.String()
+	}
+
+	ctx.JSON(http.StatusOK, series)
+}
+
+// parseSeriesRange parses `from`, `to` and `step` query parameters.
+//
+// Parameters:
+//   - ctx: the gin context.
+//   - now: the current time, default of `to`.
+//
+// Returns:
+//   - time.Time: the start of range, rounded down to step.
+//   - time.Time: the end of range.
+//   - time.Duration: the step, 0 if not set.
+//   - error: error if parameters are invalid.
+func parseSeriesRange(ctx *gin.Context, now time.Time) (time.Time, time.Time, time.Duration, error) {
+	to := now
+	if v := ctx.Query(`to`); v != `` {
+		t, err := parseSeriesTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, err
+		}
+		to = t
+	}
+
+	from := to.Add(-seriesRange)
+	if v := ctx.Query(`from`); v != `` {
+		t, err := parseSeriesTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, err
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, 0, errRange
+	}
+
+	var step time.Duration
+	if v := ctx.Query(`step`); v != `` {
+		d, err := parseSeriesStep(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, err
+		}
+		if to.Sub(from)/d > seriesMaxPoints {
+			return time.Time{}, time.Time{}, 0, errStep
+		}
+		step = d
+		from = from.Truncate(step)
+	}
+
+	return from, to, step, nil
+}
+
+// parseSeriesTime parses RFC 3339 time or Unix seconds with fraction.
+func parseSeriesTime(v string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, errors.New(`invalid time ` + strconv.Quote(v))
+	}
+
+	return t, nil
+}
+
+// parseSeriesStep parses duration or seconds.
+func parseSeriesStep(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		f, ferr := strconv.ParseFloat(v, 64)
+		if ferr != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, errors.New(`invalid step ` + strconv.Quote(v))
+		}
+		d = time.Duration(f * float64(time.Second))
+	}
+
+	if d <= 0 {
+		return 0, errors.New(`step must be positive`)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,314 @@
+// Package graphite receive metrics by Graphite plaintext protocol
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+)
+
+var Address = flag.String(`graphite`, ``, `Address of TCP listener of Graphite plaintext protocol. Empty - disabled`)
+
+const (
+	maxLine     = 64 << 10        // Max length of line
+	maxBatch    = 1000            // Max count of lines saved in one batch
+	idleTimeout = 5 * time.Minute // Connection is closed if nothing is received
+	drainTime   = time.Second     // Time to read lines which are already sent on shutdown
+)
+
+// maxConns is a max count of open connections, other connections are closed.
+var maxConns = 1000
+
+var (
+	errFormat = errors.New(`expected "path value [timestamp]"`)
+	errPath   = errors.New(`invalid path`)
+	errValue  = errors.New(`invalid value`)
+	errTime   = errors.New(`invalid timestamp`)
+	errLong   = errors.New(`line is too long`)
+)
+
+// ParseEnv overrides flag by GRAPHITE_ADDRESS environment variable.
+func ParseEnv() {
+	if env, exist := os.LookupEnv(`GRAPHITE_ADDRESS`); exist {
+		Address = &env
+	}
+}
+
+// Server receives lines `path value [timestamp]` by TCP and saves each path as gauge.
+type Server struct {
+	listener net.Listener
+	writer   *ingest.Writer
+	subnet   *net.IPNet
+	sem      chan struct{} // Slots of open connections
+
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// Listen starts accepting connections in background.
+//
+// Connections from addresses outside the trusted subnet and connections over
+// maxConns are closed.
+//
+// Parameters:
+//   - address: the address of listener, e.g. `:2003`.
+//   - w: the writer of samples.
+//   - subnet: the trusted subnet. If nil, connections from all addresses are accepted.
+//
+// Returns:
+//   - *Server: the server.
+//   - error: error if address cannot be listened.
+func Listen(address string, w *ingest.Writer, subnet *net.IPNet) (*Server, error) {
+	ln, err := net.Listen(`tcp`, address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: ln,
+		writer:   w,
+		subnet:   subnet,
+		sem:      make(chan struct{}, maxConns),
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+
+	zap.L().Info(`Graphite listener started`, zap.String(`address`, ln.Addr().String()))
+
+	return s, nil
+}
+
+// Addr returns address of listener.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Shutdown stops accepting connections and waits until open connections are handled.
+//
+// Open connections are read for drainTime, so lines which are already sent
+// are saved. If ctx is done before all connections are handled, they are closed.
+//
+// Parameters:
+//   - ctx: the context with deadline of shutdown.
+//
+// Returns:
+//   - error: ctx error if connections are closed by deadline.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.listener.Close()
+
+	// Lines which are already sent are read before connection is closed
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now().Add(drainTime))
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// accept accepts connections until listener is closed.
+func (s *Server) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			zap.L().Warn(`Cannot accept Graphite connection`, zap.Error(err))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		if !s.trusted(conn.RemoteAddr()) {
+			zap.L().Warn(`Graphite connection from untrusted address closed`, zap.Stringer(`address`, conn.RemoteAddr()))
+			conn.Close()
+			continue
+		}
+
+		select {
+		case s.sem <- struct{}{}:
+		default:
+			zap.L().Warn(`Too many Graphite connections`, zap.Int(`limit`, maxConns))
+			conn.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			<-s.sem
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+// trusted checks that address of connection is in the trusted subnet.
+func (s *Server) trusted(addr net.Addr) bool {
+	if s.subnet == nil {
+		return true
+	}
+
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && s.subnet.Contains(tcp.IP)
+}
+
+// handle reads lines of connection until it is closed or idle.
+//
+// Lines which are received together are saved as one batch, batch is written
+// when there are no more complete lines in buffer or it has maxBatch lines.
+// Invalid lines are logged and skipped. Connection is closed if line is
+// longer than maxLine.
+//
+// Parameters:
+//   - conn: the connection.
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		<-s.sem
+	}()
+
+	reader := bufio.NewReaderSize(conn, maxLine)
+	batch := make([]ingest.Sample, 0, maxBatch)
+
+	for {
+		s.mu.Lock()
+		if !s.closed {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		s.mu.Unlock()
+
+		// Line without newline is returned with error when connection is closed
+		b, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			err = errLong
+		} else if line := strings.TrimSpace(string(b)); line != `` {
+			sample, parseErr := Parse(line)
+			if parseErr != nil {
+				zap.L().Debug(`Invalid Graphite line`, zap.String(`line`, line), zap.Error(parseErr))
+			} else {
+				batch = append(batch, sample)
+			}
+		}
+
+		if len(batch) > 0 && (err != nil || len(batch) == maxBatch || !hasLine(reader)) {
+			if _, _, err := s.writer.Write(context.Background(), batch); err != nil {
+				zap.L().Error(`Cannot write Graphite lines`, zap.Int(`lines`, len(batch)), zap.Error(err))
+			}
+			batch = batch[:0]
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				zap.L().Warn(`Graphite connection closed`, zap.String(`remote`, conn.RemoteAddr().String()), zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// hasLine checks that reader has complete line in buffer, so it can be read
+// without waiting for connection.
+func hasLine(r *bufio.Reader) bool {
+	b, _ := r.Peek(r.Buffered())
+	return bytes.IndexByte(b, '\n') >= 0
+}
+
+// Parse parses line `path value [timestamp]`.
+//
+// Tags of path are labels, e.g. `cpu.load;host=a value`. Timestamp is checked
+// but not saved, storage keeps only the last value.
+//
+// Parameters:
+//   - line: the line.
+//
+// Returns:
+//   - ingest.Sample: the gauge sample.
+//   - error: error if line is invalid.
+func Parse(line string) (ingest.Sample, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return ingest.Sample{}, errFormat
+	}
+
+	path, tags, _ := strings.Cut(fields[0], `;`)
+	if path == `` {
+		return ingest.Sample{}, errPath
+	}
+
+	sample := ingest.Sample{Name: path}
+
+	if tags != `` {
+		sample.Labels = make(map[string]string)
+		for _, tag := range strings.Split(tags, `;`) {
+			k, v, ok := strings.Cut(tag, `=`)
+			if !ok || k == `` || v == `` {
+				return ingest.Sample{}, fmt.Errorf(`%w: tag %q`, errPath, tag)
+			}
+			sample.Labels[k] = v
+		}
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return ingest.Sample{}, errValue
+	}
+	sample.Value = value
+
+	// Graphite uses -1 for current time
+	if len(fields) == 3 {
+		if _, err := strconv.ParseFloat(fields[2], 64); err != nil {
+			return ingest.Sample{}, errTime
+		}
+	}
+
+	return sample, nil
+}
@@ -0,0 +1,211 @@
+package graphite
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository/memory"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    ingest.Sample
+		wantErr error
+	}{
+		{line: `servers.a.load 0.5 1700000000`, want: ingest.Sample{Name: `servers.a.load`, Value: 0.5}},
+		{line: `servers.a.load 2`, want: ingest.Sample{Name: `servers.a.load`, Value: 2}},
+		{line: `servers.a.load 2 -1`, want: ingest.Sample{Name: `servers.a.load`, Value: 2}},
+		{
+			line: `load;host=a;dc=eu 1 1700000000`,
+			want: ingest.Sample{Name: `load`, Labels: map[string]string{`host`: `a`, `dc`: `eu`}, Value: 1},
+		},
+		{line: `servers.a.load`, wantErr: errFormat},
+		{line: `servers.a.load 1 2 3`, wantErr: errFormat},
+		{line: `;host=a 1`, wantErr: errPath},
+		{line: `load;host 1`, wantErr: errPath},
+		{line: `servers.a.load high`, wantErr: errValue},
+		{line: `servers.a.load NaN`, wantErr: errValue},
+		{line: `servers.a.load 1 now`, wantErr: errTime},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := Parse(tt.line)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+	st := memory.CreateRepository(memory.Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+	})
+
+	s, err := Listen(`127.0.0.1:0`, ingest.NewWriter(st), nil)
+	require.NoError(t, err)
+
+	first, err := net.Dial(`tcp`, s.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+
+	second, err := net.Dial(`tcp`, s.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+
+	// Line is split between writes, malformed lines are skipped
+	_, err = first.Write([]byte("malformed\nservers.a.lo"))
+	require.NoError(t, err)
+	_, err = second.Write([]byte("servers.b.load 2\n"))
+	require.NoError(t, err)
+	_, err = first.Write([]byte("ad 1.5 -1\nservers.a.mem 10"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		a, errA := st.GetGaugeValue(context.Background(), `servers.a.load`)
+		b, errB := st.GetGaugeValue(context.Background(), `servers.b.load`)
+		return errA == nil && errB == nil && a == 1.5 && b == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// Line without newline is saved when connection is closed
+	first.Close()
+	assert.Eventually(t, func() bool {
+		v, err := st.GetGaugeValue(context.Background(), `servers.a.mem`)
+		return err == nil && v == 10
+	}, time.Second, 10*time.Millisecond)
+
+	// Line sent before shutdown is saved
+	_, err = second.Write([]byte("servers.b.mem 20\n"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+
+	v, err := st.GetGaugeValue(context.Background(), `servers.b.mem`)
+	assert.NoError(t, err)
+	assert.Equal(t, 20.0, v)
+
+	_, err = net.Dial(`tcp`, s.Addr().String())
+	assert.Error(t, err)
+}
+
+// countingStorage counts updates of batches.
+type countingStorage struct {
+	*memory.MemStorage
+	batches atomic.Int32
+}
+
+func (s *countingStorage) UpdateBatch(ctx context.Context, metrics []storage.Metric) ([]storage.Metric, error) {
+	s.batches.Add(1)
+	return s.MemStorage.UpdateBatch(ctx, metrics)
+}
+
+func TestServerBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+	st := &countingStorage{MemStorage: memory.CreateRepository(memory.Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+	})}
+
+	s, err := Listen(`127.0.0.1:0`, ingest.NewWriter(st), nil)
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial(`tcp`, s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Lines of one write are saved together, not one by one
+	var lines strings.Builder
+	for _, name := range []string{`a`, `b`, `c`, `d`} {
+		lines.WriteString(`servers.` + name + ".load 1\n")
+	}
+	_, err = conn.Write([]byte(lines.String()))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, err := st.GetGaugeValue(context.Background(), `servers.d.load`)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	values, _, err := st.GetValues(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, values, 4)
+	assert.Less(t, st.batches.Load(), int32(4))
+}
+
+func TestServerLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+	st := memory.CreateRepository(memory.Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+	})
+
+	conns := maxConns
+	maxConns = 1
+	t.Cleanup(func() { maxConns = conns })
+
+	_, subnet, err := net.ParseCIDR(`10.0.0.0/8`)
+	require.NoError(t, err)
+
+	// Connection from outside the trusted subnet is closed
+	s, err := Listen(`127.0.0.1:0`, ingest.NewWriter(st), subnet)
+	require.NoError(t, err)
+
+	conn, err := net.Dial(`tcp`, s.Addr().String())
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	conn.Close()
+	require.NoError(t, s.Shutdown(context.Background()))
+
+	// Connection over the limit is closed
+	s, err = Listen(`127.0.0.1:0`, ingest.NewWriter(st), nil)
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+
+	first, err := net.Dial(`tcp`, s.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+
+	second, err := net.Dial(`tcp`, s.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// The first connection works
+	_, err = first.Write([]byte("servers.a.load 1\n"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := st.GetGaugeValue(context.Background(), `servers.a.load`)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
@@ -3,16 +3,28 @@ package handlers
 
 import (
 	"github.com/Jourloy/go-metrics-collector/internal/server/app"
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
 	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
 	"github.com/gin-gonic/gin"
 )
 
-// RegisterAppHandler the app handler in the specified gin.Engine and uses the provided storage.
-func RegisterAppHandler(g *gin.RouterGroup, s storage.Storage) {
-	appService := app.GetAppSevice(s)
+// UnsignedPaths are receivers of external protocols. Their clients can't sign
+// requests by key of the agent, so they are not checked by HashDecode if
+// unsigned receivers are enabled.
+var UnsignedPaths = []string{`/api/v1/write`, `/write`, `/v1/metrics`}
+
+// RegisterAppHandler the app handler in the specified gin.Engine and uses the provided storage
+// and writer of samples of external protocols.
+func RegisterAppHandler(g *gin.RouterGroup, s storage.Storage, w *ingest.Writer) {
+	appService := app.GetAppSevice(s, w)
 
 	g.GET(`/ping`, appService.Pong)
 	g.GET(`/`, appService.GetAllMetrics)
+	g.GET(`/metrics`, appService.GetPrometheusMetrics)
+	g.POST(`/api/v1/write`, appService.RemoteWrite)
+	g.POST(`/write`, appService.InfluxWrite)
+	g.POST(`/v1/metrics`, appService.OTLPMetrics)
+	g.GET(`/api/v1/series`, appService.GetSeries)
 
 	// Below code looks ugly, but it is needed to make the handler work.
 	//
@@ -34,4 +46,5 @@ func RegisterAppHandler(g *gin.RouterGroup, s storage.Storage) {
 	g.POST(`/update/:type/:name/:value`, appService.UpdateMetricByParams)
 
 	g.POST(`/updates`, appService.UpdateManyMetrics)
+	g.POST(`/updates/`, appService.UpdateManyMetrics) // Autotests need this, because they don't support autoredirects
 }
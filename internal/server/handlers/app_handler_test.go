@@ -1,15 +1,31 @@
 package handlers
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/Jourloy/go-metrics-collector/internal/proto/prompb"
+	"github.com/Jourloy/go-metrics-collector/internal/server/app"
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+	"github.com/Jourloy/go-metrics-collector/internal/server/middlewares"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
 	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository"
 	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
 	"github.com/stretchr/testify/assert"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 type Metric struct {
@@ -164,7 +180,7 @@ func TestAppBodyHandlers(t *testing.T) {
 			g := r.Group(`/`)
 			s, _ := repository.CreateRepository()
 
-			RegisterAppHandler(g, s)
+			RegisterAppHandler(g, s, ingest.NewWriter(s))
 
 			b, _ := json.Marshal(tt.args.body)
 			req := httptest.NewRequest(tt.args.method, tt.args.path, strings.NewReader(string(b)))
@@ -261,7 +277,7 @@ func TestAppParamsHandlers(t *testing.T) {
 			g := r.Group(`/`)
 			s, _ := repository.CreateRepository()
 
-			RegisterAppHandler(g, s)
+			RegisterAppHandler(g, s, ingest.NewWriter(s))
 
 			req := httptest.NewRequest(tt.args.method, tt.args.path, nil)
 			rec := httptest.NewRecorder()
@@ -276,3 +292,639 @@ func TestAppParamsHandlers(t *testing.T) {
 		})
 	}
 }
+
+// TestAppBatchHandler tests batch update of metrics.
+func TestAppBatchHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantCode    int
+		wantErrBody string
+	}{
+		{
+			name:        `Negative #1 (Batch with invalid body)`,
+			body:        `{`,
+			wantCode:    400,
+			wantErrBody: `body not found`,
+		},
+		{
+			name:        `Negative #2 (Batch with invalid metric)`,
+			body:        `[{"id":"batch","type":"counter","delta":1},{"id":"batch","type":"gauge"}]`,
+			wantCode:    400,
+			wantErrBody: `{"errors":[{"index":1,"id":"batch","error":"gauge value not found"}]}`,
+		},
+		{
+			name:        `Positive #1 (Batch success)`,
+			body:        `[{"id":"batch","type":"counter","delta":1},{"id":"batch","type":"gauge","value":1.5}]`,
+			wantCode:    200,
+			wantErrBody: `[{"id":"batch","type":"counter","delta":1},{"id":"batch","type":"gauge","value":1.5}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.Default()
+			g := r.Group(`/`)
+			s, _ := repository.CreateRepository()
+
+			RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+			req := httptest.NewRequest(http.MethodPost, `/updates/`, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+
+			r.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantCode, rec.Code)
+			assert.Equal(t, tt.wantErrBody, strings.TrimSuffix(rec.Body.String(), "\n"))
+		})
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	r := gin.Default()
+	r.Use(middlewares.GzipDecode(*app.MaxBodySize))
+	g := r.Group(`/`)
+	s, _ := repository.CreateRepository()
+
+	RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+	s.UpdateGaugeMetric(context.Background(), `Alloc`, 1.5)
+	s.UpdateGaugeMetric(context.Background(), `CPUutilization.0`, 20)
+	s.UpdateGaugeMetric(context.Background(), `1min`, 3)
+	s.UpdateCounterMetric(context.Background(), `PollCount`, 5)
+	s.UpdateCounterMetric(context.Background(), `Alloc`, 1)
+	s.UpdateGaugeMetric(context.Background(), `CPUutilization{host="a"}`, 25)
+	s.UpdateGaugeMetric(context.Background(), `CPUutilization{cpu="1",host="a"}`, 30)
+	s.UpdateGaugeMetric(context.Background(), `Load1{host="a\"b\nc",service.name="api"}`, 2)
+	s.UpdateGaugeMetric(context.Background(), `Load5{a.b="x",a_b="y"}`, 4)
+	s.UpdateGaugeMetric(context.Background(), `Load15{a.b="x"}`, 5)
+	s.UpdateGaugeMetric(context.Background(), `Load15{a_b="x"}`, 6)
+
+	want := "# TYPE Alloc gauge\nAlloc 1.5\n" +
+		"# TYPE CPUutilization gauge\nCPUutilization{cpu=\"1\",host=\"a\"} 30\nCPUutilization{host=\"a\"} 25\n" +
+		"# TYPE CPUutilization_0 gauge\nCPUutilization_0 20\n" +
+		"# TYPE Load1 gauge\nLoad1{host=\"a\\\"b\\nc\",service_name=\"api\"} 2\n" +
+		"# TYPE Load15 gauge\nLoad15{a_b=\"x\"} 5\n" +
+		"# TYPE PollCount counter\nPollCount 5\n" +
+		"# TYPE _1min gauge\n_1min 3\n"
+
+	req := httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `text/plain; version=0.0.4; charset=utf-8`, rec.Header().Get(`Content-Type`))
+	assert.Empty(t, rec.Header().Get(`Content-Encoding`))
+	assert.Equal(t, want, rec.Body.String())
+
+	// Prometheus sends list of encodings
+	req = httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+	req.Header.Set(`Accept-Encoding`, `gzip, deflate;q=0.5`)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `gzip`, rec.Header().Get(`Content-Encoding`))
+
+	gz, err := gzip.NewReader(rec.Body)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, want, string(b))
+
+	req = httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+	req.Header.Set(`Accept-Encoding`, `gzip;q=0, identity`)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Empty(t, rec.Header().Get(`Content-Encoding`))
+	assert.Equal(t, want, rec.Body.String())
+
+	// Prometheus prefers OpenMetrics
+	req = httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+	req.Header.Set(`Accept`, `application/openmetrics-text;version=1.0.0;q=0.5,application/openmetrics-text;version=0.0.1;q=0.4,text/plain;version=0.0.4;q=0.3,*/*;q=0.2`)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `application/openmetrics-text; version=1.0.0; charset=utf-8`, rec.Header().Get(`Content-Type`))
+	assert.Equal(t, strings.Replace(want, "# TYPE PollCount counter\nPollCount 5\n", "# TYPE PollCount counter\nPollCount_total 5\n", 1)+"# EOF\n", rec.Body.String())
+
+	// Text format is preferred, or OpenMetrics of unsupported version is requested
+	for _, accept := range []string{
+		`text/plain;version=0.0.4,application/openmetrics-text;q=0.5`,
+		`application/openmetrics-text;version=2.0.0`,
+		`application/openmetrics-text;q=0`,
+	} {
+		req = httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+		req.Header.Set(`Accept`, accept)
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		assert.Equal(t, `text/plain; version=0.0.4; charset=utf-8`, rec.Header().Get(`Content-Type`), accept)
+		assert.Equal(t, want, rec.Body.String(), accept)
+	}
+}
+
+func TestRemoteWriteHandler(t *testing.T) {
+	r := gin.Default()
+	g := r.Group(`/`)
+	s, _ := repository.CreateRepository()
+
+	RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+	send := func(req *prompb.WriteRequest) *httptest.ResponseRecorder {
+		b, err := proto.Marshal(req)
+		assert.NoError(t, err)
+
+		httpReq := httptest.NewRequest(http.MethodPost, `/api/v1/write`, bytes.NewReader(snappy.Encode(nil, b)))
+		httpReq.Header.Set(`Content-Encoding`, `snappy`)
+		httpReq.Header.Set(`Content-Type`, `application/x-protobuf`)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httpReq)
+		return rec
+	}
+
+	series := func(name string, value float64) *prompb.TimeSeries {
+		return &prompb.TimeSeries{
+			Labels: []*prompb.Label{
+				{Name: `__name__`, Value: name},
+				{Name: `job`, Value: `node`},
+			},
+			Samples: []*prompb.Sample{{Value: value, Timestamp: 1}},
+		}
+	}
+
+	rec := send(&prompb.WriteRequest{
+		Metadata: []*prompb.MetricMetadata{
+			{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: `node_boots`},
+		},
+	})
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = send(&prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{
+			series(`node_load1`, 0.5),
+			series(`node_requests_total`, 10),
+			series(`node_boots`, 3),
+		},
+	})
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	g1, err := s.GetGaugeValue(context.Background(), `node_load1{job="node"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.5, g1)
+
+	c1, err := s.GetCounterValue(context.Background(), `node_requests_total{job="node"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), c1)
+
+	c2, err := s.GetCounterValue(context.Background(), `node_boots{job="node"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), c2)
+
+	// Invalid body
+	httpReq := httptest.NewRequest(http.MethodPost, `/api/v1/write`, strings.NewReader(`not snappy`))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httpReq)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestRemoteWriteTooLarge(t *testing.T) {
+	limit := *app.MaxBodySize
+	*app.MaxBodySize = 1024
+	t.Cleanup(func() { *app.MaxBodySize = limit })
+
+	r := gin.Default()
+	g := r.Group(`/`)
+	s, _ := repository.CreateRepository()
+
+	RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+	send := func(body []byte) int {
+		req := httptest.NewRequest(http.MethodPost, `/api/v1/write`, bytes.NewReader(body))
+		req.Header.Set(`Content-Encoding`, `snappy`)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Compressed body is too large
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(make([]byte, 2048)))
+
+	// Small body is decompressed into too large request
+	compressed := snappy.Encode(nil, make([]byte, 16<<10))
+	assert.Less(t, len(compressed), 1024)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(compressed))
+}
+
+func TestInfluxWriteHandler(t *testing.T) {
+	r := gin.Default()
+	g := r.Group(`/`)
+	s, _ := repository.CreateRepository()
+
+	RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+	body := "cpu,host=a usage_idle=90.5 1700000000000000000\ncpu,host=a\nmem,host=a used=7i\n"
+	req := httptest.NewRequest(http.MethodPost, `/write`, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, `{"errors":[{"line":2,"error":"fields not found"}]}`, rec.Body.String())
+
+	// Valid lines are written
+	v, err := s.GetGaugeValue(context.Background(), `cpu_usage_idle{host="a"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 90.5, v)
+
+	v, err = s.GetGaugeValue(context.Background(), `mem_used{host="a"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 7.0, v)
+
+	req = httptest.NewRequest(http.MethodPost, `/write`, strings.NewReader(`cpu,host=a usage_idle=80`))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+func TestInfluxWriteTooLarge(t *testing.T) {
+	limit := *app.MaxBodySize
+	*app.MaxBodySize = 32
+	t.Cleanup(func() { *app.MaxBodySize = limit })
+
+	r := gin.Default()
+	g := r.Group(`/`)
+	s, _ := repository.CreateRepository()
+
+	RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+	body := strings.Repeat("cpu,host=a usage_idle=80\n", 2)
+	req := httptest.NewRequest(http.MethodPost, `/write`, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// Nothing is written from rejected body
+	_, err := s.GetGaugeValue(context.Background(), `cpu_usage_idle{host="a"}`)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestOTLPHandler(t *testing.T) {
+	r := gin.Default()
+	g := r.Group(`/`)
+	s, _ := repository.CreateRepository()
+
+	RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+	b, _ := proto.Marshal(&collectorpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Metrics: []*metricspb.Metric{{
+					Name: `otlp_queue`,
+					Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+						DataPoints: []*metricspb.NumberDataPoint{{Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 3.5}}},
+					}},
+				}},
+			}},
+		}},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, `/v1/metrics`, bytes.NewReader(b))
+	req.Header.Set(`Content-Type`, `application/x-protobuf`)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `application/x-protobuf`, rec.Header().Get(`Content-Type`))
+
+	v, err := s.GetGaugeValue(context.Background(), `otlp_queue`)
+	assert.NoError(t, err)
+	assert.Equal(t, 3.5, v)
+
+	body := `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"otlp_jobs","sum":{"isMonotonic":true,"aggregationTemporality":1,"dataPoints":[{"asInt":"4"}]}}]}]}]}`
+	req = httptest.NewRequest(http.MethodPost, `/v1/metrics`, strings.NewReader(body))
+	req.Header.Set(`Content-Type`, `application/json`)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{}`, rec.Body.String())
+
+	c, err := s.GetCounterValue(context.Background(), `otlp_jobs`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), c)
+
+	req = httptest.NewRequest(http.MethodPost, `/v1/metrics`, strings.NewReader(body))
+	req.Header.Set(`Content-Type`, `text/plain`)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+}
+
+func TestOTLPTooLarge(t *testing.T) {
+	limit := *app.MaxBodySize
+	*app.MaxBodySize = 16
+	t.Cleanup(func() { *app.MaxBodySize = limit })
+
+	r := gin.Default()
+	g := r.Group(`/`)
+	s, _ := repository.CreateRepository()
+
+	RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+	body := `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"otlp_queue","gauge":{"dataPoints":[{"asDouble":1}]}}]}]}]}`
+	req := httptest.NewRequest(http.MethodPost, `/v1/metrics`, strings.NewReader(body))
+	req.Header.Set(`Content-Type`, `application/json`)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+func TestGzipBomb(t *testing.T) {
+	r := gin.Default()
+	r.Use(middlewares.GzipDecode(1024))
+	g := r.Group(`/`)
+	s, _ := repository.CreateRepository()
+
+	RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+	// Small compressed body is decompressed into too large body
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(bytes.Repeat([]byte("cpu,host=a usage_idle=80\n"), 1<<12))
+	zw.Close()
+	assert.Less(t, bomb.Len(), 1024)
+
+	for _, path := range []string{`/write`, `/v1/metrics`} {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(bomb.Bytes()))
+		req.Header.Set(`Content-Encoding`, `gzip`)
+		req.Header.Set(`Content-Type`, `application/json`)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, path)
+	}
+
+	// Compressed body is too large
+	req := httptest.NewRequest(http.MethodPost, `/write`, bytes.NewReader(make([]byte, 2048)))
+	req.Header.Set(`Content-Encoding`, `gzip`)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	_, err := s.GetGaugeValue(context.Background(), `cpu_usage_idle{host="a"}`)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestLabelsHandler(t *testing.T) {
+	r := gin.Default()
+	g := r.Group(`/`)
+	s, _ := repository.CreateRepository()
+
+	RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+	body := `[` +
+		`{"id":"LabelsCPU","type":"gauge","value":25,"labels":{"host":"a"}},` +
+		`{"id":"LabelsCPU","type":"gauge","value":30,"labels":{"host":"a","cpu":"1"}},` +
+		`{"id":"LabelsCPU","type":"gauge","value":40,"labels":{"host":"b"}},` +
+		`{"id":"LabelsCount","type":"counter","delta":3,"labels":{"host":"a"}}` +
+		`]`
+	req := httptest.NewRequest(http.MethodPost, `/updates/`, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	v, err := s.GetGaugeValue(context.Background(), `LabelsCPU{cpu="1",host="a"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 30.0, v)
+
+	tests := []struct {
+		name string
+		url  string
+		code int
+		body string
+	}{
+		{name: `exact`, url: `/value/gauge/LabelsCPU?host=a&cpu=1`, code: http.StatusOK, body: `30`},
+		{name: `least labels`, url: `/value/gauge/LabelsCPU?host=b`, code: http.StatusOK, body: `40`},
+		{name: `ambiguous`, url: `/value/gauge/LabelsCPU`, code: http.StatusBadRequest},
+		{name: `not found`, url: `/value/gauge/LabelsCPU?host=c`, code: http.StatusNotFound},
+		{name: `single series`, url: `/value/counter/LabelsCount`, code: http.StatusOK, body: `3`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.body != `` {
+				assert.Equal(t, tt.body, rec.Body.String())
+			}
+		})
+	}
+
+	// Labels of response are labels of found metric
+	req = httptest.NewRequest(http.MethodPost, `/value/`, strings.NewReader(`{"id":"LabelsCPU","type":"gauge","labels":{"cpu":"1"}}`))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"id":"LabelsCPU","type":"gauge","value":30,"labels":{"cpu":"1","host":"a"}}`, rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, `/update/counter/LabelsCount/2?host=a`, nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"id":"LabelsCount","type":"counter","delta":5,"labels":{"host":"a"}}`, rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, `/update/`, strings.NewReader(`{"id":"LabelsCPU","type":"gauge","value":1,"labels":{"a=b":"c"}}`))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestSeriesHandler(t *testing.T) {
+	r := gin.Default()
+	g := r.Group(`/`)
+	s, _ := repository.CreateRepository()
+
+	RegisterAppHandler(g, s, ingest.NewWriter(s))
+
+	from := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+
+	s.UpdateGaugeMetric(context.Background(), `SeriesGauge{host="a"}`, 1)
+	s.UpdateGaugeMetric(context.Background(), `SeriesGauge{host="a"}`, 2)
+	s.UpdateCounterMetric(context.Background(), `SeriesCounter`, 3)
+	s.UpdateCounterMetric(context.Background(), `SeriesCounter`, 4)
+
+	var series struct {
+		ID     string            `json:"id"`
+		Labels map[string]string `json:"labels"`
+		Step   string            `json:"step"`
+		Points []struct {
+			Time  time.Time `json:"time"`
+			Value float64   `json:"value"`
+		} `json:"points"`
+	}
+
+	req := httptest.NewRequest(http.MethodGet, `/api/v1/series?name=SeriesGauge&host=a&from=`+from, nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &series))
+	assert.Equal(t, `SeriesGauge`, series.ID)
+	assert.Equal(t, map[string]string{`host`: `a`}, series.Labels)
+	if assert.Len(t, series.Points, 2) {
+		assert.Equal(t, 1.0, series.Points[0].Value)
+		assert.Equal(t, 2.0, series.Points[1].Value)
+	}
+
+	// Counters are cumulative, the last value of step is returned
+	req = httptest.NewRequest(http.MethodGet, `/api/v1/series?name=SeriesCounter&type=counter&step=1h&from=`+from, nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &series))
+	assert.Equal(t, `1h0m0s`, series.Step)
+	if assert.Len(t, series.Points, 1) {
+		assert.Equal(t, 7.0, series.Points[0].Value)
+	}
+
+	// Sum of counter is the sum of increments
+	req = httptest.NewRequest(http.MethodGet, `/api/v1/series?name=SeriesCounter&type=counter&step=1h&agg=sum&from=`+from, nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &series))
+	if assert.Len(t, series.Points, 1) {
+		assert.Equal(t, 7.0, series.Points[0].Value)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, `/api/v1/series?name=SeriesGauge&step=1h&agg=min&from=`+from, nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &series))
+	if assert.Len(t, series.Points, 1) {
+		assert.Equal(t, 1.0, series.Points[0].Value)
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		code int
+	}{
+		{name: `without name`, url: `/api/v1/series`, code: http.StatusBadRequest},
+		{name: `unknown metric`, url: `/api/v1/series?name=SeriesUnknown`, code: http.StatusNotFound},
+		{name: `invalid time`, url: `/api/v1/series?name=SeriesCounter&type=counter&from=yesterday`, code: http.StatusBadRequest},
+		{name: `from after to`, url: `/api/v1/series?name=SeriesCounter&type=counter&from=2000&to=1000`, code: http.StatusBadRequest},
+		{name: `sum of gauge`, url: `/api/v1/series?name=SeriesGauge&agg=sum`, code: http.StatusBadRequest},
+		{name: `unknown aggregation`, url: `/api/v1/series?name=SeriesGauge&agg=median`, code: http.StatusBadRequest},
+		{name: `too many steps`, url: `/api/v1/series?name=SeriesCounter&type=counter&step=1ms`, code: http.StatusBadRequest},
+		{name: `RFC 3339`, url: `/api/v1/series?name=SeriesCounter&type=counter&from=2024-01-01T00:00:00Z&to=2024-01-01T01:00:00Z&step=60`, code: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.code, rec.Code)
+		})
+	}
+}
+
+// failingStorage is a storage with unavailable database.
+type failingStorage struct{}
+
+var errDatabase = errors.New(`connection refused`)
+
+func (failingStorage) UpdateGaugeMetric(context.Context, string, float64) (float64, error) {
+	return 0, errDatabase
+}
+
+func (failingStorage) UpdateCounterMetric(context.Context, string, int64) (int64, error) {
+	return 0, errDatabase
+}
+
+func (failingStorage) UpdateBatch(context.Context, []storage.Metric) ([]storage.Metric, error) {
+	return nil, errDatabase
+}
+
+func (failingStorage) GetValues(context.Context) (map[string]float64, map[string]int64, error) {
+	return nil, nil, errDatabase
+}
+
+func (failingStorage) GetCounterValue(context.Context, string) (int64, error) {
+	return 0, errDatabase
+}
+
+func (failingStorage) GetGaugeValue(context.Context, string) (float64, error) {
+	return 0, errDatabase
+}
+
+func (failingStorage) FindCounters(context.Context, string, storage.Labels) (map[string]int64, error) {
+	return nil, errDatabase
+}
+
+func (failingStorage) FindGauges(context.Context, string, storage.Labels) (map[string]float64, error) {
+	return nil, errDatabase
+}
+
+func (failingStorage) GetGaugeHistory(context.Context, string, time.Time, time.Time, time.Duration) ([]storage.Bucket, error) {
+	return nil, errDatabase
+}
+
+func (failingStorage) GetCounterHistory(context.Context, string, time.Time, time.Time, time.Duration) ([]storage.Bucket, error) {
+	return nil, errDatabase
+}
+
+func TestStorageErrors(t *testing.T) {
+	r := gin.Default()
+	g := r.Group(`/`)
+
+	RegisterAppHandler(g, failingStorage{}, ingest.NewWriter(failingStorage{}))
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		code   int
+	}{
+		{name: `update by params`, method: http.MethodPost, url: `/update/counter/PollCount/1`, code: http.StatusServiceUnavailable},
+		{name: `update by body`, method: http.MethodPost, url: `/update/`, body: `{"id":"Alloc","type":"gauge","value":1}`, code: http.StatusServiceUnavailable},
+		{name: `batch`, method: http.MethodPost, url: `/updates/`, body: `[{"id":"Alloc","type":"gauge","value":1}]`, code: http.StatusServiceUnavailable},
+		{name: `invalid batch`, method: http.MethodPost, url: `/updates/`, body: `[{"id":"Alloc","type":"gauge"}]`, code: http.StatusBadRequest},
+		{name: `value by params`, method: http.MethodGet, url: `/value/gauge/Alloc`, code: http.StatusServiceUnavailable},
+		{name: `value by body`, method: http.MethodPost, url: `/value/`, body: `{"id":"Alloc","type":"gauge"}`, code: http.StatusServiceUnavailable},
+		{name: `all metrics`, method: http.MethodGet, url: `/`, code: http.StatusServiceUnavailable},
+		{name: `prometheus`, method: http.MethodGet, url: `/metrics`, code: http.StatusServiceUnavailable},
+		{name: `series`, method: http.MethodGet, url: `/api/v1/series?name=Alloc`, code: http.StatusServiceUnavailable},
+		{name: `influx`, method: http.MethodPost, url: `/write`, body: `cpu usage=1`, code: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.code, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,376 @@
+// Package influx parse InfluxDB line protocol and convert points to samples
+package influx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+)
+
+var (
+	Counters   = flag.String(`influx-counters`, ``, `Comma separated globs of integer fields saved as counters, e.g. net_bytes_*`)
+	UDPAddress = flag.String(`influx-udp`, ``, `Address of UDP listener of InfluxDB line protocol. Empty - disabled`)
+)
+
+var (
+	errMeasurement = errors.New(`measurement is empty`)
+	errTag         = errors.New(`invalid tag`)
+	errField       = errors.New(`invalid field`)
+	errNoFields    = errors.New(`fields not found`)
+	errTimestamp   = errors.New(`invalid timestamp`)
+)
+
+// ParseEnv overrides flags by INFLUX_COUNTERS and INFLUX_UDP_ADDRESS environment variables.
+func ParseEnv() {
+	if env, exist := os.LookupEnv(`INFLUX_COUNTERS`); exist {
+		Counters = &env
+	}
+
+	if env, exist := os.LookupEnv(`INFLUX_UDP_ADDRESS`); exist {
+		UDPAddress = &env
+	}
+}
+
+// FieldType is a type of field value.
+type FieldType int
+
+const (
+	Float FieldType = iota
+	Integer
+	Unsigned
+	String
+	Boolean
+)
+
+// Field is a value of field.
+type Field struct {
+	Type   FieldType
+	Number float64 // Value of float, integer, unsigned and boolean (0 or 1) field
+	String string  // Value of string field
+}
+
+// Point is a parsed line.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]Field
+	Timestamp   *int64 // Timestamp in precision of request, nil if not set
+}
+
+// LineError is an error of line.
+type LineError struct {
+	Line  int    `json:"line"`  // Number of line from 1
+	Error string `json:"error"` // Error message
+}
+
+// Rules are globs of names of integer fields saved as counters.
+type Rules []string
+
+// ParseRules parses comma separated globs.
+//
+// Parameters:
+//   - s: the globs, e.g. `net_bytes_*,diskio_*`.
+//
+// Returns:
+//   - Rules: the rules.
+//   - error: error if glob is invalid.
+func ParseRules(s string) (Rules, error) {
+	var rules Rules
+	for _, glob := range strings.Split(s, `,`) {
+		glob = strings.TrimSpace(glob)
+		if glob == `` {
+			continue
+		}
+		if _, err := path.Match(glob, ``); err != nil {
+			return nil, fmt.Errorf(`invalid glob %q: %w`, glob, err)
+		}
+		rules = append(rules, glob)
+	}
+	return rules, nil
+}
+
+// IsCounter checks if name of metric matches any rule.
+//
+// Parameters:
+//   - name: the name of metric, e.g. `net_bytes_recv`.
+//
+// Returns:
+//   - bool: true if metric is a counter.
+func (r Rules) IsCounter(name string) bool {
+	for _, glob := range r {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Samples converts points into samples.
+//
+// Name of sample is `<measurement>_<field>`, or `<measurement>` for field
+// `value`. Tags are labels. Integer and unsigned fields are cumulative
+// counters if name matches rules, other numbers and booleans are gauges.
+// String fields are skipped.
+//
+// Parameters:
+//   - points: the points.
+//   - rules: the rules of counters.
+//
+// Returns:
+//   - []ingest.Sample: the samples.
+func Samples(points []Point, rules Rules) []ingest.Sample {
+	var samples []ingest.Sample
+
+	for _, p := range points {
+		// Fields are sorted, so order of samples doesn't depend on map order
+		keys := make([]string, 0, len(p.Fields))
+		for k := range p.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			f := p.Fields[k]
+			if f.Type == String {
+				continue
+			}
+
+			name := p.Measurement + `_` + k
+			if k == `value` {
+				name = p.Measurement
+			}
+
+			samples = append(samples, ingest.Sample{
+				Name:    name,
+				Labels:  p.Tags,
+				Value:   f.Number,
+				Counter: (f.Type == Integer || f.Type == Unsigned) && rules.IsCounter(name),
+			})
+		}
+	}
+
+	return samples
+}
+
+// ParseLines parses lines of InfluxDB line protocol.
+//
+// Empty lines and lines started with `#` are skipped. Invalid lines are
+// returned as errors, other lines are parsed.
+//
+// Parameters:
+//   - b: the lines.
+//
+// Returns:
+//   - []Point: the parsed points.
+//   - []LineError: the errors of invalid lines.
+func ParseLines(b []byte) ([]Point, []LineError) {
+	var points []Point
+	var errs []LineError
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 0, 64<<10), len(b)+1)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+
+		p, err := Parse(line)
+		if err != nil {
+			errs = append(errs, LineError{Line: n, Error: err.Error()})
+			continue
+		}
+		points = append(points, p)
+	}
+
+	return points, errs
+}
+
+// Parse parses line in format `measurement[,tag=value...] field=value[,field=value...] [timestamp]`.
+//
+// Parameters:
+//   - line: the line.
+//
+// Returns:
+//   - Point: the point.
+//   - error: error if line is invalid.
+func Parse(line string) (Point, error) {
+	p := Point{
+		Tags:   make(map[string]string),
+		Fields: make(map[string]Field),
+	}
+
+	measurement, i := scan(line, 0, `, `)
+	if measurement == `` {
+		return Point{}, errMeasurement
+	}
+	p.Measurement = measurement
+
+	// Tags
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = scan(line, i+1, `=, `)
+		if key == `` || i >= len(line) || line[i] != '=' {
+			return Point{}, fmt.Errorf(`%w: %q`, errTag, key)
+		}
+
+		value, i = scan(line, i+1, `, `)
+		if value == `` {
+			return Point{}, fmt.Errorf(`%w: %q`, errTag, key)
+		}
+		p.Tags[key] = value
+	}
+
+	i = skipSpaces(line, i)
+	if i >= len(line) {
+		return Point{}, errNoFields
+	}
+
+	// Fields
+	for {
+		var key string
+		key, i = scan(line, i, `=, `)
+		if key == `` || i >= len(line) || line[i] != '=' {
+			return Point{}, fmt.Errorf(`%w: %q`, errField, key)
+		}
+		i++
+
+		var f Field
+		var err error
+		if i < len(line) && line[i] == '"' {
+			f.Type = String
+			f.String, i, err = scanString(line, i+1)
+		} else {
+			var raw string
+			raw, i = scan(line, i, `, `)
+			f, err = parseField(raw)
+		}
+		if err != nil {
+			return Point{}, fmt.Errorf(`%w %q: %w`, errField, key, err)
+		}
+		p.Fields[key] = f
+
+		if i < len(line) && line[i] == ',' {
+			i++
+			continue
+		}
+		break
+	}
+
+	// Timestamp
+	i = skipSpaces(line, i)
+	if i < len(line) {
+		ts, err := strconv.ParseInt(strings.TrimSpace(line[i:]), 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf(`%w: %q`, errTimestamp, line[i:])
+		}
+		p.Timestamp = &ts
+	}
+
+	return p, nil
+}
+
+// parseField parses value of field which is not a string.
+//
+// Parameters:
+//   - raw: the value, e.g. `1.5`, `1i`, `1u` or `true`.
+//
+// Returns:
+//   - Field: the field.
+//   - error: error if value is invalid.
+func parseField(raw string) (Field, error) {
+	switch raw {
+	case `t`, `T`, `true`, `True`, `TRUE`:
+		return Field{Type: Boolean, Number: 1}, nil
+	case `f`, `F`, `false`, `False`, `FALSE`:
+		return Field{Type: Boolean, Number: 0}, nil
+	case ``:
+		return Field{}, errors.New(`value is empty`)
+	}
+
+	switch raw[len(raw)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		return Field{Type: Integer, Number: float64(v)}, err
+	case 'u':
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		return Field{Type: Unsigned, Number: float64(v)}, err
+	}
+
+	v, err := strconv.ParseFloat(raw, 64)
+	return Field{Type: Float, Number: v}, err
+}
+
+// scan reads token until unescaped stop character.
+//
+// Backslash escapes any of stop characters, `"` and `\`.
+//
+// Parameters:
+//   - s: the line.
+//   - i: the start of token.
+//   - stops: the stop characters.
+//
+// Returns:
+//   - string: the unescaped token.
+//   - int: the index of stop character or length of line.
+func scan(s string, i int, stops string) (string, int) {
+	var b strings.Builder
+	for ; i < len(s); i++ {
+		ch := s[i]
+		if ch == '\\' && i+1 < len(s) && (strings.IndexByte(stops, s[i+1]) >= 0 || s[i+1] == '\\' || s[i+1] == '"') {
+			i++
+			b.WriteByte(s[i])
+			continue
+		}
+		if strings.IndexByte(stops, ch) >= 0 {
+			break
+		}
+		b.WriteByte(ch)
+	}
+	return b.String(), i
+}
+
+// scanString reads string value of field after opening quote.
+//
+// Parameters:
+//   - s: the line.
+//   - i: the index after opening quote.
+//
+// Returns:
+//   - string: the unescaped value.
+//   - int: the index after closing quote.
+//   - error: error if closing quote not found.
+func scanString(s string, i int) (string, int, error) {
+	var b strings.Builder
+	for ; i < len(s); i++ {
+		ch := s[i]
+		if ch == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+			i++
+			b.WriteByte(s[i])
+			continue
+		}
+		if ch == '"' {
+			return b.String(), i + 1, nil
+		}
+		b.WriteByte(ch)
+	}
+	return ``, i, errors.New(`closing quote not found`)
+}
+
+// skipSpaces returns index of first character after spaces.
+func skipSpaces(s string, i int) int {
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,170 @@
+package influx
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository/memory"
+)
+
+func TestParse(t *testing.T) {
+	ts := int64(1700000000000000000)
+
+	tests := []struct {
+		name    string
+		line    string
+		want    Point
+		wantErr error
+	}{
+		{
+			name: `tags, fields and timestamp`,
+			line: `cpu,host=server01,region=eu usage_idle=92.5,usage_user=3i 1700000000000000000`,
+			want: Point{
+				Measurement: `cpu`,
+				Tags:        map[string]string{`host`: `server01`, `region`: `eu`},
+				Fields: map[string]Field{
+					`usage_idle`: {Type: Float, Number: 92.5},
+					`usage_user`: {Type: Integer, Number: 3},
+				},
+				Timestamp: &ts,
+			},
+		},
+		{
+			name: `without tags and timestamp`,
+			line: `mem used=10u,ok=true,note="a \"b\", c"`,
+			want: Point{
+				Measurement: `mem`,
+				Tags:        map[string]string{},
+				Fields: map[string]Field{
+					`used`: {Type: Unsigned, Number: 10},
+					`ok`:   {Type: Boolean, Number: 1},
+					`note`: {Type: String, String: `a "b", c`},
+				},
+			},
+		},
+		{
+			name: `escaped characters`,
+			line: `disk\ io,path=/var\ log,dev\=x=sda read\,bytes=1i`,
+			want: Point{
+				Measurement: `disk io`,
+				Tags:        map[string]string{`path`: `/var log`, `dev=x`: `sda`},
+				Fields: map[string]Field{
+					`read,bytes`: {Type: Integer, Number: 1},
+				},
+			},
+		},
+		{name: `empty measurement`, line: `,host=a value=1`, wantErr: errMeasurement},
+		{name: `tag without value`, line: `cpu,host value=1`, wantErr: errTag},
+		{name: `without fields`, line: `cpu,host=a`, wantErr: errNoFields},
+		{name: `field without value`, line: `cpu value=`, wantErr: errField},
+		{name: `invalid integer`, line: `cpu value=1.5i`, wantErr: errField},
+		{name: `unclosed string`, line: `cpu value="abc`, wantErr: errField},
+		{name: `invalid timestamp`, line: `cpu value=1 now`, wantErr: errTimestamp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.line)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	points, errs := ParseLines([]byte("# comment\ncpu value=1\n\ncpu\nmem used=2i\n"))
+
+	assert.Len(t, points, 2)
+	assert.Equal(t, []LineError{{Line: 4, Error: errNoFields.Error()}}, errs)
+}
+
+func TestSamples(t *testing.T) {
+	rules, err := ParseRules(`net_bytes_*, cpu`)
+	require.NoError(t, err)
+
+	points, errs := ParseLines([]byte("net,iface=eth0 bytes_recv=100i,bytes_rate=1.5,name=\"eth0\"\ncpu value=3i\nmem used=7i"))
+	require.Empty(t, errs)
+
+	samples := Samples(points, rules)
+	labels := map[string]string{`iface`: `eth0`}
+	assert.Equal(t, []ingest.Sample{
+		{Name: `net_bytes_rate`, Labels: labels, Value: 1.5},
+		{Name: `net_bytes_recv`, Labels: labels, Value: 100, Counter: true},
+		{Name: `cpu`, Labels: map[string]string{}, Value: 3, Counter: true},
+		{Name: `mem_used`, Labels: map[string]string{}, Value: 7},
+	}, samples)
+
+	_, err = ParseRules(`[`)
+	assert.Error(t, err)
+}
+
+func TestListenUDP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+	s := memory.CreateRepository(memory.Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+	})
+
+	l, err := ListenUDP(`127.0.0.1:0`, ingest.NewWriter(s), nil, nil)
+	require.NoError(t, err)
+
+	conn, err := net.Dial(`udp`, l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("invalid\nload,host=a load1=0.5"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		v, err := s.GetGaugeValue(context.Background(), `load_load1{host="a"}`)
+		return err == nil && v == 0.5
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, l.Close())
+}
+
+func TestListenUDPSubnet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+	s := memory.CreateRepository(memory.Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+	})
+
+	_, subnet, err := net.ParseCIDR(`127.0.0.0/8`)
+	require.NoError(t, err)
+
+	l, err := ListenUDP(`127.0.0.1:0`, ingest.NewWriter(s), nil, subnet)
+	require.NoError(t, err)
+	defer l.Close()
+
+	conn, err := net.Dial(`udp`, l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(`load,host=a load1=0.5`))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		v, err := s.GetGaugeValue(context.Background(), `load_load1{host="a"}`)
+		return err == nil && v == 0.5
+	}, time.Second, 10*time.Millisecond)
+
+	// Packets from other addresses are dropped
+	assert.True(t, l.trusted(&net.UDPAddr{IP: net.ParseIP(`127.0.0.2`)}))
+	assert.False(t, l.trusted(&net.UDPAddr{IP: net.ParseIP(`10.0.0.1`)}))
+}
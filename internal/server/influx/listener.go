@@ -0,0 +1,113 @@
+package influx
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"go.uber.org/zap"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+)
+
+// maxPacket is a max size of UDP packet.
+const maxPacket = 64 << 10
+
+// Listener receives lines of InfluxDB line protocol by UDP.
+type Listener struct {
+	conn   net.PacketConn
+	writer *ingest.Writer
+	rules  Rules
+	subnet *net.IPNet
+	done   chan struct{}
+}
+
+// ListenUDP starts receiving lines in background.
+//
+// Invalid lines are logged and skipped. Packets from addresses outside the
+// trusted subnet are dropped.
+//
+// Parameters:
+//   - address: the address of listener, e.g. `:8089`.
+//   - w: the writer of samples.
+//   - rules: the rules of counters.
+//   - subnet: the trusted subnet. If nil, packets from all addresses are accepted.
+//
+// Returns:
+//   - *Listener: the listener.
+//   - error: error if address cannot be listened.
+func ListenUDP(address string, w *ingest.Writer, rules Rules, subnet *net.IPNet) (*Listener, error) {
+	conn, err := net.ListenPacket(`udp`, address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		conn:   conn,
+		writer: w,
+		rules:  rules,
+		subnet: subnet,
+		done:   make(chan struct{}),
+	}
+
+	go l.listen()
+
+	zap.L().Info(`InfluxDB UDP listener started`, zap.String(`address`, conn.LocalAddr().String()))
+
+	return l, nil
+}
+
+// Addr returns address of listener.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Close stops listener and waits until last packet is written.
+func (l *Listener) Close() error {
+	err := l.conn.Close()
+	<-l.done
+	return err
+}
+
+// listen reads packets until connection is closed.
+func (l *Listener) listen() {
+	defer close(l.done)
+
+	buf := make([]byte, maxPacket)
+
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			zap.L().Warn(`Cannot read InfluxDB packet`, zap.Error(err))
+			continue
+		}
+
+		if !l.trusted(addr) {
+			zap.L().Debug(`InfluxDB packet from untrusted address dropped`, zap.Stringer(`address`, addr))
+			continue
+		}
+
+		points, errs := ParseLines(buf[:n])
+		for _, e := range errs {
+			zap.L().Warn(`Invalid InfluxDB line`, zap.Int(`line`, e.Line), zap.String(`error`, e.Error))
+		}
+
+		// UDP has no response, so points are lost if storage fails
+		if _, _, err := l.writer.Write(context.Background(), Samples(points, l.rules)); err != nil {
+			zap.L().Error(`Cannot write InfluxDB points`, zap.Error(err))
+		}
+	}
+}
+
+// trusted checks that address of packet is in the trusted subnet.
+func (l *Listener) trusted(addr net.Addr) bool {
+	if l.subnet == nil {
+		return true
+	}
+
+	udp, ok := addr.(*net.UDPAddr)
+	return ok && l.subnet.Contains(udp.IP)
+}
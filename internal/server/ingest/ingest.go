@@ -0,0 +1,291 @@
+// Package ingest writes samples of external protocols into storage
+package ingest
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+)
+
+var errName = errors.New(`name of sample is empty`)
+var errValue = errors.New(`value of sample is not a number`)
+
+// Sample is a value of metric from external protocol.
+type Sample struct {
+	Name    string            // Name of metric
+	Labels  map[string]string // Labels of metric, may be empty
+	Value   float64           // Value of metric
+	Counter bool              // Value is a cumulative counter, otherwise gauge
+	Delta   bool              // Value of counter is a difference since previous sample
+}
+
+// lastTTL is a time after which the last value of counter is forgotten, so
+// series which are not sent anymore don't take memory. The next sample of
+// forgotten counter is a new baseline.
+var lastTTL = time.Hour
+
+// maxLast is a max count of remembered counters. If it is reached, the least
+// recently seen counter is forgotten.
+const maxLast = 100_000
+
+// Writer writes samples into storage.
+//
+// Storage keeps counters as sum of deltas, but external protocols send
+// cumulative values. Writer remembers the last cumulative value of each
+// counter and writes the difference. If cumulative value decreases, the
+// counter was reset and the whole value is written. Delta counters are
+// written as is.
+//
+// Storage doesn't know the last cumulative value, only the sum of deltas, so
+// the first sample of counter which is already in storage but not remembered,
+// e.g. after restart of the server, is a baseline and nothing is added. The
+// whole value is written only for counters which are not in storage yet.
+type Writer struct {
+	storage storage.Storage
+	now     func() time.Time
+
+	mu    sync.Mutex
+	last  map[string]lastValue
+	swept time.Time // Time when expired values were removed
+}
+
+// lastValue is the last cumulative value of counter.
+type lastValue struct {
+	value float64
+	seen  time.Time
+}
+
+// NewWriter creates a Writer.
+//
+// Parameters:
+//   - s: the storage.
+//
+// Returns:
+//   - *Writer: the writer.
+func NewWriter(s storage.Storage) *Writer {
+	return &Writer{
+		storage: s,
+		now:     time.Now,
+		last:    make(map[string]lastValue),
+	}
+}
+
+// Write writes samples into storage in order as a single batch.
+//
+// Invalid samples are skipped. Valid samples are written either all or none
+// of them if storage fails. Writes are concurrent, the lock is held only
+// while deltas are calculated.
+//
+// Parameters:
+//   - ctx: the context of request.
+//   - samples: the samples.
+//
+// Returns:
+//   - int: the count of written samples.
+//   - []error: the errors of skipped samples.
+//   - error: the error of storage.
+func (w *Writer) Write(ctx context.Context, samples []Sample) (int, []error, error) {
+	var errs []error
+	valid := make([]Sample, 0, len(samples))
+	ids := make([]string, 0, len(samples))
+
+	for _, sample := range samples {
+		if sample.Name == `` {
+			errs = append(errs, errName)
+			continue
+		}
+		if err := storage.CheckSeries(sample.Name, sample.Labels); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			errs = append(errs, errValue)
+			continue
+		}
+
+		valid = append(valid, sample)
+		ids = append(ids, storage.SeriesKey(sample.Name, sample.Labels))
+	}
+
+	if len(valid) == 0 {
+		return 0, errs, nil
+	}
+
+	// Counters which are not remembered are checked in storage
+	stored, err := w.storedCounters(ctx, valid, ids)
+	if err != nil {
+		return 0, errs, err
+	}
+
+	batch, undo := w.deltas(valid, ids, stored)
+
+	if _, err := w.storage.UpdateBatch(ctx, batch); err != nil {
+		undo()
+		return 0, errs, err
+	}
+
+	return len(batch), errs, nil
+}
+
+// storedCounters checks which cumulative counters that are not remembered
+// are already in storage.
+//
+// Parameters:
+//   - ctx: the context of request.
+//   - samples: the valid samples.
+//   - ids: the series keys of samples.
+//
+// Returns:
+//   - map[string]bool: true by series key if counter is in storage.
+//   - error: the error of storage.
+func (w *Writer) storedCounters(ctx context.Context, samples []Sample, ids []string) (map[string]bool, error) {
+	var missing []string
+
+	w.mu.Lock()
+	for i, sample := range samples {
+		if !sample.Counter || sample.Delta {
+			continue
+		}
+		if _, ok := w.last[ids[i]]; !ok {
+			missing = append(missing, ids[i])
+		}
+	}
+	w.mu.Unlock()
+
+	stored := make(map[string]bool, len(missing))
+	for _, id := range missing {
+		if _, ok := stored[id]; ok {
+			continue
+		}
+
+		_, err := w.storage.GetCounterValue(ctx, id)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		stored[id] = err == nil
+	}
+
+	return stored, nil
+}
+
+// deltas converts samples into batch and remembers cumulative values.
+//
+// Values are remembered before batch is saved, so concurrent writes of the
+// same counter don't write the same difference twice.
+//
+// Parameters:
+//   - samples: the valid samples.
+//   - ids: the series keys of samples.
+//   - stored: the counters which are not remembered but are in storage.
+//
+// Returns:
+//   - []storage.Metric: the batch.
+//   - func(): the function which restores remembered values if batch is not
+//     saved, so the values are sent again with the next samples.
+func (w *Writer) deltas(samples []Sample, ids []string, stored map[string]bool) ([]storage.Metric, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	w.sweep(now)
+
+	batch := make([]storage.Metric, 0, len(samples))
+	prevs := make(map[string]*lastValue)
+	set := make(map[string]float64)
+
+	for i, sample := range samples {
+		id := ids[i]
+
+		if !sample.Counter {
+			batch = append(batch, storage.Metric{Name: id, MType: `gauge`, Value: sample.Value})
+			continue
+		}
+
+		if sample.Delta {
+			batch = append(batch, storage.Metric{Name: id, MType: `counter`, Delta: int64(math.Round(sample.Value))})
+			continue
+		}
+
+		last, ok := w.last[id]
+		prev := last.value
+		if v, inBatch := set[id]; inBatch {
+			prev = v
+		} else if !ok && stored[id] {
+			// Baseline, value since the previous sample is unknown
+			prev = sample.Value
+		}
+
+		delta := math.Round(sample.Value) - math.Round(prev)
+		if sample.Value < prev {
+			delta = math.Round(sample.Value)
+		}
+
+		batch = append(batch, storage.Metric{Name: id, MType: `counter`, Delta: int64(delta)})
+
+		if _, ok := set[id]; !ok {
+			if last, ok := w.last[id]; ok {
+				prevs[id] = &last
+			} else {
+				prevs[id] = nil
+			}
+		}
+		set[id] = sample.Value
+
+		if !ok && len(w.last) >= maxLast {
+			w.evict()
+		}
+		w.last[id] = lastValue{value: sample.Value, seen: now}
+	}
+
+	undo := func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		// Values changed by other writes are kept
+		for id, v := range set {
+			if w.last[id].value != v {
+				continue
+			}
+			if prev := prevs[id]; prev != nil {
+				w.last[id] = *prev
+			} else {
+				delete(w.last, id)
+			}
+		}
+	}
+
+	return batch, undo
+}
+
+// sweep removes values which were not updated for lastTTL. Values are checked
+// not more often than once in lastTTL.
+func (w *Writer) sweep(now time.Time) {
+	if now.Sub(w.swept) < lastTTL {
+		return
+	}
+	w.swept = now
+
+	for id, v := range w.last {
+		if now.Sub(v.seen) > lastTTL {
+			delete(w.last, id)
+		}
+	}
+}
+
+// evict forgets the least recently seen counter.
+func (w *Writer) evict() {
+	var oldest string
+	var seen time.Time
+
+	for id, v := range w.last {
+		if oldest == `` || v.seen.Before(seen) {
+			oldest, seen = id, v.seen
+		}
+	}
+
+	delete(w.last, oldest)
+}
@@ -0,0 +1,200 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository/memory"
+)
+
+func createStorage(t *testing.T) *memory.MemStorage {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+
+	return memory.CreateRepository(memory.Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+	})
+}
+
+// failingStorage fails updates of batches.
+type failingStorage struct {
+	*memory.MemStorage
+	fail bool
+}
+
+func (s *failingStorage) UpdateBatch(ctx context.Context, metrics []storage.Metric) ([]storage.Metric, error) {
+	if s.fail {
+		return nil, errors.New(`connection refused`)
+	}
+	return s.MemStorage.UpdateBatch(ctx, metrics)
+}
+
+func TestWriter(t *testing.T) {
+	s := createStorage(t)
+	w := NewWriter(s)
+	ctx := context.Background()
+
+	labels := map[string]string{`job`: `node`, `instance`: `host:9100`}
+
+	written, errs, err := w.Write(ctx, []Sample{
+		{Name: `requests_total`, Labels: labels, Value: 10, Counter: true},
+		{Name: `requests_total`, Labels: labels, Value: 15, Counter: true},
+		{Name: `temperature`, Value: 36.6},
+		{Name: ``, Value: 1},
+		{Name: `stale`, Value: math.NaN()},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, written)
+	assert.Len(t, errs, 2)
+
+	id := `requests_total{instance="host:9100",job="node"}`
+
+	v, _ := s.GetCounterValue(ctx, id)
+	assert.Equal(t, int64(15), v)
+
+	g, _ := s.GetGaugeValue(ctx, `temperature`)
+	assert.Equal(t, 36.6, g)
+
+	// Counter was reset
+	w.Write(ctx, []Sample{{Name: `requests_total`, Labels: labels, Value: 4, Counter: true}})
+	v, _ = s.GetCounterValue(ctx, id)
+	assert.Equal(t, int64(19), v)
+
+	w.Write(ctx, []Sample{{Name: `requests_total`, Labels: labels, Value: 6, Counter: true}})
+	v, _ = s.GetCounterValue(ctx, id)
+	assert.Equal(t, int64(21), v)
+
+	// Delta counter
+	w.Write(ctx, []Sample{{Name: `requests_total`, Labels: labels, Value: 2, Counter: true, Delta: true}})
+	v, _ = s.GetCounterValue(ctx, id)
+	assert.Equal(t, int64(23), v)
+
+	// New writer, e.g. after restart, takes the first sample of counter in
+	// storage as baseline, value after reset is not added twice
+	w = NewWriter(s)
+	w.Write(ctx, []Sample{{Name: `requests_total`, Labels: labels, Value: 7, Counter: true}})
+	v, _ = s.GetCounterValue(ctx, id)
+	assert.Equal(t, int64(23), v)
+
+	w.Write(ctx, []Sample{{Name: `requests_total`, Labels: labels, Value: 9, Counter: true}})
+	v, _ = s.GetCounterValue(ctx, id)
+	assert.Equal(t, int64(25), v)
+
+	// New counter is written as is
+	w.Write(ctx, []Sample{{Name: `errors_total`, Value: 3, Counter: true}})
+	v, _ = s.GetCounterValue(ctx, `errors_total`)
+	assert.Equal(t, int64(3), v)
+}
+
+func TestWriterStorageError(t *testing.T) {
+	s := &failingStorage{MemStorage: createStorage(t), fail: true}
+	w := NewWriter(s)
+	ctx := context.Background()
+
+	written, _, err := w.Write(ctx, []Sample{
+		{Name: `temperature`, Value: 36.6},
+		{Name: `requests_total`, Value: 10, Counter: true},
+		{Name: `load`, Value: 1},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 0, written)
+
+	// Nothing is written from failed batch
+	_, err = s.GetGaugeValue(ctx, `temperature`)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Failed value is sent again with the next sample
+	s.fail = false
+	_, _, err = w.Write(ctx, []Sample{{Name: `requests_total`, Value: 12, Counter: true}})
+	assert.NoError(t, err)
+
+	v, _ := s.GetCounterValue(ctx, `requests_total`)
+	assert.Equal(t, int64(12), v)
+}
+
+func TestWriterExpire(t *testing.T) {
+	s := createStorage(t)
+	w := NewWriter(s)
+	ctx := context.Background()
+
+	now := time.Now()
+	w.now = func() time.Time { return now }
+
+	w.Write(ctx, []Sample{{Name: `requests_total`, Value: 10, Counter: true}})
+	assert.Len(t, w.last, 1)
+
+	// Series which is not sent anymore is forgotten
+	now = now.Add(2 * lastTTL)
+	w.Write(ctx, []Sample{{Name: `errors_total`, Value: 1, Counter: true}})
+	assert.Len(t, w.last, 1)
+	assert.Contains(t, w.last, `errors_total`)
+
+	// The next sample of forgotten counter is a baseline
+	w.Write(ctx, []Sample{{Name: `requests_total`, Value: 3, Counter: true}})
+	v, _ := s.GetCounterValue(ctx, `requests_total`)
+	assert.Equal(t, int64(10), v)
+
+	w.Write(ctx, []Sample{{Name: `requests_total`, Value: 5, Counter: true}})
+	v, _ = s.GetCounterValue(ctx, `requests_total`)
+	assert.Equal(t, int64(12), v)
+}
+
+// slowStorage blocks updates of batches until all of them are started.
+type slowStorage struct {
+	*memory.MemStorage
+	started sync.WaitGroup
+}
+
+func (s *slowStorage) UpdateBatch(ctx context.Context, metrics []storage.Metric) ([]storage.Metric, error) {
+	s.started.Done()
+	s.started.Wait()
+	return s.MemStorage.UpdateBatch(ctx, metrics)
+}
+
+func TestWriterConcurrent(t *testing.T) {
+	s := &slowStorage{MemStorage: createStorage(t)}
+	w := NewWriter(s)
+	ctx := context.Background()
+
+	// Writes wait for each other in storage, so they deadlock if storage is called under lock
+	s.started.Add(2)
+	var wg sync.WaitGroup
+	for _, sample := range []Sample{
+		{Name: `requests_total`, Value: 10, Counter: true},
+		{Name: `errors_total`, Value: 2, Counter: true},
+	} {
+		wg.Add(1)
+		go func(sample Sample) {
+			defer wg.Done()
+			_, _, err := w.Write(ctx, []Sample{sample})
+			assert.NoError(t, err)
+		}(sample)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`writes are not concurrent`)
+	}
+
+	v, _ := s.GetCounterValue(ctx, `requests_total`)
+	assert.Equal(t, int64(10), v)
+	v, _ = s.GetCounterValue(ctx, `errors_total`)
+	assert.Equal(t, int64(2), v)
+}
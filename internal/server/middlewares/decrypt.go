@@ -0,0 +1,70 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Jourloy/go-metrics-collector/internal/encrypt"
+)
+
+// Decrypt is a middleware function that decrypts request body encrypted with
+// public key of the server.
+//
+// Only requests with `X-Encryption` header are decrypted, other requests are
+// passed as is. Must be used before GzipDecode, because agent compresses body
+// before encryption.
+//
+// Encrypted body larger than limit is rejected with 413.
+//
+// Parameters:
+//   - key: the private key of the server. If nil, requests are not decrypted.
+//   - limit: the max size of encrypted body in bytes.
+//
+// Returns:
+//   - a gin.HandlerFunc
+func Decrypt(key *rsa.PrivateKey, limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key == nil || c.Request.Header.Get(encrypt.HeaderEncryption) == `` {
+			c.Next()
+			return
+		}
+
+		if c.Request.Header.Get(encrypt.HeaderEncryption) != encrypt.Algorithm {
+			zap.L().Error(`Unknown encryption`, zap.String(`encryption`, c.Request.Header.Get(encrypt.HeaderEncryption)))
+			c.String(http.StatusBadRequest, `bad request`)
+			c.Abort()
+			return
+		}
+
+		b, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+		if isTooLarge(err) {
+			abortTooLarge(c, limit)
+			return
+		}
+		if err != nil {
+			zap.L().Error(`Cannot read body`, zap.Error(err))
+			c.String(http.StatusBadRequest, `bad request`)
+			c.Abort()
+			return
+		}
+
+		data, err := encrypt.Decrypt(key, b)
+		if err != nil {
+			zap.L().Error(`Cannot decrypt body`, zap.Error(err))
+			c.String(http.StatusBadRequest, `bad request`)
+			c.Abort()
+			return
+		}
+
+		c.Request.Header.Del(encrypt.HeaderEncryption)
+		c.Request.Body = io.NopCloser(bytes.NewReader(data))
+		c.Request.ContentLength = int64(len(data))
+
+		c.Next()
+	}
+}
@@ -3,7 +3,10 @@ package middlewares
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"io"
+	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -23,42 +26,56 @@ func (r gzipBodyWriter) Write(b []byte) (int, error) {
 	return r.Body.Write(b)
 }
 
+// RawBodyKey is a key of gin context with compressed body of request, it is
+// set only if body was decompressed.
+const RawBodyKey = `rawBody`
+
 // GzipDecode is a middleware function that compresses and decompresses gzipped request and response bodies.
 //
+// Body of request is read only up to limit, both compressed and decompressed,
+// so large bodies and gzip bombs are rejected with 413 before they are read
+// into memory.
+//
 // Parameters:
-//   - ctx: the gin context.
+//   - limit: the max size of body in bytes.
 //
 // Returns:
 // - a gin.HandlerFunc
-func GzipDecode() gin.HandlerFunc {
+func GzipDecode(limit int64) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		b, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+		if isTooLarge(err) {
+			abortTooLarge(c, limit)
+			return
+		}
+
+		// If content encoding is gzip, decompress the response body
+		if err == nil && c.Request.Header.Get(`Content-Encoding`) == `gzip` {
+			// Old agents signed compressed body
+			c.Set(RawBodyKey, b)
+
+			var r *gzip.Reader
+			r, err = gzip.NewReader(bytes.NewReader(b))
+			if err == nil {
+				b, err = io.ReadAll(io.LimitReader(r, limit+1))
+			}
+			if int64(len(b)) > limit {
+				abortTooLarge(c, limit)
+				return
+			}
+		}
+
 		writer := gzipBodyWriter{
 			ResponseWriter: c.Writer,
 			Body:           &bytes.Buffer{},
 		}
 		c.Writer = writer
 
-		b, err := io.ReadAll(c.Request.Body)
 		if err != nil {
 			c.Next()
 			return
 		}
 
-		// If content encoding is gzip, decompress the response body
-		if c.Request.Header.Get(`Content-Encoding`) == `gzip` {
-			r, err := gzip.NewReader(bytes.NewReader(b))
-			if err != nil {
-				c.Next()
-				return
-			}
-
-			b, err = io.ReadAll(r)
-			if err != nil {
-				c.Next()
-				return
-			}
-		}
-
 		// Set request body
 		c.Request.Body = io.NopCloser(strings.NewReader(string(b)))
 
@@ -70,7 +87,8 @@ func GzipDecode() gin.HandlerFunc {
 		c.Next()
 
 		// If client accepts gzip then compress the response
-		if c.Request.Header.Get(`Accept-Encoding`) == `gzip` {
+		writer.ResponseWriter.Header().Add(`Vary`, `Accept-Encoding`)
+		if acceptsGzip(c.Request.Header.Get(`Accept-Encoding`)) {
 			writer.ResponseWriter.Header().Set(`Content-Encoding`, `gzip`)
 
 			originalBody := writer.Body.Bytes()
@@ -88,3 +106,56 @@ func GzipDecode() gin.HandlerFunc {
 		}
 	}
 }
+
+// acceptsGzip checks if gzip is allowed by Accept-Encoding header.
+//
+// Header is a list like `gzip, deflate` or `gzip;q=1.0, identity;q=0.5`.
+// Encoding with `q=0` is not allowed.
+//
+// Parameters:
+//   - header: the value of Accept-Encoding header.
+//
+// Returns:
+//   - bool: true if gzip is allowed.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, `,`) {
+		encoding, params, _ := strings.Cut(part, `;`)
+		encoding = strings.TrimSpace(encoding)
+		if encoding != `gzip` && encoding != `*` {
+			continue
+		}
+
+		q, found := strings.CutPrefix(strings.ReplaceAll(params, ` `, ``), `q=`)
+		if !found {
+			return true
+		}
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTooLarge checks if body was not read because it is larger than limit.
+//
+// Parameters:
+//   - err: the error of reading body.
+//
+// Returns:
+//   - bool: true if body is too large.
+func isTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// abortTooLarge rejects request with 413.
+//
+// Parameters:
+//   - c: the gin context.
+//   - limit: the max size of body in bytes.
+func abortTooLarge(c *gin.Context, limit int64) {
+	zap.L().Error(`Body is too large`, zap.Int64(`limit`, limit))
+	c.String(http.StatusRequestEntityTooLarge, `body is too large`)
+	c.Abort()
+}
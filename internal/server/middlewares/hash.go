@@ -2,26 +2,59 @@ package middlewares
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"flag"
 	"io"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+
+	"github.com/Jourloy/go-metrics-collector/internal/sign"
 )
 
 var (
-	Key = flag.String(`k`, ``, `Key for hash`)
+	Key        = flag.String(`k`, ``, `Key for hash`)
+	HashWindow = flag.Duration(`hash-window`, 5*time.Minute, `Max age of signed request`)
+	HashCompat = flag.Bool(`hash-compat`, false, `Accept deprecated signatures of old agents`)
+
+	UnsignedReceivers = flag.Bool(`unsigned-receivers`, false, `Accept unsigned requests of Prometheus, InfluxDB and OpenTelemetry receivers`)
 )
 
-func parseEnv() {
+// nonceLimit is a max count of remembered nonces of signed requests.
+const nonceLimit = 100_000
+
+var errSignature = errors.New(`signature is invalid`)
+var errNoSignature = errors.New(`signature not found`)
+var errNoTimestamp = errors.New(`timestamp of signature not found`)
+
+// ParseEnv overrides flags by KEY, HASH_WINDOW, HASH_COMPAT and UNSIGNED_RECEIVERS environment variables.
+func ParseEnv() {
 	if env, exist := os.LookupEnv(`KEY`); exist {
 		Key = &env
 	}
+
+	if env, exist := os.LookupEnv(`HASH_WINDOW`); exist {
+		if d, err := time.ParseDuration(env); err == nil {
+			HashWindow = &d
+		}
+	}
+
+	if env, exist := os.LookupEnv(`HASH_COMPAT`); exist {
+		if b, err := strconv.ParseBool(env); err == nil {
+			HashCompat = &b
+		}
+	}
+
+	if env, exist := os.LookupEnv(`UNSIGNED_RECEIVERS`); exist {
+		if b, err := strconv.ParseBool(env); err == nil {
+			UnsignedReceivers = &b
+		}
+	}
 }
 
 type hashResponseWriter struct {
@@ -37,77 +70,121 @@ func (r hashResponseWriter) Write(b []byte) (int, error) {
 	return r.Body.Write(b)
 }
 
-// HashDecode compare the hash of the request body with the hash in the header and return 400 if they don't match.
+// HashDecode checks HMAC-SHA256 signature of the request body and signs the response.
+//
+// Agent sends `HashSHA256` header with HMAC of timestamp, nonce and body, and
+// `X-Timestamp` and `X-Nonce` headers. Requests outside of HashWindow or with
+// already used nonce are rejected, so old requests cannot be replayed.
+//
+// If HashCompat is true, requests of old agents signed by AES-GCM seal of body
+// are accepted too. Requests without signature are not accepted if key is
+// set. GET and HEAD requests and requests to unsigned paths are not checked,
+// unsigned paths are passed only if UnsignedReceivers is enabled.
+//
+// Returns 400 if signature is invalid.
 //
-// **Do not use this middleware in production.**
-// User can send new data with old hash.
-func HashDecode() gin.HandlerFunc {
-	parseEnv()
+// Parameters:
+//   - unsigned: the paths of requests which are not checked.
+func HashDecode(unsigned ...string) gin.HandlerFunc {
+	ParseEnv()
+
+	nonces := sign.NewNonceCache(*HashWindow, nonceLimit)
 
 	return func(c *gin.Context) {
-		writer := hashResponseWriter{
-			ResponseWriter: c.Writer,
-			Body:           &bytes.Buffer{},
+		// Check key
+		if *Key == `` {
+			zap.L().Debug(`Key is empty`)
+			c.Next()
+			return
 		}
-		c.Writer = writer
 
 		// Read body
 		b, err := io.ReadAll(c.Request.Body)
 		if err != nil {
 			zap.L().Error(`Cannot read body`, zap.Error(err))
-			panic(err)
+			c.String(http.StatusBadRequest, `bad request`)
+			c.Abort()
+			return
 		}
 		c.Request.Body = io.NopCloser(bytes.NewBuffer(b))
 
-		// Check key
-		if *Key == `` {
-			zap.L().Debug(`Key is empty`)
-			c.Next()
-			writer.ResponseWriter.Write(writer.Body.Bytes())
-			return
+		// Check hash
+		if isSigned(c.Request, unsigned) {
+			if err := verifyRequest(c, b, nonces); err != nil {
+				zap.L().Warn(`Request rejected`, zap.Error(err))
+				c.String(http.StatusBadRequest, `bad request`)
+				c.Abort()
+				return
+			}
+			zap.L().Debug(`Hash checked`)
 		}
 
-		// Check hash
-		h := c.Request.Header.Get(`HashSHA256`)
-		if h == `` {
-			zap.L().Debug(`Header is empty`)
-			c.Next()
-			writer.ResponseWriter.Write(writer.Body.Bytes())
-			return
+		writer := hashResponseWriter{
+			ResponseWriter: c.Writer,
+			Body:           &bytes.Buffer{},
 		}
+		c.Writer = writer
 
-		key := sha256.Sum256([]byte(*Key))
+		c.Next()
 
-		// Create cipher block
-		aesblock, err := aes.NewCipher(key[:])
-		if err != nil {
-			zap.L().Error(`Cannot create AES block`, zap.Error(err))
-			c.String(400, `bad request`)
-		}
+		// Sign response
+		c.Header(sign.HeaderHash, sign.Sum(*Key, writer.Body.Bytes()))
 
-		// Create GCM
-		aesgcm, err := cipher.NewGCM(aesblock)
-		if err != nil {
-			zap.L().Error(`Cannot create AES GCM`, zap.Error(err))
-			c.String(400, `bad request`)
-		}
+		writer.ResponseWriter.Write(writer.Body.Bytes())
+	}
+}
+
+// isSigned checks if request must be signed.
+func isSigned(r *http.Request, unsigned []string) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return false
+	}
+	return !slices.Contains(unsigned, r.URL.Path)
+}
 
-		nonce := key[len(key)-aesgcm.NonceSize():]
+// verifyRequest checks signature of the request.
+//
+// Parameters:
+//   - c: the gin context of request.
+//   - body: the body of request.
+//   - nonces: the cache of used nonces.
+//
+// Returns:
+//   - error: nil if request is accepted.
+func verifyRequest(c *gin.Context, body []byte, nonces *sign.NonceCache) error {
+	h := c.Request.Header.Get(sign.HeaderHash)
+	ts := c.Request.Header.Get(sign.HeaderTimestamp)
+
+	if h == `` {
+		return errNoSignature
+	}
 
-		// Encode boyd and check hash
-		compareH := aesgcm.Seal(nil, nonce, b, nil)
-		if string(compareH) != h {
-			c.String(400, `bad request`)
+	// Request from old agent
+	if ts == `` {
+		if !*HashCompat {
+			return errNoTimestamp
 		}
 
-		zap.L().Debug(`Hash checked`)
+		valid := sign.VerifyLegacy(*Key, h, body)
 
-		c.Next()
+		// Old agents signed compressed body
+		if raw, ok := c.Get(RawBodyKey); ok && !valid {
+			valid = sign.VerifyLegacy(*Key, h, raw.([]byte))
+		}
 
-		// Encode body and update header
-		newH := aesgcm.Seal(nil, nonce, writer.Body.Bytes(), nil)
-		c.Header(`HashSHA256`, hex.EncodeToString(newH[:]))
+		if !valid {
+			return errSignature
+		}
 
-		writer.ResponseWriter.Write(writer.Body.Bytes())
+		zap.L().Warn(`Request is signed in deprecated format, update the agent`, zap.String(`ip`, c.ClientIP()))
+		return nil
 	}
+
+	nonce := c.Request.Header.Get(sign.HeaderNonce)
+	if !sign.VerifyRequest(*Key, h, ts, nonce, body) {
+		return errSignature
+	}
+
+	// Check nonce only for valid signature, so cache cannot be filled by anyone
+	return nonces.Check(nonce, ts, time.Now())
 }
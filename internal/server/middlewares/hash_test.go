@@ -0,0 +1,150 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Jourloy/go-metrics-collector/internal/sign"
+)
+
+// setHashFlags sets key and compatibility mode for the test.
+func setHashFlags(t *testing.T, key string, compat bool) {
+	oldKey, oldCompat := Key, HashCompat
+	Key, HashCompat = &key, &compat
+	t.Cleanup(func() { Key, HashCompat = oldKey, oldCompat })
+}
+
+func newHashRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(GzipDecode(1<<20), HashDecode(`/write`))
+
+	ok := func(c *gin.Context) { c.String(http.StatusOK, `ok`) }
+	r.POST(`/update/`, ok)
+	r.POST(`/write`, ok)
+	r.GET(`/value`, ok)
+
+	return r
+}
+
+func TestHashDecode(t *testing.T) {
+	body := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	legacy := hex.EncodeToString(sign.SealLegacy(`key`, body))
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(body)
+	w.Close()
+	legacyGzip := hex.EncodeToString(sign.SealLegacy(`key`, gz.Bytes()))
+
+	tests := []struct {
+		name    string
+		compat  bool
+		method  string
+		path    string
+		body    []byte
+		headers map[string]string
+		want    int
+	}{
+		{name: `unsigned`, method: http.MethodPost, path: `/update/`, body: body, want: http.StatusBadRequest},
+		{name: `unsigned in compat mode`, compat: true, method: http.MethodPost, path: `/update/`, body: body, want: http.StatusBadRequest},
+		{name: `unsigned without body`, compat: true, method: http.MethodPost, path: `/update/`, want: http.StatusBadRequest},
+		{name: `unsigned read`, method: http.MethodGet, path: `/value`, want: http.StatusOK},
+		{name: `unsigned path`, method: http.MethodPost, path: `/write`, body: body, want: http.StatusOK},
+		{
+			name: `new format`, method: http.MethodPost, path: `/update/`, body: body,
+			headers: map[string]string{
+				sign.HeaderHash:      sign.SumRequest(`key`, now, `nonce-1`, body),
+				sign.HeaderTimestamp: now,
+				sign.HeaderNonce:     `nonce-1`,
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: `new format with wrong key`, method: http.MethodPost, path: `/update/`, body: body,
+			headers: map[string]string{
+				sign.HeaderHash:      sign.SumRequest(`other`, now, `nonce-2`, body),
+				sign.HeaderTimestamp: now,
+				sign.HeaderNonce:     `nonce-2`,
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: `new format without body`, method: http.MethodPost, path: `/update/`,
+			headers: map[string]string{
+				sign.HeaderHash:      sign.SumRequest(`key`, now, `nonce-3`, nil),
+				sign.HeaderTimestamp: now,
+				sign.HeaderNonce:     `nonce-3`,
+			},
+			want: http.StatusOK,
+		},
+		{name: `legacy`, compat: true, method: http.MethodPost, path: `/update/`, body: body, headers: map[string]string{sign.HeaderHash: legacy}, want: http.StatusOK},
+		{name: `legacy without compat`, method: http.MethodPost, path: `/update/`, body: body, headers: map[string]string{sign.HeaderHash: legacy}, want: http.StatusBadRequest},
+		{
+			name: `legacy of compressed body`, compat: true, method: http.MethodPost, path: `/update/`, body: gz.Bytes(),
+			headers: map[string]string{sign.HeaderHash: legacyGzip, `Content-Encoding`: `gzip`},
+			want:    http.StatusOK,
+		},
+		{name: `legacy with wrong key`, compat: true, method: http.MethodPost, path: `/update/`, body: body, headers: map[string]string{sign.HeaderHash: hex.EncodeToString(sign.SealLegacy(`other`, body))}, want: http.StatusBadRequest},
+		{name: `HMAC without timestamp`, compat: true, method: http.MethodPost, path: `/update/`, body: body, headers: map[string]string{sign.HeaderHash: sign.Sum(`key`, body)}, want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setHashFlags(t, `key`, tt.compat)
+			r := newHashRouter()
+
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(tt.body))
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.want, rec.Code)
+			if tt.want == http.StatusOK {
+				assert.Equal(t, sign.Sum(`key`, []byte(`ok`)), rec.Header().Get(sign.HeaderHash))
+			}
+		})
+	}
+}
+
+func TestHashDecodeReplay(t *testing.T) {
+	setHashFlags(t, `key`, false)
+	r := newHashRouter()
+
+	body := []byte(`{}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	send := func() int {
+		req := httptest.NewRequest(http.MethodPost, `/update/`, bytes.NewReader(body))
+		req.Header.Set(sign.HeaderHash, sign.SumRequest(`key`, now, `nonce`, body))
+		req.Header.Set(sign.HeaderTimestamp, now)
+		req.Header.Set(sign.HeaderNonce, `nonce`)
+
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, http.StatusBadRequest, send())
+}
+
+func TestHashDecodeWithoutKey(t *testing.T) {
+	setHashFlags(t, ``, false)
+	r := newHashRouter()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, `/update/`, bytes.NewReader([]byte(`{}`))))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
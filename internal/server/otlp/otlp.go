@@ -0,0 +1,229 @@
+// Package otlp receive metrics by OpenTelemetry protocol
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+)
+
+// Server implements OTLP MetricsService.
+type Server struct {
+	collectorpb.UnimplementedMetricsServiceServer
+	writer *ingest.Writer
+}
+
+// NewServer creates a Server.
+//
+// Parameters:
+//   - w: the writer of samples.
+//
+// Returns:
+//   - *Server: the server.
+func NewServer(w *ingest.Writer) *Server {
+	return &Server{writer: w}
+}
+
+// Export writes data points of the request.
+//
+// Data points which cannot be saved are reported as partial success. If
+// storage fails, Unavailable is returned, so the client retries the request.
+func (s *Server) Export(ctx context.Context, req *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsServiceResponse, error) {
+	samples, rejected := Samples(req)
+
+	written, errs, err := s.writer.Write(ctx, samples)
+	if err != nil {
+		zap.L().Error(`OTLP export failed`, zap.Int(`written`, written), zap.Error(err))
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	rejected += len(errs)
+
+	resp := &collectorpb.ExportMetricsServiceResponse{}
+	if rejected > 0 {
+		msg := fmt.Sprintf(`%d data points rejected`, rejected)
+		if len(errs) > 0 {
+			msg += `: ` + errs[0].Error()
+		}
+
+		zap.L().Warn(`OTLP data points rejected`, zap.Int(`count`, rejected))
+		resp.PartialSuccess = &collectorpb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: int64(rejected),
+			ErrorMessage:       msg,
+		}
+	}
+
+	return resp, nil
+}
+
+// Samples converts metrics of the request into samples.
+//
+// Resource and data point attributes are labels, attributes of data point
+// replace attributes of resource with the same key. Gauges and non-monotonic
+// sums are gauges, monotonic sums are counters. Histograms and summaries are
+// saved as `<name>_count` and `<name>_sum` counters, quantiles of summaries as
+// gauges with `quantile` label. Exponential histograms are not supported.
+//
+// Parameters:
+//   - req: the request.
+//
+// Returns:
+//   - []ingest.Sample: the samples.
+//   - int: the count of data points which are not supported.
+func Samples(req *collectorpb.ExportMetricsServiceRequest) ([]ingest.Sample, int) {
+	var samples []ingest.Sample
+	rejected := 0
+
+	for _, rm := range req.GetResourceMetrics() {
+		resource := attributes(nil, rm.GetResource().GetAttributes())
+
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				name := m.GetName()
+
+				switch data := m.GetData().(type) {
+				case *metricspb.Metric_Gauge:
+					for _, p := range data.Gauge.GetDataPoints() {
+						if noValue(p.GetFlags()) {
+							continue
+						}
+						samples = append(samples, ingest.Sample{
+							Name:   name,
+							Labels: attributes(resource, p.GetAttributes()),
+							Value:  numberValue(p),
+						})
+					}
+
+				case *metricspb.Metric_Sum:
+					counter := data.Sum.GetIsMonotonic()
+					delta := data.Sum.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+
+					for _, p := range data.Sum.GetDataPoints() {
+						if noValue(p.GetFlags()) {
+							continue
+						}
+						samples = append(samples, ingest.Sample{
+							Name:    name,
+							Labels:  attributes(resource, p.GetAttributes()),
+							Value:   numberValue(p),
+							Counter: counter,
+							Delta:   counter && delta,
+						})
+					}
+
+				case *metricspb.Metric_Histogram:
+					delta := data.Histogram.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+
+					for _, p := range data.Histogram.GetDataPoints() {
+						if noValue(p.GetFlags()) {
+							continue
+						}
+						labels := attributes(resource, p.GetAttributes())
+						samples = append(samples, ingest.Sample{
+							Name:    name + `_count`,
+							Labels:  labels,
+							Value:   float64(p.GetCount()),
+							Counter: true,
+							Delta:   delta,
+						})
+						if p.Sum != nil {
+							samples = append(samples, ingest.Sample{
+								Name:    name + `_sum`,
+								Labels:  labels,
+								Value:   p.GetSum(),
+								Counter: true,
+								Delta:   delta,
+							})
+						}
+					}
+
+				case *metricspb.Metric_Summary:
+					for _, p := range data.Summary.GetDataPoints() {
+						if noValue(p.GetFlags()) {
+							continue
+						}
+						labels := attributes(resource, p.GetAttributes())
+						samples = append(samples,
+							ingest.Sample{Name: name + `_count`, Labels: labels, Value: float64(p.GetCount()), Counter: true},
+							ingest.Sample{Name: name + `_sum`, Labels: labels, Value: p.GetSum(), Counter: true},
+						)
+						for _, q := range p.GetQuantileValues() {
+							samples = append(samples, ingest.Sample{
+								Name:   name,
+								Labels: attributes(labels, []*commonpb.KeyValue{stringAttribute(`quantile`, strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64))}),
+								Value:  q.GetValue(),
+							})
+						}
+					}
+
+				case *metricspb.Metric_ExponentialHistogram:
+					rejected += len(data.ExponentialHistogram.GetDataPoints())
+				}
+			}
+		}
+	}
+
+	return samples, rejected
+}
+
+// numberValue returns value of data point as float.
+func numberValue(p *metricspb.NumberDataPoint) float64 {
+	if v, ok := p.GetValue().(*metricspb.NumberDataPoint_AsInt); ok {
+		return float64(v.AsInt)
+	}
+	return p.GetAsDouble()
+}
+
+// noValue checks if data point is marked as not recorded.
+func noValue(flags uint32) bool {
+	return flags&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0
+}
+
+// stringAttribute creates attribute with string value.
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// attributes merges attributes into copy of labels.
+//
+// Only string, bool, int and double values are supported, other values are skipped.
+//
+// Parameters:
+//   - labels: the labels, not changed.
+//   - attrs: the attributes.
+//
+// Returns:
+//   - map[string]string: the merged labels, nil if empty.
+func attributes(labels map[string]string, attrs []*commonpb.KeyValue) map[string]string {
+	if len(labels) == 0 && len(attrs) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]string, len(labels)+len(attrs))
+	for k, v := range labels {
+		merged[k] = v
+	}
+
+	for _, a := range attrs {
+		switch v := a.GetValue().GetValue().(type) {
+		case *commonpb.AnyValue_StringValue:
+			merged[a.GetKey()] = v.StringValue
+		case *commonpb.AnyValue_BoolValue:
+			merged[a.GetKey()] = strconv.FormatBool(v.BoolValue)
+		case *commonpb.AnyValue_IntValue:
+			merged[a.GetKey()] = strconv.FormatInt(v.IntValue, 10)
+		case *commonpb.AnyValue_DoubleValue:
+			merged[a.GetKey()] = strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,119 @@
+package otlp
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository/memory"
+)
+
+func intPoint(v int64, attrs ...*commonpb.KeyValue) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{Attributes: attrs, Value: &metricspb.NumberDataPoint_AsInt{AsInt: v}}
+}
+
+func doublePoint(v float64, attrs ...*commonpb.KeyValue) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{Attributes: attrs, Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: v}}
+}
+
+func request(metrics ...*metricspb.Metric) *collectorpb.ExportMetricsServiceRequest {
+	return &collectorpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				stringAttribute(`service.name`, `api`),
+				stringAttribute(`host`, `a`),
+			}},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+		}},
+	}
+}
+
+func TestSamples(t *testing.T) {
+	sum := 1.5
+	req := request(
+		&metricspb.Metric{Name: `queue`, Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+			DataPoints: []*metricspb.NumberDataPoint{
+				doublePoint(2.5, stringAttribute(`host`, `b`)),
+				{Flags: uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK)},
+			},
+		}}},
+		&metricspb.Metric{Name: `requests`, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			IsMonotonic:            true,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			DataPoints:             []*metricspb.NumberDataPoint{intPoint(10)},
+		}}},
+		&metricspb.Metric{Name: `errors`, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			IsMonotonic:            true,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+			DataPoints:             []*metricspb.NumberDataPoint{intPoint(2)},
+		}}},
+		&metricspb.Metric{Name: `connections`, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			DataPoints: []*metricspb.NumberDataPoint{intPoint(-3)},
+		}}},
+		&metricspb.Metric{Name: `latency`, Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			DataPoints:             []*metricspb.HistogramDataPoint{{Count: 4, Sum: &sum}},
+		}}},
+		&metricspb.Metric{Name: `size`, Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+			DataPoints: []*metricspb.ExponentialHistogramDataPoint{{Count: 1}},
+		}}},
+	)
+
+	resource := map[string]string{`service.name`: `api`, `host`: `a`}
+
+	samples, rejected := Samples(req)
+	assert.Equal(t, 1, rejected)
+	assert.Equal(t, []ingest.Sample{
+		{Name: `queue`, Labels: map[string]string{`service.name`: `api`, `host`: `b`}, Value: 2.5},
+		{Name: `requests`, Labels: resource, Value: 10, Counter: true},
+		{Name: `errors`, Labels: resource, Value: 2, Counter: true, Delta: true},
+		{Name: `connections`, Labels: resource, Value: -3},
+		{Name: `latency_count`, Labels: resource, Value: 4, Counter: true},
+		{Name: `latency_sum`, Labels: resource, Value: 1.5, Counter: true},
+	}, samples)
+}
+
+func TestExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+	s := memory.CreateRepository(memory.Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+	})
+
+	srv := NewServer(ingest.NewWriter(s))
+
+	sum := func(v int64) *metricspb.Metric {
+		return &metricspb.Metric{Name: `requests`, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			IsMonotonic:            true,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			DataPoints:             []*metricspb.NumberDataPoint{intPoint(v)},
+		}}}
+	}
+
+	resp, err := srv.Export(context.Background(), request(sum(10)))
+	require.NoError(t, err)
+	assert.Nil(t, resp.PartialSuccess)
+
+	resp, err = srv.Export(context.Background(), request(sum(15), &metricspb.Metric{
+		Name: `bad`,
+		Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{{}}}},
+	}, &metricspb.Metric{Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{doublePoint(1)}}}}))
+	require.NoError(t, err)
+	require.NotNil(t, resp.PartialSuccess)
+	assert.Equal(t, int64(1), resp.PartialSuccess.RejectedDataPoints)
+
+	v, err := s.GetCounterValue(context.Background(), `requests{host="a",service.name="api"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(15), v)
+}
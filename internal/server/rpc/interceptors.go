@@ -0,0 +1,283 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Jourloy/go-metrics-collector/internal/sign"
+)
+
+const (
+	// HashKey is a metadata key with signature of request or response.
+	HashKey = `hashsha256`
+	// TimestampKey is a metadata key with unix time of request or stream opening.
+	TimestampKey = `x-timestamp`
+	// NonceKey is a metadata key with unique string of request or stream.
+	NonceKey = `x-nonce`
+)
+
+// signatureField is a field of stream messages with their signature.
+const signatureField = `signature`
+
+// signWindow is a max age of signed request or stream opening.
+var signWindow = 5 * time.Minute
+
+// nonceLimit is a max count of remembered nonces of signed requests.
+const nonceLimit = 100_000
+
+var errSignature = status.Error(codes.Unauthenticated, `signature is invalid or not found`)
+var errSubnet = status.Error(codes.PermissionDenied, `peer is not in trusted subnet`)
+
+// UnaryLoggerInterceptor logs method, status and latency of each unary call
+// the same way as middlewares.Logger does for HTTP.
+func UnaryLoggerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		t := time.Now()
+
+		resp, err := handler(ctx, req)
+
+		logCall(info.FullMethod, err, time.Since(t))
+		return resp, err
+	}
+}
+
+// StreamLoggerInterceptor logs method, status and latency of each stream.
+func StreamLoggerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		t := time.Now()
+
+		err := handler(srv, ss)
+
+		logCall(info.FullMethod, err, time.Since(t))
+		return err
+	}
+}
+
+// logCall logs details of finished call.
+func logCall(method string, err error, latency time.Duration) {
+	zap.L().Info(
+		`gRPC`,
+		zap.String(`status`, status.Code(err).String()),
+		zap.String(`method`, method),
+		zap.Duration(`latency`, latency),
+	)
+}
+
+// UnarySubnetInterceptor rejects calls from peers outside the trusted subnet.
+//
+// Parameters:
+//   - subnet: the trusted subnet. If nil, all peers are allowed.
+func UnarySubnetInterceptor(subnet *net.IPNet) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !checkPeer(ctx, subnet) {
+			return nil, errSubnet
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamSubnetInterceptor rejects streams from peers outside the trusted subnet.
+//
+// Parameters:
+//   - subnet: the trusted subnet. If nil, all peers are allowed.
+func StreamSubnetInterceptor(subnet *net.IPNet) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !checkPeer(ss.Context(), subnet) {
+			return errSubnet
+		}
+		return handler(srv, ss)
+	}
+}
+
+// checkPeer checks that address of the peer is in the subnet.
+func checkPeer(ctx context.Context, subnet *net.IPNet) bool {
+	if subnet == nil {
+		return true
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && subnet.Contains(ip)
+}
+
+// isUnsigned checks that method belongs to one of unsigned services.
+//
+// Parameters:
+//   - method: the full method, e.g. `/app.MetricService/UpdateMetrics`.
+//   - unsigned: the full names of services, e.g. `app.MetricService`.
+func isUnsigned(method string, unsigned []string) bool {
+	for _, service := range unsigned {
+		if strings.HasPrefix(method, `/`+service+`/`) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnaryHashInterceptor verifies signature of request from metadata and signs response.
+//
+// Signature is HMAC-SHA256 of timestamp, nonce and deterministic protobuf
+// encoding of the message, see sign.SumRequest. Requests outside of signWindow
+// or with already used nonce are rejected, so requests cannot be replayed.
+//
+// Parameters:
+//   - key: the secret key. If empty, requests are not checked.
+//   - unsigned: the full names of services which are not checked, e.g. OTLP
+//     receiver, whose standard clients can't sign requests.
+func UnaryHashInterceptor(key string, unsigned ...string) grpc.UnaryServerInterceptor {
+	nonces := sign.NewNonceCache(signWindow, nonceLimit)
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if key == `` || isUnsigned(info.FullMethod, unsigned) {
+			return handler(ctx, req)
+		}
+
+		b, err := marshal(req)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		ts := metadataValue(ctx, TimestampKey)
+		nonce := metadataValue(ctx, NonceKey)
+		if !sign.VerifyRequest(key, metadataValue(ctx, HashKey), ts, nonce, b) {
+			return nil, errSignature
+		}
+
+		// Check nonce only for valid signature, so cache cannot be filled by anyone
+		if err := nonces.Check(nonce, ts, time.Now()); err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sign response
+		if b, err := marshal(resp); err == nil {
+			grpc.SetHeader(ctx, metadata.Pairs(HashKey, sign.Sum(key, b)))
+		}
+
+		return resp, nil
+	}
+}
+
+// StreamHashInterceptor verifies signature of stream opening and of each
+// message of stream.
+//
+// Client signs method with timestamp and nonce of stream opening, see
+// sign.SumRequest, so opening cannot be replayed. Messages of stream cannot
+// carry own metadata, so each message has signature in `signature` field,
+// see sign.SumMessage. Message without valid signature ends the stream.
+//
+// Parameters:
+//   - key: the secret key. If empty, streams are not checked.
+//   - unsigned: the full names of services which are not checked.
+func StreamHashInterceptor(key string, unsigned ...string) grpc.StreamServerInterceptor {
+	nonces := sign.NewNonceCache(signWindow, nonceLimit)
+
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if key == `` || isUnsigned(info.FullMethod, unsigned) {
+			return handler(srv, ss)
+		}
+
+		ctx := ss.Context()
+		ts := metadataValue(ctx, TimestampKey)
+		nonce := metadataValue(ctx, NonceKey)
+
+		if !sign.VerifyRequest(key, metadataValue(ctx, HashKey), ts, nonce, []byte(info.FullMethod)) {
+			return errSignature
+		}
+
+		if err := nonces.Check(nonce, ts, time.Now()); err != nil {
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		return handler(srv, &signedServerStream{ServerStream: ss, key: key, ts: ts, nonce: nonce})
+	}
+}
+
+// signedServerStream verifies signature of each received message.
+type signedServerStream struct {
+	grpc.ServerStream
+	key   string
+	ts    string
+	nonce string
+	seq   int64 // Number of the next message
+}
+
+// RecvMsg receives message and verifies its signature.
+func (s *signedServerStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return status.Error(codes.Internal, `message is not protobuf`)
+	}
+
+	field := msg.ProtoReflect().Descriptor().Fields().ByName(signatureField)
+	if field == nil {
+		return status.Error(codes.Unauthenticated, `message of stream cannot be signed`)
+	}
+
+	// Signature is made for message without signature
+	signature := msg.ProtoReflect().Get(field).String()
+	msg.ProtoReflect().Clear(field)
+
+	b, err := marshal(msg)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if !sign.VerifyMessage(s.key, signature, s.ts, s.nonce, s.seq, b) {
+		return errSignature
+	}
+	s.seq++
+
+	return nil
+}
+
+// metadataValue returns first value of the incoming metadata key.
+func metadataValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ``
+	}
+
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ``
+	}
+
+	return values[0]
+}
+
+// marshal encodes message deterministically, so signatures are stable.
+func marshal(m any) ([]byte, error) {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return nil, status.Error(codes.Internal, `message is not protobuf`)
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+}
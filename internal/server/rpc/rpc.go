@@ -1,31 +1,329 @@
+// Package rpc provide gRPC service for update metrics
 package rpc
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/Jourloy/go-metrics-collector/internal/proto"
 	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
 )
 
+var errStorage = status.Error(codes.Internal, `storage not initialized`)
+var errName = status.Error(codes.InvalidArgument, `name is invalid or not found`)
+var errType = errors.New(`type is invalid or not found`)
+var errNotFound = status.Error(codes.NotFound, `metric not found`)
+
 type MetricServer struct {
 	proto.UnimplementedMetricServiceServer
 	storage storage.Storage
 }
 
+// CreateMetricServer returns gRPC service which works with the given storage.
+//
+// Parameters:
+//   - s: the storage instance, the same as used by HTTP handlers.
+//
+// Returns:
+//   - *MetricServer: a pointer to the initialized MetricServer.
+func CreateMetricServer(s storage.Storage) *MetricServer {
+	return &MetricServer{
+		storage: s,
+	}
+}
+
+// UpdateCounter adds value to the counter metric.
 func (s *MetricServer) UpdateCounter(ctx context.Context, in *proto.UpdateCounterRequest) (*proto.UpdateResponse, error) {
 	var response proto.UpdateResponse
 
+	// Check storage
+	if !s.checkStorage() {
+		return nil, errStorage
+	}
+
+	// Check name
+	if in.Name == `` {
+		return nil, errName
+	}
+	if err := storage.CheckSeries(in.Name, in.Labels); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	// Update metric
-	s.storage.UpdateCounterMetric(in.Name, in.Value)
+	if _, err := s.storage.UpdateCounterMetric(ctx, storage.SeriesKey(in.Name, in.Labels), in.Value); err != nil {
+		return nil, storageStatus(err)
+	}
 
 	return &response, nil
 }
 
+// UpdateGauge sets value of the gauge metric.
 func (s *MetricServer) UpdateGauge(ctx context.Context, in *proto.UpdateGaugeRequest) (*proto.UpdateResponse, error) {
 	var response proto.UpdateResponse
 
+	// Check storage
+	if !s.checkStorage() {
+		return nil, errStorage
+	}
+
+	// Check name
+	if in.Name == `` {
+		return nil, errName
+	}
+	if err := storage.CheckSeries(in.Name, in.Labels); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	// Update metric
-	s.storage.UpdateGaugeMetric(in.Name, in.Value)
+	if _, err := s.storage.UpdateGaugeMetric(ctx, storage.SeriesKey(in.Name, in.Labels), in.Value); err != nil {
+		return nil, storageStatus(err)
+	}
 
 	return &response, nil
 }
+
+// UpdateMetrics updates batch of metrics.
+//
+// The batch is validated before any metric is written, so it applies either
+// fully or not at all. If some metrics are invalid, InvalidArgument is returned.
+func (s *MetricServer) UpdateMetrics(ctx context.Context, in *proto.UpdateMetricsRequest) (*proto.UpdateMetricsResponse, error) {
+	// Check storage
+	if !s.checkStorage() {
+		return nil, errStorage
+	}
+
+	updated, err := s.updateBatch(ctx, in.Metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.UpdateMetricsResponse{
+		Metrics: updated,
+	}, nil
+}
+
+// StreamMetrics receives batches of metrics until client closes the stream.
+//
+// Each batch is applied the same way as in UpdateMetrics and acknowledged
+// after it is saved, so client may consider batch delivered only after ack.
+// The first invalid batch terminates the stream with InvalidArgument, the
+// first error of storage with Unavailable.
+func (s *MetricServer) StreamMetrics(stream proto.MetricService_StreamMetricsServer) error {
+	// Check storage
+	if !s.checkStorage() {
+		return errStorage
+	}
+
+	var batches int64
+
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		updated, err := s.updateBatch(stream.Context(), in.Metrics)
+		if err != nil {
+			return err
+		}
+
+		batches++
+		if err := stream.Send(&proto.StreamMetricsResponse{
+			Batches: batches,
+			Metrics: int64(len(updated)),
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// GetMetric returns current value of the metric.
+//
+// Labels of request are a filter, see storage.FindCounter. If labels match
+// several metrics, InvalidArgument is returned.
+func (s *MetricServer) GetMetric(ctx context.Context, in *proto.GetMetricRequest) (*proto.Metric, error) {
+	// Check storage
+	if !s.checkStorage() {
+		return nil, errStorage
+	}
+
+	metric := &proto.Metric{
+		Id:   in.Id,
+		Type: in.Type,
+	}
+
+	var key string
+	var err error
+	switch in.Type {
+	case proto.MetricType_COUNTER:
+		key, metric.Delta, err = storage.FindCounter(ctx, s.storage, in.Id, in.Labels)
+	case proto.MetricType_GAUGE:
+		key, metric.Value, err = storage.FindGauge(ctx, s.storage, in.Id, in.Labels)
+	default:
+		return nil, status.Error(codes.InvalidArgument, errType.Error())
+	}
+
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return nil, errNotFound
+	case errors.Is(err, storage.ErrAmbiguous):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case err != nil:
+		return nil, storageStatus(err)
+	}
+
+	_, metric.Labels, _ = storage.ParseSeriesKey(key)
+
+	return metric, nil
+}
+
+// ListMetrics returns all metrics sorted by type and name.
+func (s *MetricServer) ListMetrics(ctx context.Context, in *proto.ListMetricsRequest) (*proto.ListMetricsResponse, error) {
+	// Check storage
+	if !s.checkStorage() {
+		return nil, errStorage
+	}
+
+	gauge, counter, err := s.storage.GetValues(ctx)
+	if err != nil {
+		return nil, storageStatus(err)
+	}
+
+	metrics := make([]*proto.Metric, 0, len(gauge)+len(counter))
+	for key, value := range counter {
+		metrics = append(metrics, seriesMetric(key, &proto.Metric{Type: proto.MetricType_COUNTER, Delta: value}))
+	}
+	for key, value := range gauge {
+		metrics = append(metrics, seriesMetric(key, &proto.Metric{Type: proto.MetricType_GAUGE, Value: value}))
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Type != metrics[j].Type {
+			return metrics[i].Type < metrics[j].Type
+		}
+		if metrics[i].Id != metrics[j].Id {
+			return metrics[i].Id < metrics[j].Id
+		}
+		return storage.SeriesKey(``, metrics[i].Labels) < storage.SeriesKey(``, metrics[j].Labels)
+	})
+
+	return &proto.ListMetricsResponse{
+		Metrics: metrics,
+	}, nil
+}
+
+// updateBatch validates all metrics and then updates them.
+//
+// Parameters:
+//   - ctx: the context of request.
+//   - metrics: the batch of metrics.
+//
+// Returns:
+//   - []*proto.Metric: metrics with updated values.
+//   - error: InvalidArgument status with description of every invalid metric
+//     or status of storage error.
+func (s *MetricServer) updateBatch(ctx context.Context, metrics []*proto.Metric) ([]*proto.Metric, error) {
+	// Validate whole batch before update
+	var invalid []string
+	for i, m := range metrics {
+		if err := validateMetric(m); err != nil {
+			invalid = append(invalid, fmt.Sprintf(`%d (%s): %s`, i, m.GetId(), err))
+		}
+	}
+
+	if len(invalid) > 0 {
+		zap.L().Error(`Batch rejected`, zap.Int(`invalid`, len(invalid)), zap.Int(`total`, len(metrics)))
+		return nil, status.Errorf(codes.InvalidArgument, `invalid metrics: %s`, strings.Join(invalid, `; `))
+	}
+
+	batch := make([]storage.Metric, len(metrics))
+	for i, m := range metrics {
+		batch[i] = storage.Metric{Name: storage.SeriesKey(m.Id, m.Labels)}
+		switch m.Type {
+		case proto.MetricType_COUNTER:
+			batch[i].MType, batch[i].Delta = `counter`, m.Delta
+		case proto.MetricType_GAUGE:
+			batch[i].MType, batch[i].Value = `gauge`, m.Value
+		}
+	}
+
+	result, err := s.storage.UpdateBatch(ctx, batch)
+	if err != nil {
+		return nil, storageStatus(err)
+	}
+
+	updated := make([]*proto.Metric, len(metrics))
+	for i, m := range metrics {
+		updated[i] = &proto.Metric{
+			Id:     m.Id,
+			Type:   m.Type,
+			Labels: m.Labels,
+			Delta:  result[i].Delta,
+			Value:  result[i].Value,
+		}
+	}
+
+	return updated, nil
+}
+
+// storageStatus converts error of storage into gRPC status.
+//
+// Cancellation and timeout of request keep their codes, other errors are
+// Unavailable, so clients retry the request later.
+func storageStatus(err error) error {
+	zap.L().Error(`Storage error`, zap.Error(err))
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+// validateMetric checks that metric has name and known type.
+func validateMetric(m *proto.Metric) error {
+	if m == nil || m.Id == `` {
+		return errors.New(`name is invalid or not found`)
+	}
+
+	if err := storage.CheckSeries(m.Id, m.Labels); err != nil {
+		return err
+	}
+
+	if m.Type != proto.MetricType_COUNTER && m.Type != proto.MetricType_GAUGE {
+		return errType
+	}
+
+	return nil
+}
+
+// seriesMetric sets name and labels of metric from key of metric in storage.
+func seriesMetric(key string, m *proto.Metric) *proto.Metric {
+	name, labels, err := storage.ParseSeriesKey(key)
+	if err != nil {
+		name, labels = key, nil
+	}
+
+	m.Id = name
+	m.Labels = labels
+	return m
+}
+
+// checkStorage checks if the storage is initialized.
+func (s *MetricServer) checkStorage() bool {
+	if s.storage == nil {
+		zap.L().Error(`storage not initialized`)
+		return false
+	}
+	return true
+}
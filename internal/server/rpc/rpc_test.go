@@ -0,0 +1,428 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Jourloy/go-metrics-collector/internal/proto"
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
+	"github.com/Jourloy/go-metrics-collector/internal/server/otlp"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository/memory"
+	"github.com/Jourloy/go-metrics-collector/internal/sign"
+)
+
+// startServer starts MetricServer over in-process listener and returns client for it.
+func startServer(t *testing.T, s storage.Storage) proto.MetricServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+
+	srv := grpc.NewServer()
+	proto.RegisterMetricServiceServer(srv, CreateMetricServer(s))
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(`bufnet`,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return proto.NewMetricServiceClient(conn)
+}
+
+// createStorage creates memory storage which doesn't touch shared files.
+func createStorage(t *testing.T) *memory.MemStorage {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+
+	return memory.CreateRepository(memory.Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+	})
+}
+
+func TestMetricServer(t *testing.T) {
+	s := createStorage(t)
+	client := startServer(t, s)
+	ctx := context.Background()
+
+	_, err := client.UpdateGauge(ctx, &proto.UpdateGaugeRequest{Name: `Alloc`, Value: 1.5})
+	require.NoError(t, err)
+
+	_, err = client.UpdateCounter(ctx, &proto.UpdateCounterRequest{Name: `PollCount`, Value: 2})
+	require.NoError(t, err)
+	_, err = client.UpdateCounter(ctx, &proto.UpdateCounterRequest{Name: `PollCount`, Value: 3})
+	require.NoError(t, err)
+
+	gauge, err := s.GetGaugeValue(context.Background(), `Alloc`)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, gauge)
+
+	counter, err := s.GetCounterValue(context.Background(), `PollCount`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), counter)
+
+	_, err = client.UpdateGauge(ctx, &proto.UpdateGaugeRequest{Value: 1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestMetricServerWithoutStorage(t *testing.T) {
+	client := startServer(t, nil)
+
+	_, err := client.UpdateGauge(context.Background(), &proto.UpdateGaugeRequest{Name: `Alloc`, Value: 1})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+// failingStorage returns err from all methods.
+type failingStorage struct {
+	*memory.MemStorage
+	err error
+}
+
+func (s failingStorage) UpdateGaugeMetric(context.Context, string, float64) (float64, error) {
+	return 0, s.err
+}
+
+func (s failingStorage) UpdateBatch(context.Context, []storage.Metric) ([]storage.Metric, error) {
+	return nil, s.err
+}
+
+func (s failingStorage) GetValues(context.Context) (map[string]float64, map[string]int64, error) {
+	return nil, nil, s.err
+}
+
+func (s failingStorage) GetGaugeValue(context.Context, string) (float64, error) {
+	return 0, s.err
+}
+
+func TestMetricServerStorageErrors(t *testing.T) {
+	client := startServer(t, failingStorage{MemStorage: createStorage(t), err: errors.New(`connection refused`)})
+	ctx := context.Background()
+
+	_, err := client.UpdateGauge(ctx, &proto.UpdateGaugeRequest{Name: `Alloc`, Value: 1})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = client.UpdateMetrics(ctx, &proto.UpdateMetricsRequest{Metrics: []*proto.Metric{
+		{Id: `Alloc`, Type: proto.MetricType_GAUGE, Value: 1},
+	}})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = client.GetMetric(ctx, &proto.GetMetricRequest{Id: `Alloc`, Type: proto.MetricType_GAUGE})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = client.ListMetrics(ctx, &proto.ListMetricsRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// Timeout of query keeps its code
+	client = startServer(t, failingStorage{MemStorage: createStorage(t), err: context.DeadlineExceeded})
+
+	_, err = client.UpdateGauge(ctx, &proto.UpdateGaugeRequest{Name: `Alloc`, Value: 1})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func TestMetricServerBatch(t *testing.T) {
+	s := createStorage(t)
+	client := startServer(t, s)
+	ctx := context.Background()
+
+	// Invalid batch is not applied
+	_, err := client.UpdateMetrics(ctx, &proto.UpdateMetricsRequest{Metrics: []*proto.Metric{
+		{Id: `Batch`, Type: proto.MetricType_COUNTER, Delta: 1},
+		{Id: `Batch`},
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.GetMetric(ctx, &proto.GetMetricRequest{Id: `Batch`, Type: proto.MetricType_COUNTER})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Valid batch
+	res, err := client.UpdateMetrics(ctx, &proto.UpdateMetricsRequest{Metrics: []*proto.Metric{
+		{Id: `Batch`, Type: proto.MetricType_COUNTER, Delta: 1},
+		{Id: `Batch`, Type: proto.MetricType_GAUGE, Value: 0.5},
+	}})
+	require.NoError(t, err)
+	assert.Len(t, res.Metrics, 2)
+
+	// Stream
+	stream, err := client.StreamMetrics(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, stream.Send(&proto.UpdateMetricsRequest{Metrics: []*proto.Metric{
+			{Id: `Batch`, Type: proto.MetricType_COUNTER, Delta: 2},
+		}}))
+
+		ack, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, int64(i+1), ack.Batches)
+		assert.Equal(t, int64(1), ack.Metrics)
+	}
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+
+	// Read
+	metric, err := client.GetMetric(ctx, &proto.GetMetricRequest{Id: `Batch`, Type: proto.MetricType_COUNTER})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), metric.Delta)
+
+	list, err := client.ListMetrics(ctx, &proto.ListMetricsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Metrics, 2)
+	assert.Equal(t, proto.MetricType_GAUGE, list.Metrics[0].Type)
+	assert.Equal(t, 0.5, list.Metrics[0].Value)
+}
+
+func TestMetricServerLabels(t *testing.T) {
+	s := createStorage(t)
+	client := startServer(t, s)
+	ctx := context.Background()
+
+	_, err := client.UpdateMetrics(ctx, &proto.UpdateMetricsRequest{Metrics: []*proto.Metric{
+		{Id: `CPU`, Type: proto.MetricType_GAUGE, Value: 25, Labels: map[string]string{`host`: `a`}},
+		{Id: `CPU`, Type: proto.MetricType_GAUGE, Value: 30, Labels: map[string]string{`host`: `a`, `cpu`: `1`}},
+	}})
+	require.NoError(t, err)
+
+	v, err := s.GetGaugeValue(context.Background(), `CPU{cpu="1",host="a"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 30.0, v)
+
+	// Metric with the least count of labels
+	metric, err := client.GetMetric(ctx, &proto.GetMetricRequest{Id: `CPU`, Type: proto.MetricType_GAUGE})
+	require.NoError(t, err)
+	assert.Equal(t, 25.0, metric.Value)
+	assert.Equal(t, map[string]string{`host`: `a`}, metric.Labels)
+
+	metric, err = client.GetMetric(ctx, &proto.GetMetricRequest{Id: `CPU`, Type: proto.MetricType_GAUGE, Labels: map[string]string{`cpu`: `1`}})
+	require.NoError(t, err)
+	assert.Equal(t, 30.0, metric.Value)
+
+	list, err := client.ListMetrics(ctx, &proto.ListMetricsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Metrics, 2)
+	assert.Equal(t, `CPU`, list.Metrics[0].Id)
+	assert.Equal(t, map[string]string{`host`: `a`, `cpu`: `1`}, list.Metrics[0].Labels)
+
+	_, err = client.UpdateGauge(ctx, &proto.UpdateGaugeRequest{Name: `CPU`, Value: 1, Labels: map[string]string{`a,b`: `c`}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestSubnetInterceptor(t *testing.T) {
+	_, subnet, err := net.ParseCIDR(`127.0.0.0/8`)
+	require.NoError(t, err)
+
+	listener := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(UnarySubnetInterceptor(subnet)))
+	proto.RegisterMetricServiceServer(srv, CreateMetricServer(createStorage(t)))
+	go srv.Serve(listener)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(`bufnet`,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// In-process listener has no IP address, so peer is not trusted
+	_, err = proto.NewMetricServiceClient(conn).ListMetrics(context.Background(), &proto.ListMetricsRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// startHashServer starts MetricServer with hash interceptors and returns
+// client without them, so tests make signatures themselves.
+func startHashServer(t *testing.T, key string) proto.MetricServiceClient {
+	_, conn := startHashConn(t, key)
+	return proto.NewMetricServiceClient(conn)
+}
+
+// startHashConn starts MetricServer and OTLP receiver with the given key,
+// OTLP receiver is not signed. Returns storage and connection to the server.
+func startHashConn(t *testing.T, key string) (*memory.MemStorage, *grpc.ClientConn) {
+	listener := bufconn.Listen(1024 * 1024)
+
+	otlpService := collectorpb.MetricsService_ServiceDesc.ServiceName
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryHashInterceptor(key, otlpService)),
+		grpc.StreamInterceptor(StreamHashInterceptor(key, otlpService)),
+	)
+	s := createStorage(t)
+	proto.RegisterMetricServiceServer(srv, CreateMetricServer(s))
+	collectorpb.RegisterMetricsServiceServer(srv, otlp.NewServer(ingest.NewWriter(s)))
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(`bufnet`,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return s, conn
+}
+
+func TestUnsignedOTLP(t *testing.T) {
+	s, conn := startHashConn(t, `secret`)
+
+	// Standard exporter doesn't sign requests
+	_, err := collectorpb.NewMetricsServiceClient(conn).Export(context.Background(), &collectorpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Metrics: []*metricspb.Metric{{
+					Name: `queue`,
+					Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+						DataPoints: []*metricspb.NumberDataPoint{{Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 7}}},
+					}},
+				}},
+			}},
+		}},
+	})
+	require.NoError(t, err)
+
+	value, err := s.GetGaugeValue(context.Background(), `queue`)
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, value)
+
+	// Other services still require signature
+	metric, err := proto.NewMetricServiceClient(conn).GetMetric(context.Background(), &proto.GetMetricRequest{Id: `queue`, Type: proto.MetricType_GAUGE})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Nil(t, metric)
+}
+
+func TestUnaryHashInterceptor(t *testing.T) {
+	client := startHashServer(t, `secret`)
+
+	req := &proto.UpdateMetricsRequest{Metrics: []*proto.Metric{{Id: `Alloc`, Type: proto.MetricType_GAUGE, Value: 1}}}
+	b, err := marshal(req)
+	require.NoError(t, err)
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := metadata.AppendToOutgoingContext(context.Background(),
+		TimestampKey, ts,
+		NonceKey, `nonce`,
+		HashKey, sign.SumRequest(`secret`, ts, `nonce`, b),
+	)
+
+	_, err = client.UpdateMetrics(signed, req)
+	assert.NoError(t, err)
+
+	// Captured request is not accepted again
+	_, err = client.UpdateMetrics(signed, req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.UpdateMetrics(context.Background(), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Signature without timestamp and nonce
+	_, err = client.UpdateMetrics(metadata.AppendToOutgoingContext(context.Background(), HashKey, sign.Sum(`secret`, b)), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Old timestamp
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	_, err = client.UpdateMetrics(metadata.AppendToOutgoingContext(context.Background(),
+		TimestampKey, old,
+		NonceKey, `other`,
+		HashKey, sign.SumRequest(`secret`, old, `other`, b),
+	), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestStreamHashInterceptor(t *testing.T) {
+	client := startHashServer(t, `secret`)
+
+	method := proto.MetricService_StreamMetrics_FullMethodName
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	open := func(nonce string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(),
+			TimestampKey, ts,
+			NonceKey, nonce,
+			HashKey, sign.SumRequest(`secret`, ts, nonce, []byte(method)),
+		)
+	}
+
+	// message returns batch signed as seq-th message of stream
+	message := func(nonce string, seq int64, delta int64) *proto.UpdateMetricsRequest {
+		req := &proto.UpdateMetricsRequest{Metrics: []*proto.Metric{{Id: `PollCount`, Type: proto.MetricType_COUNTER, Delta: delta}}}
+		b, err := marshal(req)
+		require.NoError(t, err)
+		req.Signature = sign.SumMessage(`secret`, ts, nonce, seq, b)
+		return req
+	}
+
+	tests := []struct {
+		name     string
+		messages func() []*proto.UpdateMetricsRequest
+		want     codes.Code
+	}{
+		{name: `signed messages`, want: codes.OK, messages: func() []*proto.UpdateMetricsRequest {
+			return []*proto.UpdateMetricsRequest{message(`stream-1`, 0, 1), message(`stream-1`, 1, 2)}
+		}},
+		{name: `unsigned message`, want: codes.Unauthenticated, messages: func() []*proto.UpdateMetricsRequest {
+			return []*proto.UpdateMetricsRequest{message(`stream-2`, 0, 1), {Metrics: []*proto.Metric{{Id: `PollCount`, Type: proto.MetricType_COUNTER, Delta: 100}}}}
+		}},
+		{name: `replayed message`, want: codes.Unauthenticated, messages: func() []*proto.UpdateMetricsRequest {
+			m := message(`stream-3`, 0, 1)
+			return []*proto.UpdateMetricsRequest{m, m}
+		}},
+		{name: `message of other stream`, want: codes.Unauthenticated, messages: func() []*proto.UpdateMetricsRequest {
+			return []*proto.UpdateMetricsRequest{message(`stream-1`, 0, 1)}
+		}},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := client.StreamMetrics(open(`stream-` + strconv.Itoa(i+1)))
+			require.NoError(t, err)
+
+			// Status of rejected stream is returned by Recv, even if Send failed
+			for _, m := range tt.messages() {
+				stream.Send(m)
+				if _, err = stream.Recv(); err != nil {
+					break
+				}
+			}
+
+			if err == nil {
+				stream.CloseSend()
+				if _, err = stream.Recv(); err == io.EOF {
+					err = nil
+				}
+			}
+			assert.Equal(t, tt.want, status.Code(err))
+		})
+	}
+
+	// Captured opening of stream is not accepted again
+	stream, err := client.StreamMetrics(open(`stream-1`))
+	require.NoError(t, err)
+	stream.CloseSend()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
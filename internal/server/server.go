@@ -4,9 +4,9 @@ package server
 
 import (
 	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"io"
 	"log"
 	"net"
@@ -19,11 +19,19 @@ import (
 	limit "github.com/bu/gin-access-limit"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
 
+	"github.com/Jourloy/go-metrics-collector/internal/encrypt"
 	"github.com/Jourloy/go-metrics-collector/internal/proto"
+	"github.com/Jourloy/go-metrics-collector/internal/server/app"
+	"github.com/Jourloy/go-metrics-collector/internal/server/graphite"
 	"github.com/Jourloy/go-metrics-collector/internal/server/handlers"
+	"github.com/Jourloy/go-metrics-collector/internal/server/influx"
+	"github.com/Jourloy/go-metrics-collector/internal/server/ingest"
 	"github.com/Jourloy/go-metrics-collector/internal/server/middlewares"
+	"github.com/Jourloy/go-metrics-collector/internal/server/otlp"
 	"github.com/Jourloy/go-metrics-collector/internal/server/rpc"
 	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
 	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository"
@@ -33,6 +41,8 @@ var (
 	Host          = flag.String(`a`, `localhost:8080`, `Host of the server`)
 	Key           = flag.String(`key`, ``, `Key for cipher`)
 	TrustedSubnet = flag.String(`t`, ``, `CIDR`)
+	GRPCAddress   = flag.String(`g`, `:3200`, `Host of the gRPC server`)
+	CryptoKey     = flag.String(`crypto-key`, ``, `Path to private key for decryption`)
 )
 
 type ServerConfig struct {
@@ -43,6 +53,12 @@ type ServerConfig struct {
 	DatabaseDSN   string `json:"database_dsn"`
 	CryptoKey     string `json:"crypto_key"`
 	TrustedSubnet string `json:"trusted_subnet"`
+	GRPCAddress   string `json:"grpc_address"`
+	InfluxUDP     string `json:"influx_udp_address"`
+	InfluxCounter string `json:"influx_counters"`
+	Graphite      string `json:"graphite_address"`
+	MaxBodySize   int64  `json:"max_body_size"`
+	Unsigned      bool   `json:"unsigned_receivers"`
 }
 
 func readConfig() {
@@ -58,6 +74,34 @@ func readConfig() {
 
 		Host = &config.Address
 		TrustedSubnet = &config.TrustedSubnet
+
+		if config.GRPCAddress != `` {
+			GRPCAddress = &config.GRPCAddress
+		}
+
+		if config.CryptoKey != `` {
+			CryptoKey = &config.CryptoKey
+		}
+
+		if config.InfluxUDP != `` {
+			influx.UDPAddress = &config.InfluxUDP
+		}
+
+		if config.InfluxCounter != `` {
+			influx.Counters = &config.InfluxCounter
+		}
+
+		if config.Graphite != `` {
+			graphite.Address = &config.Graphite
+		}
+
+		if config.MaxBodySize != 0 {
+			app.MaxBodySize = &config.MaxBodySize
+		}
+
+		if config.Unsigned {
+			middlewares.UnsignedReceivers = &config.Unsigned
+		}
 	}
 }
 
@@ -66,24 +110,64 @@ func Start() {
 	readConfig()
 	flag.Parse()
 
+	// Check if CRYPTO_KEY environment variable is set and assign it to CryptoKey
+	if keyENV, exist := os.LookupEnv(`CRYPTO_KEY`); exist {
+		CryptoKey = &keyENV
+	}
+
+	// Load private key for decryption
+	var privateKey *rsa.PrivateKey
+	if *CryptoKey != `` {
+		key, err := encrypt.LoadPrivateKey(*CryptoKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		privateKey = key
+	}
+
+	// Receivers of external protocols are signed as other requests, unless
+	// it is explicitly disabled
+	middlewares.ParseEnv()
+	var unsignedPaths []string
+	if *middlewares.Key != `` && *middlewares.UnsignedReceivers {
+		zap.L().Warn(`Receivers of Prometheus, InfluxDB and OpenTelemetry accept requests without signature`)
+		unsignedPaths = handlers.UnsignedPaths
+	}
+
 	// Initiate handlers
+	app.ParseEnv()
 	r := gin.New()
 
 	// Set middlewares
-	r.Use(gin.Recovery())           // 500 instead of panic
-	r.Use(middlewares.Logger())     // Logger
-	r.Use(middlewares.GzipDecode()) // Gzip
-	r.Use(middlewares.HashDecode()) // Hash
+	r.Use(gin.Recovery())                                    // 500 instead of panic
+	r.Use(middlewares.Logger())                              // Logger
+	r.Use(middlewares.Decrypt(privateKey, *app.MaxBodySize)) // Encryption
+	r.Use(middlewares.GzipDecode(*app.MaxBodySize))          // Gzip
+	r.Use(middlewares.HashDecode(unsignedPaths...))          // Hash
 
 	if *TrustedSubnet != `` {
 		r.Use(limit.CIDR(*TrustedSubnet))
 	}
 
+	// Listeners of other protocols check peers themselves
+	var subnet *net.IPNet
+	if *TrustedSubnet != `` {
+		var err error
+		if _, subnet, err = net.ParseCIDR(*TrustedSubnet); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Check if ADDRESS environment variable is set and assign it to Host
 	if hostENV, exist := os.LookupEnv(`ADDRESS`); exist {
 		Host = &hostENV
 	}
 
+	// Check if GRPC_ADDRESS environment variable is set and assign it to GRPCAddress
+	if grpcENV, exist := os.LookupEnv(`GRPC_ADDRESS`); exist {
+		GRPCAddress = &grpcENV
+	}
+
 	// Create storage
 	//
 	// If postgres DSN is set and not valid, ok will be false. In that case,
@@ -103,9 +187,14 @@ func Start() {
 	appGroup := r.Group(`/`)
 
 	// Register application, collector, and value handlers
-	handlers.RegisterAppHandler(appGroup, s)
+	// Receivers of all protocols share one writer, so counter sent by several
+	// of them has one baseline
+	w := ingest.NewWriter(s)
+	handlers.RegisterAppHandler(appGroup, s, w)
 
-	go startGRPC()
+	grpcServer := startGRPC(s, w, subnet)
+	influxListener := startInfluxUDP(s, w, subnet)
+	graphiteServer := startGraphite(s, w, subnet)
 
 	srv := &http.Server{
 		Addr:    *Host,
@@ -122,8 +211,18 @@ func Start() {
 	<-quit
 	log.Println("Shutdown Server ...")
 
+	stopGRPC(grpcServer, 5*time.Second)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	if influxListener != nil {
+		influxListener.Close()
+	}
+	if graphiteServer != nil {
+		if err := graphiteServer.Shutdown(ctx); err != nil {
+			zap.L().Warn(`Graphite connections closed by timeout`, zap.Error(err))
+		}
+	}
 	if err := srv.Shutdown(ctx); err != nil {
 		panic(err)
 	}
@@ -132,19 +231,135 @@ func Start() {
 	log.Println("Server exiting")
 }
 
-func startGRPC() {
-	listen, err := net.Listen("tcp", ":3200")
+// stopGRPC stops gRPC server gracefully. Streams of agents are not finished
+// by themselves, so connections are closed after timeout.
+//
+// Parameters:
+//   - srv: the server.
+//   - timeout: the max duration of graceful stop.
+func stopGRPC(srv *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		zap.L().Warn(`gRPC connections closed by timeout`)
+		srv.Stop()
+	}
+}
+
+// startGRPC starts gRPC server on GRPCAddress in background.
+//
+// Parameters:
+//   - s: the storage, the same as used by HTTP handlers.
+//   - w: the writer of samples, the same as used by HTTP handlers.
+//   - subnet: the trusted subnet, nil if not set.
+//
+// Returns:
+//   - *grpc.Server: the started server.
+func startGRPC(s storage.Storage, w *ingest.Writer, subnet *net.IPNet) *grpc.Server {
+	listen, err := net.Listen(`tcp`, *GRPCAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Set interceptors in the same order as HTTP middlewares. Standard OTLP
+	// exporters can't sign requests, so with unsigned receivers OTLP receiver
+	// is not signed as its HTTP endpoint.
+	var unsigned []string
+	if *middlewares.UnsignedReceivers {
+		unsigned = append(unsigned, collectorpb.MetricsService_ServiceDesc.ServiceName)
+	}
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			rpc.UnaryLoggerInterceptor(),
+			rpc.UnarySubnetInterceptor(subnet),
+			rpc.UnaryHashInterceptor(*middlewares.Key, unsigned...),
+		),
+		grpc.ChainStreamInterceptor(
+			rpc.StreamLoggerInterceptor(),
+			rpc.StreamSubnetInterceptor(subnet),
+			rpc.StreamHashInterceptor(*middlewares.Key, unsigned...),
+		),
+	)
+	proto.RegisterMetricServiceServer(srv, rpc.CreateMetricServer(s))
+
+	// OTLP receiver needs storage, without it clients get Unimplemented
+	if s != nil {
+		collectorpb.RegisterMetricsServiceServer(srv, otlp.NewServer(w))
+	}
+
+	go func() {
+		zap.L().Info(`gRPC server started`, zap.String(`address`, *GRPCAddress))
+		if err := srv.Serve(listen); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	return srv
+}
+
+// startInfluxUDP starts UDP listener of InfluxDB line protocol if address is set.
+//
+// Parameters:
+//   - s: the storage, the same as used by HTTP handlers.
+//   - w: the writer of samples, the same as used by HTTP handlers.
+//   - subnet: the trusted subnet, nil if not set.
+//
+// Returns:
+//   - *influx.Listener: the started listener, nil if disabled.
+func startInfluxUDP(s storage.Storage, w *ingest.Writer, subnet *net.IPNet) *influx.Listener {
+	influx.ParseEnv()
+	if *influx.UDPAddress == `` {
+		return nil
+	}
+
+	if s == nil {
+		zap.L().Error(`InfluxDB UDP listener is not started, storage not initialized`)
+		return nil
+	}
+
+	rules, err := influx.ParseRules(*influx.Counters)
 	if err != nil {
 		log.Fatal(err)
 	}
-	// создаём gRPC-сервер без зарегистрированной службы
-	s := grpc.NewServer()
-	// регистрируем сервис
-	proto.RegisterMetricServiceServer(s, &rpc.MetricServer{})
 
-	fmt.Println("Сервер gRPC начал работу")
-	// получаем запрос gRPC
-	if err := s.Serve(listen); err != nil {
+	l, err := influx.ListenUDP(*influx.UDPAddress, w, rules, subnet)
+	if err != nil {
 		log.Fatal(err)
 	}
+
+	return l
+}
+
+// startGraphite starts TCP listener of Graphite plaintext protocol if address is set.
+//
+// Parameters:
+//   - s: the storage, the same as used by HTTP handlers.
+//   - w: the writer of samples, the same as used by HTTP handlers.
+//   - subnet: the trusted subnet, nil if not set.
+//
+// Returns:
+//   - *graphite.Server: the started server, nil if disabled.
+func startGraphite(s storage.Storage, w *ingest.Writer, subnet *net.IPNet) *graphite.Server {
+	graphite.ParseEnv()
+	if *graphite.Address == `` {
+		return nil
+	}
+
+	if s == nil {
+		zap.L().Error(`Graphite listener is not started, storage not initialized`)
+		return nil
+	}
+
+	srv, err := graphite.Listen(*graphite.Address, w, subnet)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return srv
 }
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Aggregations of values in bucket.
+const (
+	AggLast = `last` // The last value
+	AggMin  = `min`  // The minimum value
+	AggMax  = `max`  // The maximum value
+	AggAvg  = `avg`  // The average of values, of increments for counters
+	AggSum  = `sum`  // The sum of increments of counter
+)
+
+var errAggregation = errors.New(`unsupported aggregation`)
+
+// Point is a value of metric at a time.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// Bucket is an aggregate of values of metric in [Time, Time+resolution).
+//
+// Raw value is a bucket with Count = 1. Sum of gauge is the sum of values,
+// Sum of counter is the sum of increments, because values of counters are
+// cumulative.
+type Bucket struct {
+	Time  time.Time
+	Count int64
+	Min   float64
+	Max   float64
+	Sum   float64
+	Last  float64
+}
+
+// Tier is a resolution of history and its retention.
+type Tier struct {
+	Resolution time.Duration // Duration of bucket, 0 for raw values
+	Retention  time.Duration // Max age of buckets
+}
+
+// RawBucket returns bucket of one value.
+//
+// Parameters:
+//   - t: the time of value.
+//   - value: the value, cumulative for counters.
+//   - delta: the increment of counter or the value of gauge.
+//
+// Returns:
+//   - Bucket: the bucket.
+func RawBucket(t time.Time, value, delta float64) Bucket {
+	return Bucket{Time: t, Count: 1, Min: value, Max: value, Sum: delta, Last: value}
+}
+
+// Merge adds values of the next bucket to the bucket.
+//
+// Parameters:
+//   - next: the bucket which is not before b.
+func (b *Bucket) Merge(next Bucket) {
+	b.Min = min(b.Min, next.Min)
+	b.Max = max(b.Max, next.Max)
+	b.Sum += next.Sum
+	b.Count += next.Count
+	b.Last = next.Last
+}
+
+// Value returns aggregate of bucket.
+//
+// Parameters:
+//   - agg: the aggregation, one of Agg constants.
+//
+// Returns:
+//   - float64: the aggregate.
+func (b Bucket) Value(agg string) float64 {
+	switch agg {
+	case AggMin:
+		return b.Min
+	case AggMax:
+		return b.Max
+	case AggSum:
+		return b.Sum
+	case AggAvg:
+		return b.Sum / float64(b.Count)
+	default:
+		return b.Last
+	}
+}
+
+// CheckAggregation checks that aggregation is supported.
+//
+// Parameters:
+//   - agg: the aggregation.
+//   - counter: true if metric is counter, sum is supported only for counters.
+//
+// Returns:
+//   - error: error if aggregation is invalid.
+func CheckAggregation(agg string, counter bool) error {
+	switch agg {
+	case AggLast, AggMin, AggMax, AggAvg:
+		return nil
+	case AggSum:
+		if counter {
+			return nil
+		}
+	}
+	return fmt.Errorf(`%w %q`, errAggregation, agg)
+}
+
+// Tiers returns enabled tiers of history from raw values to hourly buckets.
+//
+// Tier with retention <= 0 disables itself and coarser tiers, because buckets
+// are rolled up from the previous tier.
+//
+// Parameters:
+//   - raw: the retention of raw values.
+//   - minute: the retention of minute buckets.
+//   - hour: the retention of hour buckets.
+//
+// Returns:
+//   - []Tier: the tiers, empty if history is disabled.
+func Tiers(raw, minute, hour time.Duration) []Tier {
+	all := []Tier{
+		{Resolution: 0, Retention: raw},
+		{Resolution: time.Minute, Retention: minute},
+		{Resolution: time.Hour, Retention: hour},
+	}
+
+	for i, t := range all {
+		if t.Retention <= 0 {
+			return all[:i]
+		}
+	}
+	return all
+}
+
+// TierOf returns index of the coarsest tier which satisfies step.
+//
+// Resolution of the tier divides step, so buckets of the tier can be rolled
+// up to step. Raw values are returned if step <= 0.
+//
+// Parameters:
+//   - tiers: the tiers from Tiers.
+//   - step: the requested step.
+//
+// Returns:
+//   - int: the index of tier.
+func TierOf(tiers []Tier, step time.Duration) int {
+	found := 0
+	for i, t := range tiers {
+		if step > 0 && t.Resolution > 0 && step%t.Resolution == 0 {
+			found = i
+		}
+	}
+	return found
+}
+
+// Rollup merges buckets into buckets of resolution.
+//
+// Buckets are aligned by time.Truncate, so buckets of resolution which
+// divides res are merged fully into one bucket.
+//
+// Parameters:
+//   - buckets: the buckets sorted by time.
+//   - res: the resolution, buckets are returned as is if res <= 0.
+//
+// Returns:
+//   - []Bucket: the merged buckets.
+func Rollup(buckets []Bucket, res time.Duration) []Bucket {
+	if res <= 0 || len(buckets) == 0 {
+		return buckets
+	}
+
+	result := make([]Bucket, 0, len(buckets))
+	for _, b := range buckets {
+		start := b.Time.Truncate(res)
+		if n := len(result); n > 0 && result[n-1].Time.Equal(start) {
+			result[n-1].Merge(b)
+			continue
+		}
+
+		b.Time = start
+		result = append(result, b)
+	}
+
+	return result
+}
+
+// StitchHistory returns buckets of tier in [from, to) including the recent
+// values which are not rolled up yet.
+//
+// Rollups are made in time order, so values of finer tiers after the last
+// bucket of tier are rolled up on the fly.
+//
+// Parameters:
+//   - tiers: the tiers of storage.
+//   - tier: the index of tier.
+//   - from: the start of range, aligned to resolution of tier.
+//   - to: the end of range.
+//   - get: the func which returns buckets of tier in [from, to) sorted by time.
+//
+// Returns:
+//   - []Bucket: the buckets of tier sorted by time.
+//   - error: the error of get.
+func StitchHistory(tiers []Tier, tier int, from, to time.Time, get func(tier int, from, to time.Time) ([]Bucket, error)) ([]Bucket, error) {
+	if tier < 0 || tier >= len(tiers) {
+		return []Bucket{}, nil
+	}
+
+	buckets, err := get(tier, from, to)
+	if err != nil || tier == 0 {
+		return buckets, err
+	}
+
+	res := tiers[tier].Resolution
+	next := from
+	if n := len(buckets); n > 0 {
+		next = buckets[n-1].Time.Add(res)
+	}
+	if !next.Before(to) {
+		return buckets, nil
+	}
+
+	recent, err := StitchHistory(tiers, tier-1, next, to, get)
+	if err != nil {
+		return nil, err
+	}
+	return append(buckets, Rollup(recent, res)...), nil
+}
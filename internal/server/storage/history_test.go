@@ -0,0 +1,105 @@
+package storage_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+)
+
+func TestRollup(t *testing.T) {
+	at := func(sec int64, v float64) storage.Bucket {
+		return storage.RawBucket(time.Unix(sec, 0), v, v)
+	}
+
+	buckets := []storage.Bucket{at(1000, 1), at(1005, 4), at(1010, 3), at(1031, 2), at(1039, 5)}
+
+	assert.Equal(t, buckets, storage.Rollup(buckets, 0))
+	assert.Equal(t, []storage.Bucket{
+		{Time: time.Unix(1000, 0), Count: 2, Min: 1, Max: 4, Sum: 5, Last: 4},
+		{Time: time.Unix(1010, 0), Count: 1, Min: 3, Max: 3, Sum: 3, Last: 3},
+		{Time: time.Unix(1030, 0), Count: 2, Min: 2, Max: 5, Sum: 7, Last: 5},
+	}, storage.Rollup(buckets, 10*time.Second))
+	assert.Empty(t, storage.Rollup(nil, time.Second))
+
+	b := storage.Rollup(buckets, time.Hour)[0]
+	assert.Equal(t, 5.0, b.Value(storage.AggLast))
+	assert.Equal(t, 1.0, b.Value(storage.AggMin))
+	assert.Equal(t, 5.0, b.Value(storage.AggMax))
+	assert.Equal(t, 15.0, b.Value(storage.AggSum))
+	assert.Equal(t, 3.0, b.Value(storage.AggAvg))
+
+	assert.NoError(t, storage.CheckAggregation(storage.AggSum, true))
+	assert.Error(t, storage.CheckAggregation(storage.AggSum, false))
+	assert.Error(t, storage.CheckAggregation(`median`, false))
+}
+
+func TestTiers(t *testing.T) {
+	tiers := storage.Tiers(time.Hour, 24*time.Hour, 720*time.Hour)
+
+	tests := []struct {
+		name string
+		step time.Duration
+		want int
+	}{
+		{name: `raw values`, step: 0, want: 0},
+		{name: `less than minute`, step: 30 * time.Second, want: 0},
+		{name: `not multiple of minute`, step: 90 * time.Second, want: 0},
+		{name: `minutes`, step: 5 * time.Minute, want: 1},
+		{name: `not multiple of hour`, step: 90 * time.Minute, want: 1},
+		{name: `hours`, step: 2 * time.Hour, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, storage.TierOf(tiers, tt.step))
+		})
+	}
+
+	assert.Len(t, storage.Tiers(time.Hour, 0, 720*time.Hour), 1)
+	assert.Empty(t, storage.Tiers(0, time.Hour, time.Hour))
+	assert.Equal(t, 1, storage.TierOf(storage.Tiers(time.Hour, time.Hour, 0), 2*time.Hour))
+}
+
+func TestStitchHistory(t *testing.T) {
+	tiers := storage.Tiers(time.Hour, 24*time.Hour, 720*time.Hour)
+	from := time.Unix(0, 0)
+
+	// Hourly bucket is rolled up, the next hour is in minute buckets and raw values
+	data := [][]storage.Bucket{
+		{storage.RawBucket(from.Add(61*time.Minute+10*time.Second), 7, 7)},
+		{storage.RawBucket(from.Add(60*time.Minute), 5, 5)},
+		{storage.RawBucket(from, 1, 1)},
+	}
+
+	var requests []int
+	get := func(tier int, from, to time.Time) ([]storage.Bucket, error) {
+		requests = append(requests, tier)
+		return data[tier], nil
+	}
+
+	buckets, err := storage.StitchHistory(tiers, 2, from, from.Add(3*time.Hour), get)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 1, 0}, requests)
+	assert.Equal(t, []storage.Bucket{
+		storage.RawBucket(from, 1, 1),
+		{Time: from.Add(time.Hour), Count: 2, Min: 5, Max: 7, Sum: 12, Last: 7},
+	}, buckets)
+
+	buckets, err = storage.StitchHistory(nil, 0, from, from.Add(time.Hour), get)
+	assert.NoError(t, err)
+	assert.Empty(t, buckets)
+
+	// Error of finer tier is returned
+	_, err = storage.StitchHistory(tiers, 1, from, from.Add(time.Hour), func(tier int, from, to time.Time) ([]storage.Bucket, error) {
+		if tier == 0 {
+			return nil, errors.New(`connection refused`)
+		}
+		return nil, nil
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned if metric doesn't exist.
+	ErrNotFound = errors.New(`metric not found`)
+	// ErrAmbiguous is returned if labels match several metrics.
+	ErrAmbiguous = errors.New(`labels match several metrics`)
+
+	errSeriesKey = errors.New(`invalid series key`)
+)
+
+// Labels are dimensions of metric, e.g. `host` or `cpu`.
+type Labels map[string]string
+
+// Match checks if labels contain all labels of filter.
+//
+// Parameters:
+//   - filter: the labels to match.
+//
+// Returns:
+//   - bool: true if every label of filter has the same value.
+func (l Labels) Match(filter Labels) bool {
+	for k, v := range filter {
+		if value, ok := l[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Value encodes labels as JSON object for database.
+//
+// JSON is returned as string, because bytes are sent as bytea.
+func (l Labels) Value() (driver.Value, error) {
+	if l == nil {
+		return `{}`, nil
+	}
+
+	b, err := json.Marshal(map[string]string(l))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan decodes labels from JSON object of database.
+func (l *Labels) Scan(src any) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf(`cannot scan %T into labels`, src)
+	}
+
+	var labels map[string]string
+	if err := json.Unmarshal(b, &labels); err != nil {
+		return err
+	}
+	if len(labels) == 0 {
+		labels = nil
+	}
+
+	*l = labels
+	return nil
+}
+
+// SeriesKey returns key of metric in storage.
+//
+// Labels are added to the name in Prometheus format sorted by names, e.g.
+// `http_requests_total{code="200",method="GET"}`. Metric without labels is
+// stored by its name.
+//
+// Parameters:
+//   - name: the name of metric.
+//   - labels: the labels of metric.
+//
+// Returns:
+//   - string: the key of metric.
+func SeriesKey(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// ParseSeriesKey splits key of metric into name and labels.
+//
+// Parameters:
+//   - key: the key created by SeriesKey.
+//
+// Returns:
+//   - string: the name of metric.
+//   - Labels: the labels, nil if metric has no labels.
+//   - error: error if key is invalid.
+func ParseSeriesKey(key string) (string, Labels, error) {
+	name, rest, ok := strings.Cut(key, `{`)
+	if !ok {
+		return key, nil, nil
+	}
+	if name == `` || !strings.HasSuffix(rest, `}`) {
+		return ``, nil, fmt.Errorf(`%w: %q`, errSeriesKey, key)
+	}
+	rest = rest[:len(rest)-1]
+
+	labels := make(Labels)
+	for rest != `` {
+		k, v, ok := strings.Cut(rest, `=`)
+		if !ok || k == `` {
+			return ``, nil, fmt.Errorf(`%w: %q`, errSeriesKey, key)
+		}
+
+		quoted, err := strconv.QuotedPrefix(v)
+		if err != nil {
+			return ``, nil, fmt.Errorf(`%w: %q`, errSeriesKey, key)
+		}
+		value, _ := strconv.Unquote(quoted)
+		labels[k] = value
+
+		rest = v[len(quoted):]
+		if rest != `` {
+			if rest[0] != ',' {
+				return ``, nil, fmt.Errorf(`%w: %q`, errSeriesKey, key)
+			}
+			rest = rest[1:]
+		}
+	}
+
+	if len(labels) == 0 {
+		labels = nil
+	}
+
+	return name, labels, nil
+}
+
+// FindCounter finds counter by name and labels.
+//
+// Counter with exactly the same labels is returned first. Otherwise labels
+// are a filter, and the matching counter with the least count of labels is
+// returned, e.g. `CPUutilization` without `cpu` label is the total of all cores.
+// Only counters with the name are read from storage, see Storage.FindCounters.
+//
+// Parameters:
+//   - ctx: the context of request.
+//   - s: the storage.
+//   - name: the name of metric.
+//   - filter: the labels of metric, may be empty.
+//
+// Returns:
+//   - string: the key of counter.
+//   - int64: the value of counter.
+//   - error: ErrNotFound, ErrAmbiguous or error of storage.
+func FindCounter(ctx context.Context, s Storage, name string, filter Labels) (string, int64, error) {
+	key := SeriesKey(name, filter)
+	value, err := s.GetCounterValue(ctx, key)
+	switch {
+	case err == nil:
+		return key, value, nil
+	case !errors.Is(err, ErrNotFound):
+		return ``, 0, err
+	}
+
+	counter, err := s.FindCounters(ctx, name, filter)
+	if err != nil {
+		return ``, 0, err
+	}
+	return findSeries(counter, name, filter)
+}
+
+// FindGauge finds gauge by name and labels the same way as FindCounter.
+//
+// Parameters:
+//   - ctx: the context of request.
+//   - s: the storage.
+//   - name: the name of metric.
+//   - filter: the labels of metric, may be empty.
+//
+// Returns:
+//   - string: the key of gauge.
+//   - float64: the value of gauge.
+//   - error: ErrNotFound, ErrAmbiguous or error of storage.
+func FindGauge(ctx context.Context, s Storage, name string, filter Labels) (string, float64, error) {
+	key := SeriesKey(name, filter)
+	value, err := s.GetGaugeValue(ctx, key)
+	switch {
+	case err == nil:
+		return key, value, nil
+	case !errors.Is(err, ErrNotFound):
+		return ``, 0, err
+	}
+
+	gauge, err := s.FindGauges(ctx, name, filter)
+	if err != nil {
+		return ``, 0, err
+	}
+	return findSeries(gauge, name, filter)
+}
+
+// findSeries finds metric with the name matched by filter and the least count of labels.
+func findSeries[V int64 | float64](values map[string]V, name string, filter Labels) (string, V, error) {
+	found := ``
+	size := -1
+	ambiguous := false
+
+	for key := range values {
+		n, labels, err := ParseSeriesKey(key)
+		if err != nil || n != name || !labels.Match(filter) {
+			continue
+		}
+
+		switch {
+		case size == -1 || len(labels) < size:
+			found, size, ambiguous = key, len(labels), false
+		case len(labels) == size:
+			ambiguous = true
+		}
+	}
+
+	if size == -1 {
+		return ``, 0, ErrNotFound
+	}
+	if ambiguous {
+		return ``, 0, ErrAmbiguous
+	}
+
+	return found, values[found], nil
+}
+
+// CheckSeries checks that name and labels can be saved in storage.
+//
+// Name must not contain `{`, names of labels must not contain `=`, `,`, `{`,
+// `}` and `"`, so key of metric can be parsed back.
+//
+// Parameters:
+//   - name: the name of metric.
+//   - labels: the labels of metric.
+//
+// Returns:
+//   - error: error if name or labels are invalid.
+func CheckSeries(name string, labels Labels) error {
+	if name == `` || strings.ContainsRune(name, '{') {
+		return fmt.Errorf(`invalid name %q`, name)
+	}
+
+	for k := range labels {
+		if k == `` || strings.ContainsAny(k, `=,{}"`) {
+			return fmt.Errorf(`invalid label %q`, k)
+		}
+	}
+
+	return nil
+}
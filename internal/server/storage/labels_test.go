@@ -0,0 +1,95 @@
+package storage_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository/memory"
+)
+
+func TestSeriesKey(t *testing.T) {
+	assert.Equal(t, `up`, storage.SeriesKey(`up`, nil))
+	assert.Equal(t, `up{a="1",b="x\"y"}`, storage.SeriesKey(`up`, storage.Labels{`b`: `x"y`, `a`: `1`}))
+
+	tests := []struct {
+		key    string
+		name   string
+		labels storage.Labels
+		err    bool
+	}{
+		{key: `up`, name: `up`},
+		{key: `up{}`, name: `up`},
+		{key: `up{a="1",b="x\"y,z"}`, name: `up`, labels: storage.Labels{`a`: `1`, `b`: `x"y,z`}},
+		{key: `up{service.name="api"}`, name: `up`, labels: storage.Labels{`service.name`: `api`}},
+		{key: `up{a=1}`, err: true},
+		{key: `up{a="1"`, err: true},
+		{key: `up{a="1"b="2"}`, err: true},
+		{key: `{a="1"}`, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			name, labels, err := storage.ParseSeriesKey(tt.key)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.name, name)
+			assert.Equal(t, tt.labels, labels)
+		})
+	}
+}
+
+func TestFindGauge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+	s := memory.CreateRepository(memory.Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+	})
+	ctx := context.Background()
+
+	s.UpdateGaugeMetric(ctx, `Alloc`, 1)
+	s.UpdateGaugeMetric(ctx, `CPUutilization{host="a"}`, 10)
+	s.UpdateGaugeMetric(ctx, `CPUutilization{cpu="0",host="a"}`, 20)
+	s.UpdateGaugeMetric(ctx, `CPUutilization{cpu="1",host="a"}`, 30)
+	s.UpdateGaugeMetric(ctx, `Load1{host="a"}`, 1)
+	s.UpdateGaugeMetric(ctx, `Load1{host="b"}`, 2)
+
+	tests := []struct {
+		name   string
+		filter storage.Labels
+		key    string
+		value  float64
+		err    error
+	}{
+		{name: `Alloc`, key: `Alloc`, value: 1},
+		{name: `CPUutilization`, key: `CPUutilization{host="a"}`, value: 10},
+		{name: `CPUutilization`, filter: storage.Labels{`cpu`: `1`}, key: `CPUutilization{cpu="1",host="a"}`, value: 30},
+		{name: `Load1`, filter: storage.Labels{`host`: `b`}, key: `Load1{host="b"}`, value: 2},
+		{name: `Load1`, err: storage.ErrAmbiguous},
+		{name: `Load1`, filter: storage.Labels{`host`: `c`}, err: storage.ErrNotFound},
+		{name: `Load5`, err: storage.ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(storage.SeriesKey(tt.name, tt.filter), func(t *testing.T) {
+			key, value, err := storage.FindGauge(ctx, s, tt.name, tt.filter)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.key, key)
+			assert.Equal(t, tt.value, value)
+		})
+	}
+}
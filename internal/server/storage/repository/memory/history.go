@@ -0,0 +1,136 @@
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+)
+
+// rollupInterval is an interval of rollups and removing old buckets.
+const rollupInterval = time.Minute
+
+// history keeps buckets of metrics in tiers of resolution.
+//
+// Raw values are saved in the first tier, background rollup moves them to
+// coarser tiers. It is not safe for concurrent use, MemStorage guards it by
+// its mutex.
+type history struct {
+	tiers  []storage.Tier
+	series []map[string][]storage.Bucket // Buckets of each tier by key of metric
+}
+
+// newHistory creates a history.
+//
+// Parameters:
+//   - tiers: the tiers from storage.Tiers, empty - history is disabled.
+//
+// Returns:
+//   - *history: the history.
+func newHistory(tiers []storage.Tier) *history {
+	series := make([]map[string][]storage.Bucket, len(tiers))
+	for i := range series {
+		series[i] = make(map[string][]storage.Bucket)
+	}
+
+	return &history{
+		tiers:  tiers,
+		series: series,
+	}
+}
+
+// enabled checks if history is enabled.
+func (h *history) enabled() bool {
+	return len(h.tiers) > 0
+}
+
+// add saves value of metric and removes its raw values older than retention.
+//
+// Parameters:
+//   - name: the key of metric.
+//   - t: the time of value.
+//   - value: the value, cumulative for counters.
+//   - delta: the increment of counter or the value of gauge.
+func (h *history) add(name string, t time.Time, value, delta float64) {
+	if !h.enabled() {
+		return
+	}
+
+	buckets := append(h.series[0][name], storage.RawBucket(t, value, delta))
+	h.series[0][name] = trim(buckets, t.Add(-h.tiers[0].Retention))
+}
+
+// get returns buckets of the coarsest tier which satisfies step.
+//
+// Parameters:
+//   - name: the key of metric.
+//   - from: the start of range, aligned to step.
+//   - to: the end of range.
+//   - step: the step of range, 0 for raw values.
+//
+// Returns:
+//   - []storage.Bucket: copy of buckets sorted by time.
+func (h *history) get(name string, from, to time.Time, step time.Duration) []storage.Bucket {
+	tier := storage.TierOf(h.tiers, step)
+
+	// Buckets are read from memory, so there are no errors
+	buckets, _ := storage.StitchHistory(h.tiers, tier, from, to, func(tier int, from, to time.Time) ([]storage.Bucket, error) {
+		buckets := h.series[tier][name]
+
+		start := sort.Search(len(buckets), func(i int) bool { return !buckets[i].Time.Before(from) })
+		end := sort.Search(len(buckets), func(i int) bool { return !buckets[i].Time.Before(to) })
+		if start >= end {
+			return []storage.Bucket{}, nil
+		}
+
+		return append([]storage.Bucket(nil), buckets[start:end]...), nil
+	})
+
+	return buckets
+}
+
+// rollup merges finished buckets of each tier into the next tier and removes
+// buckets older than retention.
+//
+// Parameters:
+//   - now: the current time.
+func (h *history) rollup(now time.Time) {
+	for i := 1; i < len(h.tiers); i++ {
+		res := h.tiers[i].Resolution
+		until := now.Truncate(res)
+
+		for name, buckets := range h.series[i-1] {
+			coarse := h.series[i][name]
+
+			next := time.Time{}
+			if n := len(coarse); n > 0 {
+				next = coarse[n-1].Time.Add(res)
+			}
+
+			start := sort.Search(len(buckets), func(j int) bool { return !buckets[j].Time.Before(next) })
+			end := sort.Search(len(buckets), func(j int) bool { return !buckets[j].Time.Before(until) })
+			if start >= end {
+				continue
+			}
+
+			h.series[i][name] = append(coarse, storage.Rollup(buckets[start:end], res)...)
+		}
+	}
+
+	for i, t := range h.tiers {
+		for name, buckets := range h.series[i] {
+			buckets = trim(buckets, now.Add(-t.Retention))
+			if len(buckets) == 0 {
+				delete(h.series[i], name)
+				continue
+			}
+			h.series[i][name] = buckets
+		}
+	}
+}
+
+// trim removes buckets before min.
+func trim(buckets []storage.Bucket, min time.Time) []storage.Bucket {
+	i := sort.Search(len(buckets), func(i int) bool { return !buckets[i].Time.Before(min) })
+	return buckets[i:]
+}
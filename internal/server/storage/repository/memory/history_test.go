@@ -0,0 +1,59 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+)
+
+func TestHistory(t *testing.T) {
+	h := newHistory(storage.Tiers(time.Minute, time.Hour, 24*time.Hour))
+	start := time.Unix(3600, 0)
+
+	for i := 0; i < 5; i++ {
+		h.add(`Alloc`, start.Add(time.Duration(i)*30*time.Second), float64(i), float64(i))
+	}
+
+	// Raw values older than a minute are removed on add
+	assert.Equal(t, []storage.Bucket{
+		storage.RawBucket(start.Add(60*time.Second), 2, 2),
+		storage.RawBucket(start.Add(90*time.Second), 3, 3),
+	}, h.get(`Alloc`, start, start.Add(120*time.Second), 0))
+
+	assert.Empty(t, h.get(`Alloc`, start, start.Add(60*time.Second), 0))
+	assert.Empty(t, h.get(`Unknown`, start, start.Add(time.Hour), 0))
+
+	// Not rolled up values are rolled up on the fly
+	assert.Equal(t, []storage.Bucket{
+		{Time: start.Add(time.Minute), Count: 2, Min: 2, Max: 3, Sum: 5, Last: 3},
+		{Time: start.Add(2 * time.Minute), Count: 1, Min: 4, Max: 4, Sum: 4, Last: 4},
+	}, h.get(`Alloc`, start, start.Add(time.Hour), time.Minute))
+
+	// Finished minutes are rolled up, raw values are removed
+	h.rollup(start.Add(2*time.Minute + 45*time.Second))
+	assert.Equal(t, []storage.Bucket{
+		{Time: start.Add(time.Minute), Count: 2, Min: 2, Max: 3, Sum: 5, Last: 3},
+	}, h.series[1][`Alloc`])
+	assert.Equal(t, []storage.Bucket{storage.RawBucket(start.Add(2*time.Minute), 4, 4)}, h.series[0][`Alloc`])
+
+	// The unfinished hour is not rolled up
+	assert.Empty(t, h.series[2])
+	assert.Equal(t, []storage.Bucket{
+		{Time: start, Count: 3, Min: 2, Max: 4, Sum: 9, Last: 4},
+	}, h.get(`Alloc`, start, start.Add(time.Hour), time.Hour))
+
+	// Buckets are removed after retention of their tier
+	h.rollup(start.Add(2 * time.Hour))
+	assert.Empty(t, h.series[0])
+	assert.Empty(t, h.series[1])
+	assert.Equal(t, []storage.Bucket{
+		{Time: start, Count: 3, Min: 2, Max: 4, Sum: 9, Last: 4},
+	}, h.series[2][`Alloc`])
+
+	disabled := newHistory(nil)
+	disabled.add(`Alloc`, start, 1, 1)
+	assert.Empty(t, disabled.get(`Alloc`, start, start.Add(time.Minute), 0))
+}
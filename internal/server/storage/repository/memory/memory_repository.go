@@ -2,13 +2,18 @@
 package memory
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"maps"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
 )
 
 var (
@@ -16,19 +21,33 @@ var (
 	FileStoragePath string
 	IsSave          = true
 	SyncSave        = false
+	SnapshotKeep    = 1
 )
 
+// rotateInterval is a min time between rotations of snapshots if SyncSave is
+// true. Other saves replace only the latest snapshot, so kept snapshots are
+// not different by one update.
+const rotateInterval = time.Minute
+
 type Options struct {
 	StoreInterval   time.Duration
 	FileStoragePath *string
 	Restore         *bool
+	History         []storage.Tier // Tiers of history, empty - history is disabled
+	SnapshotKeep    int            // Count of kept snapshots, at least one is kept
 }
 
 type MemStorage struct {
-	done chan struct{}
+	done   chan struct{}
+	dirty  chan struct{} // Signal of changes which are not saved if SyncSave is true
+	saveMu sync.Mutex    // Keeps order of snapshots
 	sync.Mutex
-	gauge   map[string]float64
-	counter map[string]int64
+	gauge          map[string]float64
+	counter        map[string]int64
+	gaugeSeries    map[string][]string // Keys of gauges by name of metric
+	counterSeries  map[string][]string // Keys of counters by name of metric
+	gaugeHistory   *history
+	counterHistory *history
 }
 
 // CreateRepository creates a new storage repository.
@@ -48,36 +67,26 @@ func CreateRepository(opt Options) *MemStorage {
 	}
 
 	FileStoragePath = *opt.FileStoragePath
+	SnapshotKeep = max(opt.SnapshotKeep, 1)
 
-	// Open file
-	file, err := os.OpenFile(*opt.FileStoragePath, os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		zap.L().Error(`File open error`, zap.Error(err))
-	}
-	defer file.Close()
-
-	// If restore is true and file exist decode content
-	if *opt.Restore && err == nil {
-		var data struct {
-			Gauge   *map[string]float64
-			Counter *map[string]int64
-		}
-
-		err := json.NewDecoder(file).Decode(&data)
-		if err != nil {
-			zap.L().Error(`File decode error`, zap.Error(err))
+	// If restore is true, restore the latest valid snapshot
+	if *opt.Restore {
+		data, file, err := readSnapshot(FileStoragePath, SnapshotKeep)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			zap.L().Error(`Snapshot restore error`, zap.Error(err))
 		}
 
 		if data.Gauge != nil {
-			gauge = *data.Gauge
+			gauge = data.Gauge
 		}
 		if data.Counter != nil {
-			counter = *data.Counter
+			counter = data.Counter
 		}
 
 		if len(gauge) > 0 || len(counter) > 0 {
 			zap.L().Info(
 				`MemStorage restored`,
+				zap.String(`File`, file),
 				zap.Int(`Gauge`, len(gauge)),
 				zap.Int(`Counter`, len(counter)),
 			)
@@ -95,15 +104,29 @@ func CreateRepository(opt Options) *MemStorage {
 	}
 
 	return &MemStorage{
-		gauge:   gauge,
-		counter: counter,
-		done:    make(chan struct{}),
+		gauge:          gauge,
+		counter:        counter,
+		gaugeSeries:    indexSeries(gauge),
+		counterSeries:  indexSeries(counter),
+		gaugeHistory:   newHistory(opt.History),
+		counterHistory: newHistory(opt.History),
+		done:           make(chan struct{}),
+		dirty:          make(chan struct{}, 1),
 	}
 }
 
 // StartTickers starts the tickers for the MemStorage.
 func (r *MemStorage) StartTickers() {
-	if SyncSave || !IsSave {
+	if r.gaugeHistory.enabled() {
+		go r.rollupHistory()
+	}
+
+	if !IsSave {
+		return
+	}
+
+	if SyncSave {
+		go r.saveDirty()
 		return
 	}
 
@@ -127,50 +150,167 @@ func (r *MemStorage) StartTickers() {
 	}()
 }
 
-// SaveMetricsOnDisk saves the metrics in memory to a file on disk.
-func (r *MemStorage) SaveMetricsOnDisk() {
-	zap.L().Debug(`Saving metrics on disk...`)
-	r.Mutex.Lock()
-	defer r.Mutex.Unlock()
+// rollupHistory rolls up history and removes old buckets until done is closed.
+func (r *MemStorage) rollupHistory() {
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
 
-	if _, err := os.Stat(FileStoragePath); os.IsNotExist(err) {
-		zap.L().Warn(`File doesn't exist`)
-	} else {
-		if err := os.Truncate(FileStoragePath, 0); err != nil {
-			zap.L().Error(`File truncate error`, zap.Error(err))
+	for {
+		select {
+		case <-r.done:
 			return
+		case now := <-ticker.C:
+			r.Mutex.Lock()
+			r.gaugeHistory.rollup(now)
+			r.counterHistory.rollup(now)
+			r.Mutex.Unlock()
 		}
 	}
+}
 
-	file, err := os.OpenFile(FileStoragePath, os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		zap.L().Error(err.Error())
-		return
+// saveDirty saves metrics after each change until done is closed.
+//
+// Changes made while snapshot is written are saved together by the next
+// snapshot. Snapshots are rotated not more often than once in rotateInterval.
+func (r *MemStorage) saveDirty() {
+	var rotated time.Time
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.dirty:
+			rotate := time.Since(rotated) >= rotateInterval
+			if r.save(rotate) && rotate {
+				rotated = time.Now()
+			}
+		}
 	}
-	defer file.Close()
+}
 
-	data := make(map[string]any)
-	data[`gauge`] = r.gauge
-	data[`counter`] = r.counter
+// markDirty wakes up saveDirty, if it is already woken up, changes are saved
+// by the same snapshot.
+func (r *MemStorage) markDirty() {
+	select {
+	case r.dirty <- struct{}{}:
+	default:
+	}
+}
 
-	if err := json.NewEncoder(file).Encode(data); err != nil {
-		zap.L().Error(`File encode error`, zap.Error(err))
-		return
+// SaveMetricsOnDisk saves the metrics in memory to a snapshot on disk.
+//
+// Snapshot is replaced atomically and SnapshotKeep previous snapshots are kept,
+// see writeSnapshot.
+func (r *MemStorage) SaveMetricsOnDisk() {
+	r.save(true)
+}
+
+// save saves the metrics in memory to a snapshot on disk.
+//
+// Parameters:
+//   - rotate: if true, previous snapshots are kept, otherwise only the latest
+//     snapshot is replaced.
+//
+// Returns:
+//   - bool: true if snapshot is saved.
+func (r *MemStorage) save(rotate bool) bool {
+	zap.L().Debug(`Saving metrics on disk...`)
+
+	keep := 1
+	if rotate {
+		keep = SnapshotKeep
+	}
+
+	// Snapshots are written in the same order as they are taken
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.Mutex.Lock()
+	b, err := encodeSnapshot(snapshot{Gauge: r.gauge, Counter: r.counter})
+	r.Mutex.Unlock()
+	if err != nil {
+		zap.L().Error(`Snapshot encode error`, zap.Error(err))
+		return false
+	}
+
+	if err := writeSnapshot(FileStoragePath, keep, b); err != nil {
+		zap.L().Error(`Snapshot write error`, zap.Error(err))
+		return false
 	}
 
 	zap.L().Debug(`Metrics saved on disk`)
+	return true
 }
 
-// GetValues returns the gauge and counter maps of the MemStorage.
+// GetValues returns copies of the gauge and counter maps of the MemStorage.
 //
 // Returns:
 // - map[string]float64
-// - map[string]int64.
-func (r *MemStorage) GetValues() (map[string]float64, map[string]int64) {
+// - map[string]int64
+// - error: always nil.
+func (r *MemStorage) GetValues(_ context.Context) (map[string]float64, map[string]int64, error) {
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
 
-	return r.gauge, r.counter
+	return maps.Clone(r.gauge), maps.Clone(r.counter), nil
+}
+
+// FindCounters returns counters with the name whose labels match filter.
+//
+// Parameters:
+// - name: the name of metric without labels.
+// - filter: the labels which counters must have.
+//
+// Returns:
+// - map[string]int64: the values by keys of counters.
+// - error: always nil.
+func (r *MemStorage) FindCounters(_ context.Context, name string, filter storage.Labels) (map[string]int64, error) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	return findSeries(r.counter, r.counterSeries[name], filter), nil
+}
+
+// FindGauges returns gauges with the name whose labels match filter.
+//
+// Parameters:
+// - name: the name of metric without labels.
+// - filter: the labels which gauges must have.
+//
+// Returns:
+// - map[string]float64: the values by keys of gauges.
+// - error: always nil.
+func (r *MemStorage) FindGauges(_ context.Context, name string, filter storage.Labels) (map[string]float64, error) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	return findSeries(r.gauge, r.gaugeSeries[name], filter), nil
+}
+
+// findSeries returns values of keys whose labels match filter.
+func findSeries[V int64 | float64](values map[string]V, keys []string, filter storage.Labels) map[string]V {
+	found := make(map[string]V)
+	for _, key := range keys {
+		if _, labels, err := storage.ParseSeriesKey(key); err == nil && labels.Match(filter) {
+			found[key] = values[key]
+		}
+	}
+	return found
+}
+
+// indexSeries returns keys of metrics by names of metrics.
+func indexSeries[V any](values map[string]V) map[string][]string {
+	series := make(map[string][]string)
+	for key := range values {
+		addSeries(series, key)
+	}
+	return series
+}
+
+// addSeries adds key of new metric into index of names.
+func addSeries(series map[string][]string, key string) {
+	name, _, _ := strings.Cut(key, `{`)
+	series[name] = append(series[name], key)
 }
 
 // GetCounterValue retrieves the value of a counter by its name from the MemStorage.
@@ -180,13 +320,16 @@ func (r *MemStorage) GetValues() (map[string]float64, map[string]int64) {
 //
 // Returns:
 // - int64: the value of the counter.
-// - bool: true if the counter exists, false otherwise.
-func (r *MemStorage) GetCounterValue(name string) (int64, bool) {
+// - error: storage.ErrNotFound if the counter doesn't exist.
+func (r *MemStorage) GetCounterValue(_ context.Context, name string) (int64, error) {
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
 
 	value, ok := r.counter[name]
-	return value, ok
+	if !ok {
+		return 0, storage.ErrNotFound
+	}
+	return value, nil
 }
 
 // GetGaugeValue retrieves the value of a gauge by its name from the MemStorage.
@@ -196,13 +339,16 @@ func (r *MemStorage) GetCounterValue(name string) (int64, bool) {
 //
 // Returns:
 // - value: a float64 representing the value of the gauge.
-// - ok: a boolean indicating whether the gauge was found.
-func (r *MemStorage) GetGaugeValue(name string) (float64, bool) {
+// - error: storage.ErrNotFound if the gauge doesn't exist.
+func (r *MemStorage) GetGaugeValue(_ context.Context, name string) (float64, error) {
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
 
 	value, ok := r.gauge[name]
-	return value, ok
+	if !ok {
+		return 0, storage.ErrNotFound
+	}
+	return value, nil
 }
 
 // UpdateGaugeMetric updates the gauge metric with the given name and value in the MemStorage.
@@ -213,18 +359,23 @@ func (r *MemStorage) GetGaugeValue(name string) (float64, bool) {
 //
 // Returns:
 // - the updated value of the gauge metric (float64).
-func (r *MemStorage) UpdateGaugeMetric(name string, value float64) float64 {
+// - error: always nil.
+func (r *MemStorage) UpdateGaugeMetric(_ context.Context, name string, value float64) (float64, error) {
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
 
+	if _, ok := r.gauge[name]; !ok {
+		addSeries(r.gaugeSeries, name)
+	}
 	r.gauge[name] = value
+	r.gaugeHistory.add(name, time.Now(), value, value)
 
 	// Save metrics on disk if SyncSave is true
 	if SyncSave {
-		go r.SaveMetricsOnDisk()
+		r.markDirty()
 	}
 
-	return r.gauge[name]
+	return r.gauge[name], nil
 }
 
 // UpdateCounterMetric updates the counter metric with the given name by adding the value to it.
@@ -235,16 +386,106 @@ func (r *MemStorage) UpdateGaugeMetric(name string, value float64) float64 {
 //
 // Returns:
 // - the updated value of the counter metric (int64)
-func (r *MemStorage) UpdateCounterMetric(name string, value int64) int64 {
+// - error: always nil.
+func (r *MemStorage) UpdateCounterMetric(_ context.Context, name string, value int64) (int64, error) {
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
 
+	if _, ok := r.counter[name]; !ok {
+		addSeries(r.counterSeries, name)
+	}
 	r.counter[name] += value
+	r.counterHistory.add(name, time.Now(), float64(r.counter[name]), float64(value))
+
+	// Save metrics on disk if SyncSave is true
+	if SyncSave {
+		r.markDirty()
+	}
+
+	return r.counter[name], nil
+}
+
+// UpdateBatch updates the metrics in order under a single lock, so the batch is
+// seen either fully or not at all.
+//
+// Parameters:
+// - metrics: the metrics to update, counters are incremented by Delta.
+//
+// Returns:
+// - []storage.Metric: the metrics with the updated values.
+// - error: error of invalid metric, nothing is updated then.
+func (r *MemStorage) UpdateBatch(_ context.Context, metrics []storage.Metric) ([]storage.Metric, error) {
+	for _, m := range metrics {
+		if err := m.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	now := time.Now()
+	updated := make([]storage.Metric, len(metrics))
+
+	for i, m := range metrics {
+		switch m.MType {
+		case `gauge`:
+			if _, ok := r.gauge[m.Name]; !ok {
+				addSeries(r.gaugeSeries, m.Name)
+			}
+			r.gauge[m.Name] = m.Value
+			r.gaugeHistory.add(m.Name, now, m.Value, m.Value)
+		case `counter`:
+			if _, ok := r.counter[m.Name]; !ok {
+				addSeries(r.counterSeries, m.Name)
+			}
+			r.counter[m.Name] += m.Delta
+			r.counterHistory.add(m.Name, now, float64(r.counter[m.Name]), float64(m.Delta))
+			m.Delta = r.counter[m.Name]
+		}
+		updated[i] = m
+	}
 
 	// Save metrics on disk if SyncSave is true
 	if SyncSave {
-		go r.SaveMetricsOnDisk()
+		r.markDirty()
 	}
 
-	return r.counter[name]
+	return updated, nil
+}
+
+// GetGaugeHistory returns buckets of the gauge in [from, to).
+//
+// Parameters:
+// - name: the name of the gauge.
+// - from: the start of range, aligned to step.
+// - to: the end of range.
+// - step: the step, buckets are of the coarsest tier which satisfies it.
+//
+// Returns:
+// - []storage.Bucket: the buckets sorted by time, empty if history is disabled.
+// - error: always nil.
+func (r *MemStorage) GetGaugeHistory(_ context.Context, name string, from, to time.Time, step time.Duration) ([]storage.Bucket, error) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	return r.gaugeHistory.get(name, from, to, step), nil
+}
+
+// GetCounterHistory returns buckets of the counter in [from, to).
+//
+// Parameters:
+// - name: the name of the counter.
+// - from: the start of range, aligned to step.
+// - to: the end of range.
+// - step: the step, buckets are of the coarsest tier which satisfies it.
+//
+// Returns:
+// - []storage.Bucket: the buckets sorted by time, empty if history is disabled.
+// - error: always nil.
+func (r *MemStorage) GetCounterHistory(_ context.Context, name string, from, to time.Time, step time.Duration) ([]storage.Bucket, error) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	return r.counterHistory.get(name, from, to, step), nil
 }
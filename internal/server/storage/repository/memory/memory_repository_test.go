@@ -0,0 +1,125 @@
+package memory
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+)
+
+// createStorage creates storage which doesn't touch shared files.
+func createStorage(t *testing.T) *MemStorage {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := false
+
+	return CreateRepository(Options{
+		StoreInterval:   time.Hour,
+		FileStoragePath: &path,
+		Restore:         &restore,
+		History:         storage.Tiers(time.Hour, 0, 0),
+	})
+}
+
+func TestUpdateBatch(t *testing.T) {
+	s := createStorage(t)
+	ctx := context.Background()
+
+	updated, err := s.UpdateBatch(ctx, []storage.Metric{
+		{Name: `PollCount`, MType: `counter`, Delta: 2},
+		{Name: `Alloc`, MType: `gauge`, Value: 1.5},
+		{Name: `PollCount`, MType: `counter`, Delta: 3},
+	})
+	require.NoError(t, err)
+
+	// Duplicates are applied in order
+	assert.Equal(t, []storage.Metric{
+		{Name: `PollCount`, MType: `counter`, Delta: 2},
+		{Name: `Alloc`, MType: `gauge`, Value: 1.5},
+		{Name: `PollCount`, MType: `counter`, Delta: 5},
+	}, updated)
+
+	buckets, err := s.GetCounterHistory(ctx, `PollCount`, time.Time{}, time.Now().Add(time.Second), 0)
+	require.NoError(t, err)
+	assert.Len(t, buckets, 2)
+
+	// Batch with invalid metric is not applied
+	_, err = s.UpdateBatch(ctx, []storage.Metric{
+		{Name: `PollCount`, MType: `counter`, Delta: 1},
+		{Name: `Alloc`, MType: `histogram`, Value: 1},
+	})
+	assert.ErrorIs(t, err, storage.ErrMetricType)
+
+	_, err = s.UpdateBatch(ctx, []storage.Metric{{Name: `Alloc{a,b}`, MType: `gauge`}})
+	assert.Error(t, err)
+
+	v, err := s.GetCounterValue(ctx, `PollCount`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), v)
+}
+
+func TestFindSeries(t *testing.T) {
+	s := createStorage(t)
+	ctx := context.Background()
+
+	s.UpdateCounterMetric(ctx, `Requests{code="200",host="a"}`, 1)
+	s.UpdateBatch(ctx, []storage.Metric{
+		{Name: `Requests{code="500",host="a"}`, MType: `counter`, Delta: 2},
+		{Name: `Requests{code="200",host="b"}`, MType: `counter`, Delta: 3},
+		{Name: `RequestsTotal`, MType: `counter`, Delta: 4},
+		{Name: `Requests`, MType: `gauge`, Value: 5},
+	})
+
+	counters, err := s.FindCounters(ctx, `Requests`, storage.Labels{`host`: `a`})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{`Requests{code="200",host="a"}`: 1, `Requests{code="500",host="a"}`: 2}, counters)
+
+	counters, err = s.FindCounters(ctx, `Requests`, nil)
+	require.NoError(t, err)
+	assert.Len(t, counters, 3)
+
+	gauges, err := s.FindGauges(ctx, `Requests`, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{`Requests`: 5}, gauges)
+
+	// Index is built for restored metrics
+	s.SaveMetricsOnDisk()
+	restore := true
+	path := FileStoragePath
+	restored := CreateRepository(Options{StoreInterval: time.Hour, FileStoragePath: &path, Restore: &restore})
+
+	counters, err = restored.FindCounters(ctx, `Requests`, storage.Labels{`code`: `200`})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{`Requests{code="200",host="a"}`: 1, `Requests{code="200",host="b"}`: 3}, counters)
+}
+
+func TestConcurrentCounter(t *testing.T) {
+	s := createStorage(t)
+	ctx := context.Background()
+
+	const workers, updates = 20, 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				_, err := s.UpdateCounterMetric(ctx, `PollCount`, 1)
+				assert.NoError(t, err)
+				_, err = s.UpdateBatch(ctx, []storage.Metric{{Name: `PollCount`, MType: `counter`, Delta: 1}})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := s.GetCounterValue(ctx, `PollCount`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*workers*updates), v)
+}
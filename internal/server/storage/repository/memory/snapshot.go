@@ -0,0 +1,213 @@
+package memory
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// Snapshot file is a header line and JSON of metrics:
+//
+//	metrics-snapshot <version> <sha256 of JSON in hex>
+//	{"counter":{...},"gauge":{...}}
+//
+// Files written before snapshots had header are JSON only, they are restored
+// without check.
+const (
+	snapshotMagic   = `metrics-snapshot`
+	snapshotVersion = 1
+)
+
+var errSnapshot = errors.New(`snapshot is corrupt`)
+
+// snapshot is the saved metrics.
+type snapshot struct {
+	Gauge   map[string]float64 `json:"gauge"`
+	Counter map[string]int64   `json:"counter"`
+}
+
+// encodeSnapshot encodes metrics with header.
+//
+// Parameters:
+//   - s: the metrics.
+//
+// Returns:
+//   - []byte: the content of snapshot file.
+//   - error: error of encoding.
+func encodeSnapshot(s snapshot) ([]byte, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(payload)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %d %s\n", snapshotMagic, snapshotVersion, hex.EncodeToString(sum[:]))
+	b.Write(payload)
+
+	return b.Bytes(), nil
+}
+
+// decodeSnapshot checks header and decodes metrics.
+//
+// Parameters:
+//   - b: the content of snapshot file.
+//
+// Returns:
+//   - snapshot: the metrics.
+//   - error: errSnapshot if file is empty, truncated or damaged.
+func decodeSnapshot(b []byte) (snapshot, error) {
+	var s snapshot
+
+	// Snapshot without header
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(`{`)) {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return s, fmt.Errorf(`%w: %w`, errSnapshot, err)
+		}
+		return s, nil
+	}
+
+	header, payload, ok := bytes.Cut(b, []byte("\n"))
+	if !ok {
+		return s, fmt.Errorf(`%w: header not found`, errSnapshot)
+	}
+
+	fields := bytes.Fields(header)
+	if len(fields) != 3 || string(fields[0]) != snapshotMagic {
+		return s, fmt.Errorf(`%w: header is invalid`, errSnapshot)
+	}
+
+	if version, err := strconv.Atoi(string(fields[1])); err != nil || version != snapshotVersion {
+		return s, fmt.Errorf(`%w: version %s is not supported`, errSnapshot, fields[1])
+	}
+
+	sum := sha256.Sum256(payload)
+	if hex.EncodeToString(sum[:]) != string(fields[2]) {
+		return s, fmt.Errorf(`%w: checksum mismatch`, errSnapshot)
+	}
+
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return s, fmt.Errorf(`%w: %w`, errSnapshot, err)
+	}
+
+	return s, nil
+}
+
+// snapshotPaths returns paths of snapshots from the latest to the oldest:
+// path, path.1, path.2 and so on.
+//
+// Parameters:
+//   - path: the path of the latest snapshot.
+//   - keep: the count of kept snapshots, at least one is kept.
+//
+// Returns:
+//   - []string: the paths.
+func snapshotPaths(path string, keep int) []string {
+	paths := []string{path}
+	for i := 1; i < keep; i++ {
+		paths = append(paths, fmt.Sprintf(`%s.%d`, path, i))
+	}
+	return paths
+}
+
+// writeSnapshot atomically replaces the latest snapshot and shifts previous
+// snapshots, the oldest one is removed.
+//
+// Content is written into temporary file, synced and renamed, so a crash
+// leaves either the old or the new file. If crash happens between renames,
+// the latest snapshot is missing and restore falls back to the previous one.
+//
+// Parameters:
+//   - path: the path of the latest snapshot.
+//   - keep: the count of kept snapshots.
+//   - b: the content of snapshot.
+//
+// Returns:
+//   - error: error of file system.
+func writeSnapshot(path string, keep int, b []byte) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+`.tmp*`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// Shift previous snapshots, path.(keep-1) is overwritten
+	paths := snapshotPaths(path, keep)
+	for i := len(paths) - 1; i > 0; i-- {
+		if err := os.Rename(paths[i-1], paths[i]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Renames are durable after sync of directory, some systems can't sync directories
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// readSnapshot reads the latest valid snapshot.
+//
+// Parameters:
+//   - path: the path of the latest snapshot.
+//   - keep: the count of kept snapshots.
+//
+// Returns:
+//   - snapshot: the metrics.
+//   - string: the path of restored snapshot.
+//   - error: os.ErrNotExist if there are no snapshots, errSnapshot if all of them are corrupt.
+func readSnapshot(path string, keep int) (snapshot, string, error) {
+	err := os.ErrNotExist
+
+	for _, p := range snapshotPaths(path, keep) {
+		b, readErr := os.ReadFile(p)
+		if errors.Is(readErr, os.ErrNotExist) {
+			continue
+		}
+		if readErr != nil {
+			zap.L().Warn(`Snapshot read error`, zap.String(`file`, p), zap.Error(readErr))
+			err = readErr
+			continue
+		}
+
+		s, decodeErr := decodeSnapshot(b)
+		if decodeErr != nil {
+			zap.L().Warn(`Snapshot is skipped`, zap.String(`file`, p), zap.Error(decodeErr))
+			err = decodeErr
+			continue
+		}
+
+		return s, p, nil
+	}
+
+	return snapshot{}, ``, err
+}
@@ -0,0 +1,125 @@
+package memory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	b, err := encodeSnapshot(snapshot{Gauge: map[string]float64{`Alloc`: 1.5}, Counter: map[string]int64{`PollCount`: 2}})
+	require.NoError(t, err)
+
+	s, err := decodeSnapshot(b)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, s.Gauge[`Alloc`])
+	assert.Equal(t, int64(2), s.Counter[`PollCount`])
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: `empty`, data: []byte{}},
+		{name: `truncated`, data: b[:len(b)-5]},
+		{name: `damaged`, data: append(append([]byte{}, b[:len(b)-3]...), `99}`...)},
+		{name: `unknown version`, data: []byte("metrics-snapshot 2 00\n{}")},
+		{name: `truncated legacy`, data: []byte(`{"gauge":{"Alloc":1`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeSnapshot(tt.data)
+			assert.ErrorIs(t, err, errSnapshot)
+		})
+	}
+
+	// Snapshot of old version has no header
+	s, err = decodeSnapshot([]byte(`{"counter":{"PollCount":3},"gauge":{"Alloc":2}}` + "\n"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), s.Counter[`PollCount`])
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := true
+	ctx := context.Background()
+
+	create := func() *MemStorage {
+		return CreateRepository(Options{
+			StoreInterval:   time.Hour,
+			FileStoragePath: &path,
+			Restore:         &restore,
+			SnapshotKeep:    3,
+		})
+	}
+
+	s := create()
+	for i := 0; i < 4; i++ {
+		s.UpdateCounterMetric(ctx, `PollCount`, 1)
+		s.SaveMetricsOnDisk()
+	}
+
+	// The last 3 snapshots are kept
+	for _, p := range []string{path, path + `.1`, path + `.2`} {
+		assert.FileExists(t, p)
+	}
+	assert.NoFileExists(t, path+`.3`)
+
+	files, err := filepath.Glob(path + `.tmp*`)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	v, err := create().GetCounterValue(ctx, `PollCount`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), v)
+
+	// Crash in the middle of write
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b[:len(b)/2], 0666))
+
+	v, err = create().GetCounterValue(ctx, `PollCount`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), v)
+
+	// Crash between renames
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.WriteFile(path+`.1`, nil, 0666))
+
+	v, err = create().GetCounterValue(ctx, `PollCount`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), v)
+}
+
+func TestSyncSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `metrics.json`)
+	restore := true
+	ctx := context.Background()
+	t.Cleanup(func() { SyncSave = false })
+
+	s := CreateRepository(Options{
+		FileStoragePath: &path,
+		Restore:         &restore,
+		SnapshotKeep:    3,
+	})
+	s.StartTickers()
+	defer close(s.done)
+
+	for i := 0; i < 50; i++ {
+		s.UpdateCounterMetric(ctx, `PollCount`, 1)
+	}
+
+	// Updates are saved together by one saver
+	assert.Eventually(t, func() bool {
+		data, _, err := readSnapshot(path, 1)
+		return err == nil && data.Counter[`PollCount`] == 50
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Snapshots are not rotated on each update
+	assert.NoFileExists(t, path+`.1`)
+}
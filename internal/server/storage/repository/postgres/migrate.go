@@ -0,0 +1,300 @@
+package postgres
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Migrations are named `<version>_<name>.<up|down>.sql`, versions start from 1
+// and go without gaps. Migrations which were made before the schema was
+// versioned don't fail on tables created by old versions of the server.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is a key of advisory lock, so replicas of the server don't
+// migrate concurrently.
+const migrationLock = 7085146211
+
+const createMigrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+var errMigrationFile = errors.New(`invalid migration file`)
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a numbered change of schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string // SQL which applies migration
+	Down    string // SQL which reverts migration
+}
+
+// MigrationStatus is a migration and the time it was applied.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time // Nil if migration is not applied
+}
+
+// loadMigrations reads migrations from `migrations` directory.
+//
+// Parameters:
+// - fsys: the file system with migrations.
+//
+// Returns:
+// - []Migration: the migrations sorted by version.
+// - error: errMigrationFile if file has invalid name, lacks up or down pair, or versions have gaps.
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, `migrations/*.sql`)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		match := migrationName.FindStringSubmatch(path.Base(file))
+		if match == nil {
+			return nil, fmt.Errorf(`%w: %s`, errMigrationFile, file)
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf(`%w: %s has name other than %s`, errMigrationFile, file, m.Name)
+		}
+
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		if match[3] == `up` {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == `` || m.Down == `` {
+			return nil, fmt.Errorf(`%w: %04d_%s has no up or down file`, errMigrationFile, m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf(`%w: version %d is missing`, errMigrationFile, i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+// withMigrationLock runs f on a connection which holds advisory lock of
+// migrations. Table of migrations is created before f.
+//
+// Parameters:
+// - ctx: the context of queries.
+// - db: the database.
+// - f: the function which runs migrations.
+//
+// Returns:
+// - error: error of f or error of Postgres.
+func withMigrationLock(ctx context.Context, db *sqlx.DB, f func(conn *sqlx.Conn) error) error {
+	// Advisory lock belongs to session, so all queries are made on the same connection
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLock)
+
+	if _, err := conn.ExecContext(ctx, createMigrationsTable); err != nil {
+		return err
+	}
+
+	return f(conn)
+}
+
+// appliedMigrations returns versions of applied migrations.
+func appliedMigrations(ctx context.Context, q sqlx.QueryerContext) (map[int]time.Time, error) {
+	var rows []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	if err := sqlx.SelectContext(ctx, q, &rows, `SELECT version, applied_at FROM schema_migrations`); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r.AppliedAt
+	}
+	return applied, nil
+}
+
+// runMigration runs SQL of migration and query which records it in a single
+// transaction.
+func runMigration(ctx context.Context, conn *sqlx.Conn, m Migration, query string, record string, args ...any) error {
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf(`migration %04d_%s: %w`, m.Version, m.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MigrateUp applies migrations which are not applied yet.
+//
+// Parameters:
+// - ctx: the context of queries.
+// - db: the database.
+//
+// Returns:
+// - []Migration: the applied migrations.
+// - error: error of Postgres, migrations before the failed one stay applied.
+func MigrateUp(ctx context.Context, db *sqlx.DB) ([]Migration, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	err = withMigrationLock(ctx, db, func(conn *sqlx.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+
+			if err := runMigration(ctx, conn, m, m.Up,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name,
+			); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// MigrateDown reverts the last applied migration.
+//
+// Parameters:
+// - ctx: the context of queries.
+// - db: the database.
+//
+// Returns:
+// - *Migration: the reverted migration, nil if nothing is applied.
+// - error: error of Postgres.
+func MigrateDown(ctx context.Context, db *sqlx.DB) (*Migration, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted *Migration
+	err = withMigrationLock(ctx, db, func(conn *sqlx.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+
+			if err := runMigration(ctx, conn, m, m.Down,
+				`DELETE FROM schema_migrations WHERE version = $1`, m.Version,
+			); err != nil {
+				return err
+			}
+			reverted = &m
+			return nil
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// GetMigrationStatus returns all migrations with time they were applied.
+//
+// Parameters:
+// - ctx: the context of queries.
+// - db: the database.
+//
+// Returns:
+// - []MigrationStatus: the migrations sorted by version.
+// - error: error of Postgres.
+func GetMigrationStatus(ctx context.Context, db *sqlx.DB) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	err = withMigrationLock(ctx, db, func(conn *sqlx.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			s := MigrationStatus{Migration: m}
+			if t, ok := applied[m.Version]; ok {
+				s.AppliedAt = &t
+			}
+			status = append(status, s)
+		}
+
+		return nil
+	})
+
+	return status, err
+}
@@ -0,0 +1,120 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	assert.Equal(t, 1, migrations[0].Version)
+	assert.Equal(t, `create_metrics`, migrations[0].Name)
+
+	file := func(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s)} }
+
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{name: `invalid name`, files: fstest.MapFS{`migrations/create.sql`: file(`SELECT 1`)}},
+		{name: `no down file`, files: fstest.MapFS{`migrations/0001_create.up.sql`: file(`SELECT 1`)}},
+		{name: `gap in versions`, files: fstest.MapFS{
+			`migrations/0001_create.up.sql`:   file(`SELECT 1`),
+			`migrations/0001_create.down.sql`: file(`SELECT 1`),
+			`migrations/0003_alter.up.sql`:    file(`SELECT 1`),
+			`migrations/0003_alter.down.sql`:  file(`SELECT 1`),
+		}},
+		{name: `different names`, files: fstest.MapFS{
+			`migrations/0001_create.up.sql`:  file(`SELECT 1`),
+			`migrations/0001_alter.down.sql`: file(`SELECT 1`),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadMigrations(tt.files)
+			assert.ErrorIs(t, err, errMigrationFile)
+		})
+	}
+}
+
+// createSchemaStorage creates storage in a temporary schema of database from
+// TEST_DATABASE_DSN, so reverted migrations don't break other tests. The test
+// is skipped without it.
+func createSchemaStorage(t *testing.T) *PostgresStorage {
+	dsn, ok := os.LookupEnv(`TEST_DATABASE_DSN`)
+	if !ok {
+		t.Skip(`TEST_DATABASE_DSN is not set`)
+	}
+
+	db, err := Connect(context.Background(), dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	schema := fmt.Sprintf(`test_migrations_%d`, time.Now().UnixNano())
+	_, err = db.Exec(`CREATE SCHEMA ` + schema)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	// Unknown parameters of DSN are passed to Postgres as run-time parameters
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != `` {
+		q := u.Query()
+		q.Set(`search_path`, schema)
+		u.RawQuery = q.Encode()
+		dsn = u.String()
+	} else {
+		dsn += ` search_path=` + schema
+	}
+
+	s := CreateRepository(Options{PostgresDSN: &dsn})
+	require.NotNil(t, s, `cannot connect to Postgres`)
+	t.Cleanup(func() { s.db.Close() })
+
+	return s
+}
+
+func TestMigrations(t *testing.T) {
+	s := createSchemaStorage(t)
+	ctx := context.Background()
+
+	migrations, err := loadMigrations(migrationFiles)
+	require.NoError(t, err)
+
+	// Storage is created with the last version
+	status, err := GetMigrationStatus(ctx, s.db)
+	require.NoError(t, err)
+	require.Len(t, status, len(migrations))
+	for _, m := range status {
+		assert.NotNil(t, m.AppliedAt, m.Name)
+	}
+
+	applied, err := MigrateUp(ctx, s.db)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	// Every migration is reverted and applied again
+	for i := len(migrations) - 1; i >= 0; i-- {
+		reverted, err := MigrateDown(ctx, s.db)
+		require.NoError(t, err)
+		require.NotNil(t, reverted)
+		assert.Equal(t, migrations[i].Version, reverted.Version)
+	}
+
+	reverted, err := MigrateDown(ctx, s.db)
+	assert.NoError(t, err)
+	assert.Nil(t, reverted)
+
+	applied, err = MigrateUp(ctx, s.db)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(migrations))
+}
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS gauge (
+	name VARCHAR(255) PRIMARY KEY,
+	value FLOAT
+);
+
+CREATE TABLE IF NOT EXISTS counter (
+	name VARCHAR(255) PRIMARY KEY,
+	value BIGINT
+);
@@ -0,0 +1,10 @@
+-- Metrics with labels can't be identified by name only, so they are removed
+DELETE FROM gauge WHERE labels <> '{}';
+ALTER TABLE gauge DROP CONSTRAINT IF EXISTS gauge_pkey;
+ALTER TABLE gauge DROP COLUMN IF EXISTS labels;
+ALTER TABLE gauge ADD PRIMARY KEY (name);
+
+DELETE FROM counter WHERE labels <> '{}';
+ALTER TABLE counter DROP CONSTRAINT IF EXISTS counter_pkey;
+ALTER TABLE counter DROP COLUMN IF EXISTS labels;
+ALTER TABLE counter ADD PRIMARY KEY (name);
@@ -0,0 +1,8 @@
+-- Metrics are identified by name and labels
+ALTER TABLE gauge ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE gauge DROP CONSTRAINT IF EXISTS gauge_pkey;
+ALTER TABLE gauge ADD PRIMARY KEY (name, labels);
+
+ALTER TABLE counter ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE counter DROP CONSTRAINT IF EXISTS counter_pkey;
+ALTER TABLE counter ADD PRIMARY KEY (name, labels);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS samples (
+	type VARCHAR(16) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	labels JSONB NOT NULL DEFAULT '{}',
+	time TIMESTAMPTZ NOT NULL,
+	value DOUBLE PRECISION NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS samples_series_time ON samples (type, name, labels, time);
+CREATE INDEX IF NOT EXISTS samples_time ON samples (time);
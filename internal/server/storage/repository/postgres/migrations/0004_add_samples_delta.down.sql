@@ -0,0 +1 @@
+ALTER TABLE samples DROP COLUMN IF EXISTS delta;
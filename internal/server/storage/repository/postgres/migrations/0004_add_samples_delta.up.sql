@@ -0,0 +1,2 @@
+-- Increment of counter or value of gauge, sum of rollups is a sum of deltas
+ALTER TABLE samples ADD COLUMN IF NOT EXISTS delta DOUBLE PRECISION NOT NULL DEFAULT 0;
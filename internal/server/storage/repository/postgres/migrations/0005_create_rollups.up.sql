@@ -0,0 +1,16 @@
+-- Buckets of history, resolution is in seconds
+CREATE TABLE IF NOT EXISTS rollups (
+	type VARCHAR(16) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	labels JSONB NOT NULL DEFAULT '{}',
+	resolution INTEGER NOT NULL,
+	time TIMESTAMPTZ NOT NULL,
+	count BIGINT NOT NULL,
+	min DOUBLE PRECISION NOT NULL,
+	max DOUBLE PRECISION NOT NULL,
+	sum DOUBLE PRECISION NOT NULL,
+	last DOUBLE PRECISION NOT NULL,
+	PRIMARY KEY (type, name, labels, resolution, time)
+);
+
+CREATE INDEX IF NOT EXISTS rollups_resolution_time ON rollups (resolution, time);
@@ -2,135 +2,493 @@
 package postgres
 
 import (
-	"slices"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
 	"time"
 
 	"github.com/avast/retry-go"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+)
+
+// Buckets of rollups are aligned to Unix time, resolution is in seconds.
+// Rollups are idempotent, so interrupted rollup is repeated by the next one.
+const (
+	rollupSamples = `
+INSERT INTO rollups (type, name, labels, resolution, time, count, min, max, sum, last)
+SELECT type, name, labels, $1::INTEGER,
+	to_timestamp(floor(extract(epoch FROM time) / $1::INTEGER) * $1::INTEGER) AS bucket,
+	count(*), min(value), max(value), sum(delta), (array_agg(value ORDER BY time DESC))[1]
+FROM samples
+WHERE time >= $2 AND time < $3
+GROUP BY type, name, labels, bucket
+ON CONFLICT (type, name, labels, resolution, time) DO UPDATE SET
+	count = EXCLUDED.count, min = EXCLUDED.min, max = EXCLUDED.max, sum = EXCLUDED.sum, last = EXCLUDED.last`
+
+	rollupBuckets = `
+INSERT INTO rollups (type, name, labels, resolution, time, count, min, max, sum, last)
+SELECT type, name, labels, $1::INTEGER,
+	to_timestamp(floor(extract(epoch FROM time) / $1::INTEGER) * $1::INTEGER) AS bucket,
+	sum(count), min(min), max(max), sum(sum), (array_agg(last ORDER BY time DESC))[1]
+FROM rollups
+WHERE resolution = $4 AND time >= $2 AND time < $3
+GROUP BY type, name, labels, bucket
+ON CONFLICT (type, name, labels, resolution, time) DO UPDATE SET
+	count = EXCLUDED.count, min = EXCLUDED.min, max = EXCLUDED.max, sum = EXCLUDED.sum, last = EXCLUDED.last`
 )
 
-var schema = `
-CREATE TABLE IF NOT EXISTS gauge (
-	name VARCHAR(255) PRIMARY KEY,
-	value FLOAT
-);
+// Upserts of metrics return the updated value. Counter is incremented by the
+// inserted value, gauge is replaced.
+const (
+	upsertGauge = `
+INSERT INTO gauge (name, labels, value) VALUES ($1, $2, $3)
+ON CONFLICT (name, labels) DO UPDATE SET value = EXCLUDED.value
+RETURNING value`
+
+	upsertCounter = `
+INSERT INTO counter (name, labels, value) VALUES ($1, $2, $3)
+ON CONFLICT (name, labels) DO UPDATE SET value = counter.value + EXCLUDED.value
+RETURNING value`
 
-CREATE TABLE IF NOT EXISTS counter (
-	name VARCHAR(255) PRIMARY KEY,
-	value BIGINT
-)`
+	insertSample = `INSERT INTO samples (type, name, labels, time, value, delta) VALUES ($1, $2, $3, $4, $5, $6)`
+)
+
+const (
+	rollupInterval = time.Minute      // Interval of rollups and removing old buckets
+	rollupDelay    = 10 * time.Second // Delay of rollups for samples which are being inserted
+)
 
 type GaugeModel struct {
-	Name  string  `db:"name"`
-	Value float64 `db:"value"`
+	Name   string         `db:"name"`
+	Labels storage.Labels `db:"labels"`
+	Value  float64        `db:"value"`
 }
 
 type CounterModel struct {
-	Name  string `db:"name"`
-	Value int64  `db:"value"`
+	Name   string         `db:"name"`
+	Labels storage.Labels `db:"labels"`
+	Value  int64          `db:"value"`
+}
+
+type SampleModel struct {
+	Time  time.Time `db:"time"`
+	Value float64   `db:"value"`
+	Delta float64   `db:"delta"`
+}
+
+type BucketModel struct {
+	Time  time.Time `db:"time"`
+	Count int64     `db:"count"`
+	Min   float64   `db:"min"`
+	Max   float64   `db:"max"`
+	Sum   float64   `db:"sum"`
+	Last  float64   `db:"last"`
 }
 
 type PostgresStorage struct {
-	db *sqlx.DB
+	db    *sqlx.DB
+	tiers []storage.Tier
+	done  chan struct{}
 }
 
 type Options struct {
 	PostgresDSN *string
+	History     []storage.Tier // Tiers of history, empty - history is disabled
+}
+
+// Connect connects to Postgres, connection is retried on network errors and
+// errors of class 08.
+//
+// Parameters:
+// - ctx: the context of connection.
+// - dsn: the Postgres DSN.
+//
+// Returns:
+// - *sqlx.DB: the database.
+// - error: error of connection.
+func Connect(ctx context.Context, dsn string) (*sqlx.DB, error) {
+	var db *sqlx.DB
+
+	err := retryIfError(ctx, func() error {
+		database, err := sqlx.ConnectContext(ctx, `postgres`, dsn)
+		if err != nil {
+			zap.L().Error(err.Error())
+			return err
+		}
+		db = database
+		return nil
+	})
+
+	return db, err
 }
 
 // CreateRepository creates a new storage repository.
 //
+// Schema of database is migrated to the last version, see MigrateUp.
+//
 // Returns:
-// - a pointer to a storage.Storage interface.
+// - a pointer to a storage.Storage interface, nil if database is unavailable or migration fails.
 func CreateRepository(opt Options) *PostgresStorage {
-	var db *sqlx.DB
+	ctx := context.Background()
 
 	// Connect to Postgres
-	err := retryIfError(
-		func() error {
-			database, err := sqlx.Connect(`postgres`, *opt.PostgresDSN)
-			if err != nil {
-				zap.L().Error(err.Error())
-				return err
-			}
-			db = database
-			return nil
-		},
-	)
+	db, err := Connect(ctx, *opt.PostgresDSN)
 	if err != nil {
 		zap.L().Error(err.Error())
 		return nil
 	}
 
-	// Create tables
-	db.MustExec(schema)
+	// Create or update tables
+	applied, err := MigrateUp(ctx, db)
+	if err != nil {
+		zap.L().Error(`Error while migrating Postgres`, zap.Error(err))
+		db.Close()
+		return nil
+	}
+	for _, m := range applied {
+		zap.L().Info(`Migration applied`, zap.Int(`version`, m.Version), zap.String(`name`, m.Name))
+	}
 
 	return &PostgresStorage{
-		db: db,
+		db:    db,
+		tiers: opt.History,
+		done:  make(chan struct{}),
+	}
+}
+
+// StartTickers starts rollups of history and removing of old buckets.
+func (r *PostgresStorage) StartTickers() {
+	if len(r.tiers) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(rollupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.done:
+				return
+			case now := <-ticker.C:
+				r.rollup(context.Background(), now.Add(-rollupDelay))
+			}
+		}
+	}()
+}
+
+// rollup merges finished buckets of each tier into the next tier and removes
+// buckets older than retention.
+//
+// Parameters:
+// - ctx: the context of queries.
+// - now: the current time.
+func (r *PostgresStorage) rollup(ctx context.Context, now time.Time) {
+	for i := 1; i < len(r.tiers); i++ {
+		res := resolution(r.tiers[i])
+
+		// Rollups are made in time order, so the last bucket is the start of the next rollup
+		var last sql.NullTime
+		if err := retryIfError(ctx, func() error {
+			return r.db.GetContext(ctx, &last, `SELECT MAX(time) FROM rollups WHERE resolution = $1`, res)
+		}); err != nil {
+			zap.L().Error(`Error while getting rollups from Postgres`, zap.Error(err))
+			return
+		}
+
+		from := time.Time{}
+		if last.Valid {
+			from = last.Time.Add(r.tiers[i].Resolution)
+		}
+		until := now.Truncate(r.tiers[i].Resolution)
+		if !from.Before(until) {
+			continue
+		}
+
+		if err := retryIfError(ctx, func() error {
+			var err error
+			if i == 1 {
+				_, err = r.db.ExecContext(ctx, rollupSamples, res, from, until)
+			} else {
+				_, err = r.db.ExecContext(ctx, rollupBuckets, res, from, until, resolution(r.tiers[i-1]))
+			}
+			return err
+		}); err != nil {
+			zap.L().Error(`Error while rolling up history in Postgres`, zap.Error(err))
+			return
+		}
+	}
+
+	for i, t := range r.tiers {
+		if err := retryIfError(ctx, func() error {
+			var err error
+			if i == 0 {
+				_, err = r.db.ExecContext(ctx, `DELETE FROM samples WHERE time < $1`, now.Add(-t.Retention))
+			} else {
+				_, err = r.db.ExecContext(ctx, `DELETE FROM rollups WHERE resolution = $1 AND time < $2`, resolution(t), now.Add(-t.Retention))
+			}
+			return err
+		}); err != nil {
+			zap.L().Error(`Error while removing history from Postgres`, zap.Error(err))
+		}
+	}
+}
+
+// resolution returns resolution of tier in seconds as in rollups table.
+func resolution(t storage.Tier) int {
+	return int(t.Resolution / time.Second)
+}
+
+// addSample saves value of metric into history if history is enabled.
+//
+// Metric is already updated, so error is only logged.
+//
+// Parameters:
+// - ctx: the context of request.
+// - mType: the type of metric, `gauge` or `counter`.
+// - name: the name of metric.
+// - labels: the labels of metric.
+// - value: the value of metric, cumulative for counters.
+// - delta: the increment of counter or the value of gauge.
+func (r *PostgresStorage) addSample(ctx context.Context, mType string, name string, labels storage.Labels, value, delta float64) {
+	if len(r.tiers) == 0 {
+		return
+	}
+
+	if err := retryIfError(ctx, func() error {
+		_, err := r.db.ExecContext(ctx, insertSample, mType, name, labels, time.Now(), value, delta)
+		return err
+	}); err != nil {
+		zap.L().Error(`Error while inserting sample into Postgres`, zap.Error(err))
+	}
+}
+
+// getHistory returns buckets of the coarsest tier which satisfies step.
+//
+// Parameters:
+// - ctx: the context of request.
+// - mType: the type of metric, `gauge` or `counter`.
+// - key: the key of metric with labels, see storage.SeriesKey.
+// - from: the start of range, aligned to step.
+// - to: the end of range.
+// - step: the step of range, 0 for raw values.
+//
+// Returns:
+// - []storage.Bucket: the buckets sorted by time.
+// - error: error of Postgres.
+func (r *PostgresStorage) getHistory(ctx context.Context, mType string, key string, from, to time.Time, step time.Duration) ([]storage.Bucket, error) {
+	name, labels, err := storage.ParseSeriesKey(key)
+	if err != nil {
+		return nil, err
 	}
+
+	tier := storage.TierOf(r.tiers, step)
+
+	return storage.StitchHistory(r.tiers, tier, from, to, func(tier int, from, to time.Time) ([]storage.Bucket, error) {
+		buckets := []storage.Bucket{}
+
+		if tier == 0 {
+			models := []SampleModel{}
+			if err := retryIfError(ctx, func() error {
+				return r.db.SelectContext(ctx, &models,
+					`SELECT time, value, delta FROM samples WHERE type = $1 AND name = $2 AND labels = $3 AND time >= $4 AND time < $5 ORDER BY time`,
+					mType, name, labels, from, to,
+				)
+			}); err != nil {
+				zap.L().Error(`Error while getting samples from Postgres`, zap.Error(err))
+				return nil, err
+			}
+
+			for _, m := range models {
+				buckets = append(buckets, storage.RawBucket(m.Time, m.Value, m.Delta))
+			}
+			return buckets, nil
+		}
+
+		models := []BucketModel{}
+		if err := retryIfError(ctx, func() error {
+			return r.db.SelectContext(ctx, &models,
+				`SELECT time, count, min, max, sum, last FROM rollups WHERE type = $1 AND name = $2 AND labels = $3 AND resolution = $4 AND time >= $5 AND time < $6 ORDER BY time`,
+				mType, name, labels, resolution(r.tiers[tier]), from, to,
+			)
+		}); err != nil {
+			zap.L().Error(`Error while getting rollups from Postgres`, zap.Error(err))
+			return nil, err
+		}
+
+		for _, m := range models {
+			buckets = append(buckets, storage.Bucket(m))
+		}
+		return buckets, nil
+	})
+}
+
+// GetGaugeHistory returns buckets of the gauge in [from, to).
+//
+// Parameters:
+// - ctx: the context of request.
+// - name: the key of the gauge with labels.
+// - from: the start of range, aligned to step.
+// - to: the end of range.
+// - step: the step, buckets are of the coarsest tier which satisfies it.
+//
+// Returns:
+// - []storage.Bucket: the buckets sorted by time, empty if history is disabled.
+// - error: error of Postgres.
+func (r *PostgresStorage) GetGaugeHistory(ctx context.Context, name string, from, to time.Time, step time.Duration) ([]storage.Bucket, error) {
+	return r.getHistory(ctx, `gauge`, name, from, to, step)
 }
 
-// StartTickers a not used here
-func (r *PostgresStorage) StartTickers() {}
+// GetCounterHistory returns buckets of the counter in [from, to).
+//
+// Parameters:
+// - ctx: the context of request.
+// - name: the key of the counter with labels.
+// - from: the start of range, aligned to step.
+// - to: the end of range.
+// - step: the step, buckets are of the coarsest tier which satisfies it.
+//
+// Returns:
+// - []storage.Bucket: the buckets sorted by time, empty if history is disabled.
+// - error: error of Postgres.
+func (r *PostgresStorage) GetCounterHistory(ctx context.Context, name string, from, to time.Time, step time.Duration) ([]storage.Bucket, error) {
+	return r.getHistory(ctx, `counter`, name, from, to, step)
+}
 
 // GetValues returns the gauge and counter maps of the postgres database.
 //
+// Parameters:
+// - ctx: the context of request.
+//
 // Returns:
 // - map[string]float64
-// - map[string]int64.
-func (r *PostgresStorage) GetValues() (map[string]float64, map[string]int64) {
+// - map[string]int64
+// - error: error of Postgres.
+func (r *PostgresStorage) GetValues(ctx context.Context) (map[string]float64, map[string]int64, error) {
 	gaugeModels := []GaugeModel{}
 	counterModels := []CounterModel{}
 
 	// Request gauge models
-	if err := retryIfError(
-		func() error {
-			return r.db.Select(&gaugeModels, `SELECT name, value FROM gauge`)
-		},
-	); err != nil {
-		zap.L().Error(err.Error())
-		return nil, nil
+	if err := retryIfError(ctx, func() error {
+		return r.db.SelectContext(ctx, &gaugeModels, `SELECT name, labels, value FROM gauge`)
+	}); err != nil {
+		zap.L().Error(`Error while getting data from Postgres`, zap.Error(err))
+		return nil, nil, err
 	}
 
 	// Request counter models
-	if err := retryIfError(func() error {
-		return r.db.Select(&counterModels, `SELECT name, value FROM counter`)
+	if err := retryIfError(ctx, func() error {
+		return r.db.SelectContext(ctx, &counterModels, `SELECT name, labels, value FROM counter`)
 	}); err != nil {
 		zap.L().Error(`Error while getting data from Postgres`, zap.Error(err))
+		return nil, nil, err
 	}
 
 	// Convert gauge models to maps
 	gauge := make(map[string]float64, len(gaugeModels))
 	for _, model := range gaugeModels {
-		gauge[model.Name] = model.Value
+		gauge[storage.SeriesKey(model.Name, model.Labels)] = model.Value
 	}
 
 	// Convert counter models to maps
 	counter := make(map[string]int64, len(counterModels))
 	for _, model := range counterModels {
-		counter[model.Name] = model.Value
+		counter[storage.SeriesKey(model.Name, model.Labels)] = model.Value
+	}
+
+	return gauge, counter, nil
+}
+
+// FindCounters returns counters with the name whose labels contain filter.
+//
+// Labels are matched by JSONB containment, so only rows with the name are
+// read by primary key.
+//
+// Parameters:
+// - ctx: the context of request.
+// - name: the name of metric without labels.
+// - filter: the labels which counters must have.
+//
+// Returns:
+// - map[string]int64: the values by keys of counters.
+// - error: error of Postgres.
+func (r *PostgresStorage) FindCounters(ctx context.Context, name string, filter storage.Labels) (map[string]int64, error) {
+	models := []CounterModel{}
+
+	if err := retryIfError(ctx, func() error {
+		return r.db.SelectContext(ctx, &models, `SELECT name, labels, value FROM counter WHERE name = $1 AND labels @> $2::jsonb`, name, filter)
+	}); err != nil {
+		zap.L().Error(`Error while getting data from Postgres`, zap.Error(err))
+		return nil, err
+	}
+
+	counter := make(map[string]int64, len(models))
+	for _, model := range models {
+		counter[storage.SeriesKey(model.Name, model.Labels)] = model.Value
 	}
 
-	return gauge, counter
+	return counter, nil
+}
+
+// FindGauges returns gauges with the name whose labels contain filter, see FindCounters.
+//
+// Parameters:
+// - ctx: the context of request.
+// - name: the name of metric without labels.
+// - filter: the labels which gauges must have.
+//
+// Returns:
+// - map[string]float64: the values by keys of gauges.
+// - error: error of Postgres.
+func (r *PostgresStorage) FindGauges(ctx context.Context, name string, filter storage.Labels) (map[string]float64, error) {
+	models := []GaugeModel{}
+
+	if err := retryIfError(ctx, func() error {
+		return r.db.SelectContext(ctx, &models, `SELECT name, labels, value FROM gauge WHERE name = $1 AND labels @> $2::jsonb`, name, filter)
+	}); err != nil {
+		zap.L().Error(`Error while getting data from Postgres`, zap.Error(err))
+		return nil, err
+	}
+
+	gauge := make(map[string]float64, len(models))
+	for _, model := range models {
+		gauge[storage.SeriesKey(model.Name, model.Labels)] = model.Value
+	}
+
+	return gauge, nil
 }
 
 // GetCounterByName retrieves a CounterModel from the Postgres based on the given name.
 //
 // Parameters:
-// - name: the name of the counter.
+// - ctx: the context of request.
+// - name: the key of the counter with labels, see storage.SeriesKey.
 //
 // Returns:
 // - *CounterModel: a pointer to the CounterModel retrieved from the database.
-// - error: any error that occurred during the retrieval process.
-func (r *PostgresStorage) GetCounterByName(name string) (*CounterModel, error) {
+// - error: storage.ErrNotFound if the counter doesn't exist, otherwise error of Postgres.
+func (r *PostgresStorage) GetCounterByName(ctx context.Context, name string) (*CounterModel, error) {
 	counterModel := CounterModel{}
 
+	metric, labels, err := storage.ParseSeriesKey(name)
+	if err != nil {
+		return nil, err
+	}
+
 	// Request counter model
-	if err := retryIfError(func() error {
-		return r.db.Get(&counterModel, `SELECT name, value FROM counter WHERE name = $1`, name)
+	if err := retryIfError(ctx, func() error {
+		return r.db.GetContext(ctx, &counterModel, `SELECT name, labels, value FROM counter WHERE name = $1 AND labels = $2`, metric, labels)
 	}); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrNotFound
+		}
 		zap.L().Error(`Error while operate with Postgres`, zap.Error(err))
 		return nil, err
 	}
@@ -141,18 +499,27 @@ func (r *PostgresStorage) GetCounterByName(name string) (*CounterModel, error) {
 // GetGaugeByName retrieves a GaugeModel from the Postgres based on the given name.
 //
 // Parameters:
-// - name: the name of the gauge.
+// - ctx: the context of request.
+// - name: the key of the gauge with labels, see storage.SeriesKey.
 //
 // Returns:
 // - *GaugeModel: a pointer to the GaugeModel retrieved from the database.
-// - error: any error that occurred during the retrieval process.
-func (r *PostgresStorage) GetGaugeByName(name string) (*GaugeModel, error) {
+// - error: storage.ErrNotFound if the gauge doesn't exist, otherwise error of Postgres.
+func (r *PostgresStorage) GetGaugeByName(ctx context.Context, name string) (*GaugeModel, error) {
 	gaugeModel := GaugeModel{}
 
+	metric, labels, err := storage.ParseSeriesKey(name)
+	if err != nil {
+		return nil, err
+	}
+
 	// Request counter model
-	if err := retryIfError(func() error {
-		return r.db.Get(&gaugeModel, `SELECT name, value FROM gauge WHERE name = $1`, name)
+	if err := retryIfError(ctx, func() error {
+		return r.db.GetContext(ctx, &gaugeModel, `SELECT name, labels, value FROM gauge WHERE name = $1 AND labels = $2`, metric, labels)
 	}); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrNotFound
+		}
 		zap.L().Error(`Error while getting data from Postgres`, zap.Error(err))
 		return nil, err
 	}
@@ -163,155 +530,208 @@ func (r *PostgresStorage) GetGaugeByName(name string) (*GaugeModel, error) {
 // GetCounterValue retrieves the value of a counter by its name from the postgres database.
 //
 // Parameters:
+// - ctx: the context of request.
 // - name: the name of the counter.
 //
 // Returns:
 // - int64: the value of the counter.
-// - bool: true if the counter exists, false otherwise.
-func (r *PostgresStorage) GetCounterValue(name string) (int64, bool) {
-	counterModel, err := r.GetCounterByName(name)
+// - error: storage.ErrNotFound if the counter doesn't exist, otherwise error of Postgres.
+func (r *PostgresStorage) GetCounterValue(ctx context.Context, name string) (int64, error) {
+	counterModel, err := r.GetCounterByName(ctx, name)
 	if err != nil {
-		return 0, false
+		return 0, err
 	}
 
-	return counterModel.Value, true
+	return counterModel.Value, nil
 }
 
 // UpdateCounterMetric updates the counter metric with the given name by adding the value to it.
 //
 // Parameters:
+// - ctx: the context of request.
 // - name: the name of the counter metric (string)
 // - value: the value to be added to the counter metric (int64)
 //
 // Returns:
 // - the updated value of the counter metric (int64)
-func (r *PostgresStorage) UpdateCounterMetric(name string, value int64) int64 {
-	counterModel, err := r.GetCounterByName(name)
-
-	// If counter doesn't exist
+// - error: error of Postgres.
+func (r *PostgresStorage) UpdateCounterMetric(ctx context.Context, name string, value int64) (int64, error) {
+	metric, labels, err := storage.ParseSeriesKey(name)
 	if err != nil {
-		// Insert metric and return 0 if error
-		if err := retryIfError(func() error {
-			_, err := r.db.NamedExec(
-				`INSERT INTO counter (name, value) VALUES (:name, :value)`,
-				CounterModel{Name: name, Value: value},
-			)
-			return err
-		}); err != nil {
-			zap.L().Error(`Error while inserting data into Postgres`, zap.Error(err))
-			return 0
-		}
-	} else {
-		// Update metric and return 0 if error
-		if err := retryIfError(func() error {
-			_, err := r.db.NamedExec(
-				`UPDATE counter SET value = :value WHERE name = :name`,
-				CounterModel{Name: name, Value: counterModel.Value + value},
-			)
-			return err
-		}); err != nil {
-			zap.L().Error(`Error while updating data into Postgres`, zap.Error(err))
-			return 0
-		}
+		return 0, err
 	}
 
-	// Get updated value
-	updatedCounterModel, err := r.GetCounterByName(name)
-	if err != nil {
-		return 0
+	// Counter is incremented in a single statement, so concurrent updates are not lost
+	var updated int64
+	if err := retryIfError(ctx, func() error {
+		return r.db.GetContext(ctx, &updated, upsertCounter, metric, labels, value)
+	}); err != nil {
+		zap.L().Error(`Error while updating data into Postgres`, zap.Error(err))
+		return 0, err
 	}
 
-	return updatedCounterModel.Value
+	r.addSample(ctx, `counter`, metric, labels, float64(updated), float64(value))
+
+	return updated, nil
 }
 
 // GetGaugeValue retrieves the value of a gauge by its name from the postgres database.
 //
 // Parameters:
+// - ctx: the context of request.
 // - name: a string representing the name of the gauge.
 //
 // Returns:
 // - value: a float64 representing the value of the gauge.
-// - ok: a boolean indicating whether the gauge was found.
-func (r *PostgresStorage) GetGaugeValue(name string) (float64, bool) {
-	gaugeModel, err := r.GetGaugeByName(name)
+// - error: storage.ErrNotFound if the gauge doesn't exist, otherwise error of Postgres.
+func (r *PostgresStorage) GetGaugeValue(ctx context.Context, name string) (float64, error) {
+	gaugeModel, err := r.GetGaugeByName(ctx, name)
 	if err != nil {
-		return 0, false
+		return 0, err
 	}
 
-	return gaugeModel.Value, true
+	return gaugeModel.Value, nil
 }
 
 // UpdateGaugeMetric updates the gauge metric with the given name and value in the postgres database.
 //
 // Parameters:
+// - ctx: the context of request.
 // - name: the name of the gauge metric (string)
 // - value: the value of the gauge metric (float64)
 //
 // Returns:
 // - the updated value of the gauge metric (float64).
-func (r *PostgresStorage) UpdateGaugeMetric(name string, value float64) float64 {
-	_, err := r.GetGaugeByName(name)
-
-	// If gauge doesn't exist
+// - error: error of Postgres.
+func (r *PostgresStorage) UpdateGaugeMetric(ctx context.Context, name string, value float64) (float64, error) {
+	metric, labels, err := storage.ParseSeriesKey(name)
 	if err != nil {
-		// Insert metric and return 0 if error
-		if err := retryIfError(func() error {
-			_, err := r.db.NamedExec(
-				`INSERT INTO gauge (name, value) VALUES (:name, :value)`,
-				GaugeModel{Name: name, Value: value},
-			)
-			return err
-		}); err != nil {
-			zap.L().Error(`Error while inserting data into Postgres`, zap.Error(err))
-			return 0
+		return 0, err
+	}
+
+	var updated float64
+	if err := retryIfError(ctx, func() error {
+		return r.db.GetContext(ctx, &updated, upsertGauge, metric, labels, value)
+	}); err != nil {
+		zap.L().Error(`Error while updating data into Postgres`, zap.Error(err))
+		return 0, err
+	}
+
+	r.addSample(ctx, `gauge`, metric, labels, updated, updated)
+
+	return updated, nil
+}
+
+// UpdateBatch updates the metrics in order in a single transaction, so the
+// batch is applied either fully or not at all. Samples of history are saved
+// in the same transaction.
+//
+// Parameters:
+// - ctx: the context of request.
+// - metrics: the metrics to update, counters are incremented by Delta.
+//
+// Returns:
+// - []storage.Metric: the metrics with the updated values.
+// - error: error of invalid metric or error of Postgres, nothing is updated then.
+func (r *PostgresStorage) UpdateBatch(ctx context.Context, metrics []storage.Metric) ([]storage.Metric, error) {
+	type series struct {
+		name   string
+		labels storage.Labels
+	}
+
+	keys := make([]series, len(metrics))
+	for i, m := range metrics {
+		if err := m.Check(); err != nil {
+			return nil, err
 		}
-	} else {
-		// Update metric and return 0 if error
-		if err := retryIfError(func() error {
-			_, err := r.db.NamedExec(
-				`UPDATE gauge SET value = :value WHERE name = :name`,
-				GaugeModel{Name: name, Value: value},
-			)
+		keys[i].name, keys[i].labels, _ = storage.ParseSeriesKey(m.Name)
+	}
+
+	updated := make([]storage.Metric, len(metrics))
+
+	// Transaction is rolled back on error, so it is repeated from the start
+	if err := retryIfError(ctx, func() error {
+		tx, err := r.db.BeginTxx(ctx, nil)
+		if err != nil {
 			return err
-		}); err != nil {
-			zap.L().Error(`Error while updating data into Postgres`, zap.Error(err))
-			return 0
 		}
-	}
+		defer tx.Rollback()
+
+		now := time.Now()
+
+		// Rows are upserted one by one, because a single INSERT can't update the same row twice
+		for i, m := range metrics {
+			var value, delta float64
+
+			switch m.MType {
+			case `gauge`:
+				if err := tx.GetContext(ctx, &m.Value, upsertGauge, keys[i].name, keys[i].labels, m.Value); err != nil {
+					return err
+				}
+				value, delta = m.Value, m.Value
+			case `counter`:
+				delta = float64(m.Delta)
+				if err := tx.GetContext(ctx, &m.Delta, upsertCounter, keys[i].name, keys[i].labels, m.Delta); err != nil {
+					return err
+				}
+				value = float64(m.Delta)
+			}
 
-	// Get updated value
-	updatedGaugeModel, err := r.GetGaugeByName(name)
-	if err != nil {
-		return 0
+			if len(r.tiers) > 0 {
+				if _, err := tx.ExecContext(ctx, insertSample, m.MType, keys[i].name, keys[i].labels, now, value, delta); err != nil {
+					return err
+				}
+			}
+
+			updated[i] = m
+		}
+
+		return tx.Commit()
+	}); err != nil {
+		zap.L().Error(`Error while updating batch in Postgres`, zap.Error(err))
+		return nil, err
 	}
 
-	return updatedGaugeModel.Value
+	return updated, nil
 }
 
-// Class 08 errors
-var retriableErrors = []string{
-	`connection_exception`,
-	`connection_does_not_exist`,
-	`connection_failure`,
-	`sqlclient_unable_to_establish_sqlconnection`,
-	`sqlserver_rejected_establishment_of_sqlconnection`,
-	`transaction_resolution_unknown`,
-	`protocol_violation`,
+// retriable checks that error of Postgres can be retried: connection errors
+// of class 08, serialization failure and errors of network, e.g. refused or
+// broken connection, which are not returned as Postgres errors.
+func retriable(err error) bool {
+	// Deadline of context is a net.Error too, but it cannot be retried
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Class() == `08` || pqErr.Code == `40001`
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, driver.ErrBadConn)
 }
 
-// retryIfError retries the given function if it returns an error.
-func retryIfError(f func() error) error {
+// retryIfError retries the given function if it returns retriable error.
+//
+// Retries are stopped if ctx is done. The last error is returned, so it
+// can be checked by errors.Is.
+func retryIfError(ctx context.Context, f func() error) error {
 	return retry.Do(
 		func() error {
 			return f()
 		},
+		retry.Context(ctx),
+		retry.LastErrorOnly(true),
 		retry.DelayType(func(n uint, err error, config *retry.Config) time.Duration {
 			timer := 1 + (n * 2)
 			return time.Duration(timer) * time.Second
 		}),
 		retry.Attempts(3),
-		retry.RetryIf(func(err error) bool {
-			return slices.Contains(retriableErrors, err.Error())
-		}),
+		retry.RetryIf(retriable),
 	)
 }
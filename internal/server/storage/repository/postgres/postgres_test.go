@@ -0,0 +1,170 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
+)
+
+// createStorage connects to Postgres from TEST_DATABASE_DSN, the test is
+// skipped without it.
+func createStorage(t *testing.T) *PostgresStorage {
+	dsn, ok := os.LookupEnv(`TEST_DATABASE_DSN`)
+	if !ok {
+		t.Skip(`TEST_DATABASE_DSN is not set`)
+	}
+
+	s := CreateRepository(Options{PostgresDSN: &dsn})
+	require.NotNil(t, s, `cannot connect to Postgres`)
+	t.Cleanup(func() { s.db.Close() })
+
+	return s
+}
+
+func TestConcurrentCounter(t *testing.T) {
+	s := createStorage(t)
+	ctx := context.Background()
+
+	name := fmt.Sprintf(`PollCount%d`, time.Now().UnixNano())
+	t.Cleanup(func() {
+		s.db.Exec(`DELETE FROM counter WHERE name = $1`, name)
+		s.db.Exec(`DELETE FROM gauge WHERE name = $1`, name)
+	})
+
+	const workers, updates = 20, 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				// The first insert of metric races too
+				_, err := s.UpdateCounterMetric(ctx, name, 1)
+				assert.NoError(t, err)
+				_, err = s.UpdateGaugeMetric(ctx, name, float64(j))
+				assert.NoError(t, err)
+				_, err = s.UpdateBatch(ctx, []storage.Metric{
+					{Name: name, MType: `counter`, Delta: 1},
+					{Name: name, MType: `counter`, Delta: 1},
+				})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := s.GetCounterValue(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3*workers*updates), v)
+
+	_, err = s.GetGaugeValue(ctx, name)
+	assert.NoError(t, err)
+}
+
+func TestFindSeries(t *testing.T) {
+	s := createStorage(t)
+	ctx := context.Background()
+
+	name := fmt.Sprintf(`Requests%d`, time.Now().UnixNano())
+	t.Cleanup(func() {
+		s.db.Exec(`DELETE FROM counter WHERE name = $1`, name)
+		s.db.Exec(`DELETE FROM gauge WHERE name = $1`, name)
+	})
+
+	_, err := s.UpdateBatch(ctx, []storage.Metric{
+		{Name: name + `{code="200",host="a"}`, MType: `counter`, Delta: 1},
+		{Name: name + `{code="500",host="a"}`, MType: `counter`, Delta: 2},
+		{Name: name + `{code="200",host="b"}`, MType: `counter`, Delta: 3},
+		{Name: name, MType: `gauge`, Value: 5},
+	})
+	require.NoError(t, err)
+
+	counters, err := s.FindCounters(ctx, name, storage.Labels{`host`: `a`})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{name + `{code="200",host="a"}`: 1, name + `{code="500",host="a"}`: 2}, counters)
+
+	counters, err = s.FindCounters(ctx, name, nil)
+	require.NoError(t, err)
+	assert.Len(t, counters, 3)
+
+	gauges, err := s.FindGauges(ctx, name, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{name: 5}, gauges)
+}
+
+func TestRetriable(t *testing.T) {
+	refused := &net.OpError{Op: `dial`, Net: `tcp`, Err: syscall.ECONNREFUSED}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: `connection refused`, err: refused, want: true},
+		{name: `wrapped connection refused`, err: fmt.Errorf(`connect: %w`, refused), want: true},
+		{name: `closed connection`, err: io.EOF, want: true},
+		{name: `broken connection`, err: io.ErrUnexpectedEOF, want: true},
+		{name: `bad connection`, err: driver.ErrBadConn, want: true},
+		{name: `connection failure`, err: &pq.Error{Code: `08006`}, want: true},
+		{name: `serialization failure`, err: &pq.Error{Code: `40001`}, want: true},
+		{name: `unique violation`, err: &pq.Error{Code: `23505`}, want: false},
+		{name: `deadline`, err: context.DeadlineExceeded, want: false},
+		{name: `canceled`, err: context.Canceled, want: false},
+		{name: `other error`, err: errors.New(`connection_exception`), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, retriable(tt.err))
+		})
+	}
+}
+
+func TestRetryIfError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		calls int
+	}{
+		{name: `connection failure`, err: &pq.Error{Code: `08006`}, calls: 2},
+		{name: `wrapped connection error`, err: fmt.Errorf(`query: %w`, &pq.Error{Code: `08001`}), calls: 2},
+		{name: `serialization failure`, err: &pq.Error{Code: `40001`}, calls: 2},
+		{name: `unique violation`, err: &pq.Error{Code: `23505`}, calls: 1},
+		{name: `not Postgres error`, err: errors.New(`connection_exception`), calls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryIfError(context.Background(), func() error {
+				calls++
+				if calls == 1 {
+					return tt.err
+				}
+				return nil
+			})
+
+			assert.Equal(t, tt.calls, calls)
+			if tt.calls == 1 {
+				assert.ErrorIs(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -2,10 +2,14 @@
 package repository
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"os"
+	"slices"
 	"strconv"
 	"time"
 
@@ -21,8 +25,15 @@ var (
 	FileStoragePath   = flag.String(`f`, `/tmp/metrics-db.json`, `File storage path`)
 	Restore           = flag.Bool(`r`, true, `Restore from file`)
 	StoreIntervalFlag = flag.Int(`i`, 300, `Store interval in seconds`) // Cannot use flag.Duration because Yandex's autotest send int
+	SnapshotKeep      = flag.Int(`snapshot-keep`, 3, `Count of kept snapshots of memory storage`)
+	HistoryRetention  = flag.Duration(`history-retention`, time.Hour, `Max age of raw values in history of metrics. 0 - history is disabled`)
+	MinuteRetention   = flag.Duration(`history-1m-retention`, 24*time.Hour, `Max age of 1 minute rollups of history. 0 - 1m and 1h rollups are disabled`)
+	HourRetention     = flag.Duration(`history-1h-retention`, 30*24*time.Hour, `Max age of 1 hour rollups of history. 0 - 1h rollups are disabled`)
 )
 
+var errDSN = errors.New(`Postgres DSN is not set`)
+var errMigrateCommand = errors.New(`unknown migrate command, use up, down or status`)
+
 type ServerConfig struct {
 	Address       string `json:"address"`
 	Restore       bool   `json:"restore"`
@@ -30,6 +41,10 @@ type ServerConfig struct {
 	StoreFile     string `json:"store_file"`
 	DatabaseDSN   string `json:"database_dsn"`
 	CryptoKey     string `json:"crypto_key"`
+	SnapshotKeep  int    `json:"snapshot_keep"`
+	History       string `json:"history_retention"`
+	MinuteHistory string `json:"history_1m_retention"`
+	HourHistory   string `json:"history_1h_retention"`
 }
 
 // envParse initializes the StoreInterval, FileStoragePath, and Restore
@@ -57,6 +72,30 @@ func envParse() {
 		}
 	}
 
+	if env, exist := os.LookupEnv(`SNAPSHOT_KEEP`); exist {
+		if n, err := strconv.Atoi(env); err == nil {
+			SnapshotKeep = &n
+		}
+	}
+
+	if env, exist := os.LookupEnv(`HISTORY_RETENTION`); exist {
+		if dur, err := time.ParseDuration(env); err == nil {
+			HistoryRetention = &dur
+		}
+	}
+
+	if env, exist := os.LookupEnv(`HISTORY_1M_RETENTION`); exist {
+		if dur, err := time.ParseDuration(env); err == nil {
+			MinuteRetention = &dur
+		}
+	}
+
+	if env, exist := os.LookupEnv(`HISTORY_1H_RETENTION`); exist {
+		if dur, err := time.ParseDuration(env); err == nil {
+			HourRetention = &dur
+		}
+	}
+
 	if file, err := os.Open(`./server.config.json`); err == nil {
 		defer file.Close()
 
@@ -67,6 +106,20 @@ func envParse() {
 		PostgresDSN = &config.DatabaseDSN
 		Restore = &config.Restore
 		FileStoragePath = &config.StoreFile
+
+		if config.SnapshotKeep > 0 {
+			SnapshotKeep = &config.SnapshotKeep
+		}
+
+		if dur, err := time.ParseDuration(config.History); err == nil {
+			HistoryRetention = &dur
+		}
+		if dur, err := time.ParseDuration(config.MinuteHistory); err == nil {
+			MinuteRetention = &dur
+		}
+		if dur, err := time.ParseDuration(config.HourHistory); err == nil {
+			HourRetention = &dur
+		}
 	}
 
 }
@@ -82,12 +135,18 @@ func CreateRepository() (storage.Storage, bool) {
 	// Parse environment variables
 	envParse()
 
+	history := storage.Tiers(*HistoryRetention, *MinuteRetention, *HourRetention)
+
 	// Log created storage
 	zap.L().Debug(`Storage parameters:`,
 		zap.String(`PostgresDSN`, *PostgresDSN),
 		zap.String(`FileStoragePath`, *FileStoragePath),
 		zap.Duration(`StoreInterval`, StoreInterval),
 		zap.Bool(`Restore`, *Restore),
+		zap.Int(`SnapshotKeep`, *SnapshotKeep),
+		zap.Duration(`HistoryRetention`, *HistoryRetention),
+		zap.Duration(`MinuteRetention`, *MinuteRetention),
+		zap.Duration(`HourRetention`, *HourRetention),
 	)
 
 	// Create Postgres storage
@@ -95,8 +154,16 @@ func CreateRepository() (storage.Storage, bool) {
 		zap.L().Debug(`PostgresStorage created`)
 		p := postgres.CreateRepository(postgres.Options{
 			PostgresDSN: PostgresDSN,
+			History:     history,
 		})
-		return p, p != nil
+		if p == nil {
+			return nil, false
+		}
+
+		// Start rollups of history
+		p.StartTickers()
+
+		return p, true
 	}
 
 	// Create memory storage
@@ -105,6 +172,8 @@ func CreateRepository() (storage.Storage, bool) {
 		StoreInterval:   StoreInterval,
 		FileStoragePath: FileStoragePath,
 		Restore:         Restore,
+		History:         history,
+		SnapshotKeep:    *SnapshotKeep,
 	})
 
 	// Start tickers for MemStorage
@@ -112,3 +181,118 @@ func CreateRepository() (storage.Storage, bool) {
 
 	return memStorage, true
 }
+
+// parseMigrateArgs parses arguments of `migrate` command.
+//
+// Parameters:
+//   - args: the arguments after `migrate`.
+//
+// Returns:
+//   - string: the command.
+//   - string: the Postgres DSN, empty if not set.
+//   - error: errMigrateCommand or error of flags.
+func parseMigrateArgs(args []string) (string, string, error) {
+	fs := flag.NewFlagSet(`migrate`, flag.ContinueOnError)
+	dsn := fs.String(`d`, ``, `Postgres DSN`)
+
+	if err := fs.Parse(args); err != nil {
+		return ``, ``, err
+	}
+	command := fs.Arg(0)
+
+	// Flags after the command
+	if fs.NArg() > 1 {
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return ``, ``, err
+		}
+		if fs.NArg() > 0 {
+			return ``, ``, fmt.Errorf(`%w: unexpected %q`, errMigrateCommand, fs.Arg(0))
+		}
+	}
+
+	if !slices.Contains([]string{`up`, `down`, `status`}, command) {
+		return ``, ``, fmt.Errorf(`%w: %q`, errMigrateCommand, command)
+	}
+
+	return command, *dsn, nil
+}
+
+// Migrate runs command of Postgres migrations.
+//
+// Arguments are `[-d dsn] command [-d dsn]`, flags are parsed by own flag
+// set, so they may follow the command. Postgres DSN from `-d` wins over
+// DATABASE_DSN env and config.
+//
+// Commands:
+//   - up: applies all migrations which are not applied yet.
+//   - down: reverts the last applied migration.
+//   - status: prints all migrations with time they were applied.
+//
+// Parameters:
+//   - args: the arguments after `migrate`.
+//   - out: the writer for report of command.
+//
+// Return:
+//   - error: errDSN, errMigrateCommand, error of flags or error of Postgres.
+func Migrate(args []string, out io.Writer) error {
+	command, dsn, err := parseMigrateArgs(args)
+	if err != nil {
+		return err
+	}
+
+	// Parse environment variables
+	envParse()
+
+	if dsn == `` {
+		dsn = *PostgresDSN
+	}
+	if dsn == `` {
+		return errDSN
+	}
+
+	ctx := context.Background()
+
+	db, err := postgres.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch command {
+	case `up`:
+		applied, err := postgres.MigrateUp(ctx, db)
+		for _, m := range applied {
+			fmt.Fprintf(out, "Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(out, `Schema is up to date`)
+		}
+	case `down`:
+		reverted, err := postgres.MigrateDown(ctx, db)
+		if err != nil {
+			return err
+		}
+		if reverted == nil {
+			fmt.Fprintln(out, `Nothing to revert`)
+			return nil
+		}
+		fmt.Fprintf(out, "Reverted %04d_%s\n", reverted.Version, reverted.Name)
+	case `status`:
+		status, err := postgres.GetMigrationStatus(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, m := range status {
+			applied := `pending`
+			if m.AppliedAt != nil {
+				applied = m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%04d_%s\t%s\n", m.Version, m.Name, applied)
+		}
+	}
+
+	return nil
+}
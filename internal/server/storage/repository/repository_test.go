@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMigrateArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		command string
+		dsn     string
+		err     error
+	}{
+		{name: `flags before command`, args: []string{`-d`, `postgres://db`, `up`}, command: `up`, dsn: `postgres://db`},
+		{name: `flags after command`, args: []string{`down`, `-d`, `postgres://db`}, command: `down`, dsn: `postgres://db`},
+		{name: `without flags`, args: []string{`status`}, command: `status`},
+		{name: `unknown command`, args: []string{`drop`}, err: errMigrateCommand},
+		{name: `no command`, args: nil, err: errMigrateCommand},
+		{name: `extra argument`, args: []string{`up`, `down`}, err: errMigrateCommand},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, dsn, err := parseMigrateArgs(tt.args)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.command, command)
+			assert.Equal(t, tt.dsn, dsn)
+		})
+	}
+}
@@ -1,20 +1,74 @@
 // Package storage provide interface for store data in memory or postgres
 package storage
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrMetricType is returned if type of metric is not `gauge` or `counter`.
+var ErrMetricType = errors.New(`type of metric is invalid`)
+
+// Metric is an update of metric in batch.
+type Metric struct {
+	Name  string  // Key of metric with labels, see SeriesKey
+	MType string  // Gauge or Counter
+	Delta int64   // Value added to counter, the updated value in result of UpdateBatch
+	Value float64 // Value of gauge
+}
+
+// Check checks that metric can be saved by UpdateBatch.
+//
+// Returns:
+//   - error: ErrMetricType or error of invalid key.
+func (m Metric) Check() error {
+	if m.MType != `gauge` && m.MType != `counter` {
+		return fmt.Errorf(`%w: %q`, ErrMetricType, m.MType)
+	}
+
+	_, _, err := ParseSeriesKey(m.Name)
+	return err
+}
+
 // Storage interface for work with storage
+//
+// Every method takes context of request, so cancellation and timeouts are
+// passed to the database. Errors of storage are returned to the caller.
 type Storage interface {
-	// Update the gauge metric with the given name and value in the MemStorage struct.
-	UpdateGaugeMetric(name string, value float64) float64
+	// Update the gauge metric with the given name and value, return the saved value.
+	UpdateGaugeMetric(ctx context.Context, name string, value float64) (float64, error)
+
+	// Add the value to the counter metric, return the updated value.
+	UpdateCounterMetric(ctx context.Context, name string, value int64) (int64, error)
+
+	// Update metrics in order, the batch applies either fully or not at all.
+	// Return metrics with the updated values.
+	UpdateBatch(ctx context.Context, metrics []Metric) ([]Metric, error)
+
+	// Return the gauge and counter maps.
+	GetValues(ctx context.Context) (map[string]float64, map[string]int64, error)
+
+	// Retrieve the value of a counter, ErrNotFound if it doesn't exist.
+	GetCounterValue(ctx context.Context, name string) (int64, error)
+
+	// Return the value of a gauge by its name, ErrNotFound if it doesn't exist.
+	GetGaugeValue(ctx context.Context, name string) (float64, error)
 
-	// Update the counter metric in the MemStorage.
-	UpdateCounterMetric(name string, value int64) int64
+	// Return counters with the name of metric whose labels contain all labels
+	// of filter, by keys. Other metrics are not read.
+	FindCounters(ctx context.Context, name string, filter Labels) (map[string]int64, error)
 
-	// Return the gauge and counter maps from the MemStorage struct.
-	GetValues() (map[string]float64, map[string]int64)
+	// Return gauges with the name of metric whose labels contain all labels
+	// of filter, by keys. Other metrics are not read.
+	FindGauges(ctx context.Context, name string, filter Labels) (map[string]float64, error)
 
-	// Retrieve the value of a counter from the MemStorage.
-	GetCounterValue(name string) (int64, bool)
+	// Return buckets of a gauge in [from, to) sorted by time. Buckets are of
+	// the coarsest tier which satisfies step, see TierOf.
+	GetGaugeHistory(ctx context.Context, name string, from, to time.Time, step time.Duration) ([]Bucket, error)
 
-	// Return the value of a gauge by its name.
-	GetGaugeValue(name string) (float64, bool)
+	// Return buckets of a counter in [from, to) sorted by time. Buckets are of
+	// the coarsest tier which satisfies step, see TierOf.
+	GetCounterHistory(ctx context.Context, name string, from, to time.Time, step time.Duration) ([]Bucket, error)
 }
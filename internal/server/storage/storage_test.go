@@ -1,6 +1,8 @@
 package storage_test
 
 import (
+	"context"
+
 	"github.com/Jourloy/go-metrics-collector/internal/server/storage"
 	"github.com/Jourloy/go-metrics-collector/internal/server/storage/repository"
 )
@@ -15,5 +17,5 @@ func Example() {
 	}
 
 	// Use repository
-	s.GetValues()
+	s.GetValues(context.Background())
 }
@@ -0,0 +1,216 @@
+// Package sign provide HMAC-SHA256 signatures shared by agent and server
+package sign
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sum returns hex encoded HMAC-SHA256 of the given parts.
+//
+// Parameters:
+//   - key: the secret key.
+//   - parts: the data to sign. Parts are written one after another.
+//
+// Returns:
+//   - string: hex encoded signature.
+func Sum(key string, parts ...[]byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks the hex encoded signature of the given parts in constant time.
+//
+// Parameters:
+//   - key: the secret key.
+//   - signature: hex encoded signature to check.
+//   - parts: the signed data.
+//
+// Returns:
+//   - bool: true if the signature is valid.
+func Verify(key string, signature string, parts ...[]byte) bool {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	want, _ := hex.DecodeString(Sum(key, parts...))
+	return hmac.Equal(got, want)
+}
+
+// VerifyLegacy checks signature of agents made before HMAC signatures: hex
+// encoded AES-GCM seal of body. Key of cipher is SHA-256 of the key, nonce is
+// the tail of it.
+//
+// The format is deprecated, nonce is fixed and there is no protection from
+// replay, so it is checked only for compatibility with old agents.
+//
+// Parameters:
+//   - key: the secret key.
+//   - signature: hex encoded seal to check.
+//   - body: the signed body.
+//
+// Returns:
+//   - bool: true if the signature is valid.
+func VerifyLegacy(key string, signature string, body []byte) bool {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(got, SealLegacy(key, body))
+}
+
+// SealLegacy returns AES-GCM seal of body as made by old agents, see VerifyLegacy.
+func SealLegacy(key string, body []byte) []byte {
+	k := sha256.Sum256([]byte(key))
+
+	// Key has valid length for AES-256 and GCM has standard nonce size, so there are no errors
+	block, _ := aes.NewCipher(k[:])
+	gcm, _ := cipher.NewGCM(block)
+
+	return gcm.Seal(nil, k[len(k)-gcm.NonceSize():], body, nil)
+}
+
+// Headers of signed HTTP request.
+const (
+	HeaderHash      = `HashSHA256`
+	HeaderTimestamp = `X-Timestamp`
+	HeaderNonce     = `X-Nonce`
+)
+
+var errReplay = errors.New(`request is replayed`)
+var errCacheFull = errors.New(`nonce cache is full`)
+
+// SumRequest returns signature of request with timestamp and nonce.
+//
+// Parameters:
+//   - key: the secret key.
+//   - timestamp: unix time of request in seconds.
+//   - nonce: unique string of request.
+//   - body: the body of request.
+//
+// Returns:
+//   - string: hex encoded signature.
+func SumRequest(key string, timestamp string, nonce string, body []byte) string {
+	return Sum(key, []byte(timestamp+"\n"+nonce+"\n"), body)
+}
+
+// VerifyRequest checks signature of request with timestamp and nonce.
+func VerifyRequest(key string, signature string, timestamp string, nonce string, body []byte) bool {
+	return Verify(key, signature, []byte(timestamp+"\n"+nonce+"\n"), body)
+}
+
+// SumMessage returns signature of message of stream. Stream is identified by
+// timestamp and nonce of its opening, so messages cannot be moved into other
+// stream, and number of message prevents its replay inside the stream.
+//
+// Parameters:
+//   - key: the secret key.
+//   - timestamp: unix time of stream opening in seconds.
+//   - nonce: unique string of stream.
+//   - seq: the number of message in stream, starting from 0.
+//   - body: the message.
+//
+// Returns:
+//   - string: hex encoded signature.
+func SumMessage(key string, timestamp string, nonce string, seq int64, body []byte) string {
+	return Sum(key, []byte(timestamp+"\n"+nonce+"\n"+strconv.FormatInt(seq, 10)+"\n"), body)
+}
+
+// VerifyMessage checks signature of message of stream, see SumMessage.
+func VerifyMessage(key string, signature string, timestamp string, nonce string, seq int64, body []byte) bool {
+	return Verify(key, signature, []byte(timestamp+"\n"+nonce+"\n"+strconv.FormatInt(seq, 10)+"\n"), body)
+}
+
+// NewNonce returns random hex encoded string for signed request.
+func NewNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NonceCache remembers nonces of accepted requests while their timestamps
+// are inside the acceptance window, so the same request cannot be accepted twice.
+type NonceCache struct {
+	sync.Mutex
+	window time.Duration
+	limit  int
+	nonces map[string]time.Time
+}
+
+// NewNonceCache creates a cache for nonces.
+//
+// Parameters:
+//   - window: max difference between timestamp of request and current time.
+//   - limit: max count of remembered nonces.
+//
+// Returns:
+//   - *NonceCache: the cache.
+func NewNonceCache(window time.Duration, limit int) *NonceCache {
+	return &NonceCache{
+		window: window,
+		limit:  limit,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// Check verifies that timestamp is inside the window and remembers the nonce.
+//
+// Parameters:
+//   - nonce: unique string of request.
+//   - timestamp: unix time of request in seconds.
+//   - now: current time.
+//
+// Returns:
+//   - error: an error if timestamp is outside the window or nonce was already used.
+func (c *NonceCache) Check(nonce string, timestamp string, now time.Time) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf(`timestamp is invalid: %w`, err)
+	}
+
+	ts := time.Unix(unix, 0)
+	if ts.Before(now.Add(-c.window)) || ts.After(now.Add(c.window)) {
+		return fmt.Errorf(`timestamp is outside of %s window`, c.window)
+	}
+
+	if nonce == `` {
+		return errors.New(`nonce is empty`)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.nonces[nonce]; ok {
+		return errReplay
+	}
+
+	// Forget nonces which cannot be accepted anymore
+	if len(c.nonces) >= c.limit {
+		for n, expire := range c.nonces {
+			if expire.Before(now) {
+				delete(c.nonces, n)
+			}
+		}
+	}
+
+	if len(c.nonces) >= c.limit {
+		return errCacheFull
+	}
+
+	c.nonces[nonce] = ts.Add(c.window)
+	return nil
+}
@@ -0,0 +1,64 @@
+package sign
+
+import (
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	h := SumRequest(`key`, `100`, `nonce`, body)
+
+	assert.True(t, VerifyRequest(`key`, h, `100`, `nonce`, body))
+	assert.False(t, VerifyRequest(`other`, h, `100`, `nonce`, body))
+	assert.False(t, VerifyRequest(`key`, h, `101`, `nonce`, body))
+	assert.False(t, VerifyRequest(`key`, h, `100`, `other`, body))
+	assert.False(t, VerifyRequest(`key`, `not hex`, `100`, `nonce`, body))
+}
+
+func TestVerifyMessage(t *testing.T) {
+	body := []byte(`batch`)
+	h := SumMessage(`key`, `100`, `nonce`, 1, body)
+
+	assert.True(t, VerifyMessage(`key`, h, `100`, `nonce`, 1, body))
+	assert.False(t, VerifyMessage(`key`, h, `100`, `nonce`, 2, body))
+	assert.False(t, VerifyMessage(`key`, h, `100`, `other`, 1, body))
+	assert.False(t, VerifyMessage(`other`, h, `100`, `nonce`, 1, body))
+}
+
+func TestVerifyLegacy(t *testing.T) {
+	body := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+	h := hex.EncodeToString(SealLegacy(`key`, body))
+
+	assert.True(t, VerifyLegacy(`key`, h, body))
+	assert.False(t, VerifyLegacy(`other`, h, body))
+	assert.False(t, VerifyLegacy(`key`, h, []byte(`{}`)))
+	assert.False(t, VerifyLegacy(`key`, Sum(`key`, body), body))
+	assert.False(t, VerifyLegacy(`key`, `not hex`, body))
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	c := NewNonceCache(time.Minute, 2)
+
+	assert.NoError(t, c.Check(`a`, ts, now))
+	assert.ErrorIs(t, c.Check(`a`, ts, now), errReplay)
+
+	// Outside of window
+	assert.Error(t, c.Check(`b`, `900`, now))
+	assert.Error(t, c.Check(`b`, `1100`, now))
+	assert.Error(t, c.Check(`b`, `invalid`, now))
+
+	assert.NoError(t, c.Check(`b`, ts, now))
+	assert.ErrorIs(t, c.Check(`c`, ts, now), errCacheFull)
+
+	// Old nonces are forgotten after window
+	later := now.Add(2 * time.Minute)
+	assert.NoError(t, c.Check(`c`, strconv.FormatInt(later.Unix(), 10), later))
+}